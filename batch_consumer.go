@@ -1,5 +1,23 @@
 package rmq
 
+import "context"
+
 type BatchConsumer interface {
 	Consume(batch Deliveries)
 }
+
+// BatchConsumerWithContext is like BatchConsumer, but gets a context which is
+// cancelled when the queue stops consuming or the consume timeout of the queue
+// elapses
+type BatchConsumerWithContext interface {
+	Consume(ctx context.Context, batch Deliveries)
+}
+
+// contextBatchConsumer adapts a BatchConsumer to BatchConsumerWithContext
+type contextBatchConsumer struct {
+	consumer BatchConsumer
+}
+
+func (consumer contextBatchConsumer) Consume(ctx context.Context, batch Deliveries) {
+	consumer.consumer.Consume(batch)
+}
@@ -1,61 +1,195 @@
 package rmq
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/adjust/uniuri"
+)
 
 type Cleaner struct {
 	connection Connection
+	token      string                   // identifies this cleaner in the cleaner lock
+	onClean    func(CleanResult, error) // optional, see OnClean
+}
+
+// CleanResult reports what a call to Clean did
+type CleanResult struct {
+	Connections []string       // names of the cleaned connections
+	Returned    map[string]int // number of unacked deliveries returned to ready per queue
 }
 
 func NewCleaner(connection Connection) *Cleaner {
-	return &Cleaner{connection: connection}
+	return &Cleaner{
+		connection: connection,
+		token:      uniuri.NewLen(12),
+	}
+}
+
+// OnClean sets a function which Run calls after each clean with its result
+func (cleaner *Cleaner) OnClean(handler func(result CleanResult, err error)) {
+	cleaner.onClean = handler
+}
+
+// Run calls Clean every interval until ctx is done and returns ctx.Err()
+// cleaners of all hosts compete for a lock in Redis and only the one holding
+// it cleans, so they never return unacked deliveries concurrently. The lock
+// expires after two intervals if its holder stops cleaning
+func (cleaner *Cleaner) Run(ctx context.Context, interval time.Duration) error {
+	cleanerConnection, ok := cleaner.connection.(*redisConnection)
+	if !ok {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		leader, err := cleaner.lock(cleanerConnection, 2*interval)
+		if leader && err == nil {
+			var result CleanResult
+			result, err = cleaner.Clean()
+			if cleaner.onClean != nil {
+				cleaner.onClean(result, err)
+			}
+		} else if err != nil && cleaner.onClean != nil {
+			cleaner.onClean(CleanResult{}, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			cleaner.unlock(cleanerConnection)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
 
-func (cleaner *Cleaner) Clean() error {
+// lock acquires or extends the cleaner lock, returns true if this cleaner holds it
+func (cleaner *Cleaner) lock(connection *redisConnection, ttl time.Duration) (bool, error) {
+	ttlMillis := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	locked, err := connection.redisClient.RunScript(lockScript, []string{connection.keys.cleanerLock}, cleaner.token, ttlMillis)
+	return locked == 1, err
+}
+
+// unlock releases the cleaner lock if this cleaner holds it, so that other
+// cleaners can take over right away
+func (cleaner *Cleaner) unlock(connection *redisConnection) {
+	connection.redisClient.RunScript(unlockScript, []string{connection.keys.cleanerLock}, cleaner.token)
+}
+
+// Clean cleans all connections whose heartbeat died by returning their unacked
+// deliveries to ready and removing them. Deliveries of active connections are
+// returned if their lease expired (see SetLeaseDuration)
+func (cleaner *Cleaner) Clean() (CleanResult, error) {
+	result := CleanResult{Returned: map[string]int{}}
 	cleanerConnection, ok := cleaner.connection.(*redisConnection)
 	if !ok {
-		return nil
+		return result, nil
+	}
+	connectionNames, err := cleanerConnection.GetConnections()
+	if err != nil {
+		return result, err
 	}
-	connectionNames := cleanerConnection.GetConnections()
 	for _, connectionName := range connectionNames {
 		connection := cleanerConnection.hijackConnection(connectionName)
-		if connection.Check() {
-			continue // skip active connections!
+		switch err := connection.Check(); err {
+		case nil: // skip active connections, but return their expired leases
+			returned, err := returnExpiredLeases(connection)
+			for queueName, count := range returned {
+				result.Returned[queueName] += count
+			}
+			if err != nil {
+				return result, err
+			}
+			continue
+		case ErrNotFound:
+		default:
+			return result, err
 		}
 
-		if err := CleanConnection(connection); err != nil {
-			return err
+		returned, err := CleanConnection(connection)
+		for queueName, count := range returned {
+			result.Returned[queueName] += count
 		}
+		if err != nil {
+			return result, err
+		}
+		result.Connections = append(result.Connections, connectionName)
 	}
 
-	return nil
+	return result, nil
 }
 
-func CleanConnection(connection *redisConnection) error {
-	queueNames := connection.GetConsumingQueues()
+// CleanConnection returns the unacked deliveries of all queues consumed by the
+// connection to ready and removes the connection, returns the number of
+// returned deliveries per queue
+func CleanConnection(connection *redisConnection) (map[string]int, error) {
+	returned := map[string]int{}
+	queueNames, err := connection.GetConsumingQueues()
+	if err != nil {
+		return returned, err
+	}
 	for _, queueName := range queueNames {
-		queue, ok := connection.OpenQueue(queueName).(*redisQueue)
-		if !ok {
-			return fmt.Errorf("rmq cleaner failed to open queue %s", queueName)
+		queue, err := connection.OpenQueue(queueName)
+		if err != nil {
+			return returned, fmt.Errorf("rmq cleaner failed to open queue %s %s", queueName, err)
 		}
 
-		CleanQueue(queue)
+		count, err := CleanQueue(queue.(*redisQueue))
+		returned[queueName] = count
+		if err != nil {
+			return returned, fmt.Errorf("rmq cleaner failed to clean queue %s %s", queueName, err)
+		}
 	}
 
-	if !connection.Close() {
-		return fmt.Errorf("rmq cleaner failed to close connection %s", connection)
+	if err := connection.Close(); err != nil {
+		return returned, fmt.Errorf("rmq cleaner failed to close connection %s %s", connection, err)
 	}
 
 	if err := connection.CloseAllQueuesInConnection(); err != nil {
-		return fmt.Errorf("rmq cleaner failed to close all queues %s %s", connection, err)
+		return returned, fmt.Errorf("rmq cleaner failed to close all queues %s %s", connection, err)
 	}
 
-	// log.Printf("rmq cleaner cleaned connection %s", connection)
-	return nil
+	connection.logger.Info("cleaned connection", "connection", connection.Name, "returned", returned)
+	return returned, nil
 }
 
-func CleanQueue(queue *redisQueue) {
-	returned := queue.ReturnAllUnacked()
-	queue.CloseInConnection()
-	_ = returned
-	// log.Printf("rmq cleaner cleaned queue %s %d", queue, returned)
+// returnExpiredLeases returns the deliveries with expired leases of all queues
+// consumed by the connection to ready, returns the number of returned
+// deliveries per queue which had any
+func returnExpiredLeases(connection *redisConnection) (map[string]int, error) {
+	returned := map[string]int{}
+	queueNames, err := connection.GetConsumingQueues()
+	if err != nil {
+		return returned, err
+	}
+	for _, queueName := range queueNames {
+		queue := connection.openQueue(queueName)
+		count, err := queue.ReturnExpiredLeases()
+		if count > 0 {
+			returned[queueName] = count
+		}
+		if err != nil {
+			return returned, fmt.Errorf("rmq cleaner failed to return expired leases %s %s", queueName, err)
+		}
+	}
+	return returned, nil
+}
+
+// CleanQueue returns all unacked deliveries of the queue back to ready and
+// returns the number of returned deliveries
+func CleanQueue(queue *redisQueue) (int, error) {
+	returned, err := queue.ReturnAllUnacked()
+	if err != nil {
+		return returned, err
+	}
+	if err := queue.CloseInConnection(); err != nil {
+		return returned, err
+	}
+	queue.logger.Debug("cleaned queue", "queue", queue.name, "connection", queue.connectionName, "returned", returned)
+	return returned, nil
 }
@@ -1,6 +1,7 @@
 package rmq
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -14,36 +15,36 @@ func TestCleanerSuite(t *testing.T) {
 type CleanerSuite struct{}
 
 func (suite *CleanerSuite) TestCleaner(c *C) {
-	flushConn := OpenConnection("cleaner-flush", "tcp", "localhost:6379", 1)
+	flushConn := openConnection(c, "cleaner-flush")
 	flushConn.flushDb()
 	flushConn.StopHeartbeat()
 
-	conn := OpenConnection("cleaner-conn1", "tcp", "localhost:6379", 1)
-	c.Check(conn.GetOpenQueues(), HasLen, 0)
-	queue := conn.OpenQueue("q1").(*redisQueue)
-	c.Check(conn.GetOpenQueues(), HasLen, 1)
-	conn.OpenQueue("q2")
-	c.Check(conn.GetOpenQueues(), HasLen, 2)
+	conn := openConnection(c, "cleaner-conn1")
+	c.Check(openQueues(c, conn), HasLen, 0)
+	queue := openQueue(c, conn, "q1")
+	c.Check(openQueues(c, conn), HasLen, 1)
+	openQueue(c, conn, "q2")
+	c.Check(openQueues(c, conn), HasLen, 2)
 
-	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(readyCount(c, queue), Equals, 0)
 	queue.Publish("del1")
-	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(readyCount(c, queue), Equals, 1)
 	queue.Publish("del2")
-	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(readyCount(c, queue), Equals, 2)
 	queue.Publish("del3")
-	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(readyCount(c, queue), Equals, 3)
 	queue.Publish("del4")
-	c.Check(queue.ReadyCount(), Equals, 4)
+	c.Check(readyCount(c, queue), Equals, 4)
 	queue.Publish("del5")
-	c.Check(queue.ReadyCount(), Equals, 5)
+	c.Check(readyCount(c, queue), Equals, 5)
 	queue.Publish("del6")
-	c.Check(queue.ReadyCount(), Equals, 6)
+	c.Check(readyCount(c, queue), Equals, 6)
 
-	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(unackedCount(c, queue), Equals, 0)
 	queue.StartConsuming(2, time.Millisecond)
 	time.Sleep(time.Millisecond)
-	c.Check(queue.UnackedCount(), Equals, 2)
-	c.Check(queue.ReadyCount(), Equals, 4)
+	c.Check(unackedCount(c, queue), Equals, 2)
+	c.Check(readyCount(c, queue), Equals, 4)
 
 	consumer := NewTestConsumer("c-A")
 	consumer.AutoFinish = false
@@ -51,45 +52,45 @@ func (suite *CleanerSuite) TestCleaner(c *C) {
 
 	queue.AddConsumer("consumer1", consumer)
 	time.Sleep(10 * time.Millisecond)
-	c.Check(queue.UnackedCount(), Equals, 3)
-	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(unackedCount(c, queue), Equals, 3)
+	c.Check(readyCount(c, queue), Equals, 3)
 
-	c.Assert(consumer.LastDelivery, NotNil)
-	c.Check(consumer.LastDelivery.Payload(), Equals, "del1")
-	c.Check(consumer.LastDelivery.Ack(), Equals, true)
+	c.Assert(consumer.Last(), NotNil)
+	c.Check(consumer.Last().Payload(), Equals, "del1")
+	c.Check(consumer.Last().Ack(), IsNil)
 	time.Sleep(10 * time.Millisecond)
-	c.Check(queue.UnackedCount(), Equals, 2)
-	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(unackedCount(c, queue), Equals, 2)
+	c.Check(readyCount(c, queue), Equals, 3)
 
 	consumer.Finish()
 	time.Sleep(10 * time.Millisecond)
-	c.Check(queue.UnackedCount(), Equals, 3)
-	c.Check(queue.ReadyCount(), Equals, 2)
-	c.Check(consumer.LastDelivery.Payload(), Equals, "del2")
+	c.Check(unackedCount(c, queue), Equals, 3)
+	c.Check(readyCount(c, queue), Equals, 2)
+	c.Check(consumer.Last().Payload(), Equals, "del2")
 
 	queue.StopConsuming()
 	conn.StopHeartbeat()
 	time.Sleep(time.Millisecond)
 
-	conn = OpenConnection("cleaner-conn1", "tcp", "localhost:6379", 1)
-	queue = conn.OpenQueue("q1").(*redisQueue)
+	conn = openConnection(c, "cleaner-conn1")
+	queue = openQueue(c, conn, "q1")
 
 	queue.Publish("del7")
-	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(readyCount(c, queue), Equals, 3)
 	queue.Publish("del7")
-	c.Check(queue.ReadyCount(), Equals, 4)
+	c.Check(readyCount(c, queue), Equals, 4)
 	queue.Publish("del8")
-	c.Check(queue.ReadyCount(), Equals, 5)
+	c.Check(readyCount(c, queue), Equals, 5)
 	queue.Publish("del9")
-	c.Check(queue.ReadyCount(), Equals, 6)
+	c.Check(readyCount(c, queue), Equals, 6)
 	queue.Publish("del10")
-	c.Check(queue.ReadyCount(), Equals, 7)
+	c.Check(readyCount(c, queue), Equals, 7)
 
-	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(unackedCount(c, queue), Equals, 0)
 	queue.StartConsuming(2, time.Millisecond)
 	time.Sleep(time.Millisecond)
-	c.Check(queue.UnackedCount(), Equals, 2)
-	c.Check(queue.ReadyCount(), Equals, 5)
+	c.Check(unackedCount(c, queue), Equals, 2)
+	c.Check(readyCount(c, queue), Equals, 5)
 
 	consumer = NewTestConsumer("c-B")
 	consumer.AutoFinish = false
@@ -97,44 +98,146 @@ func (suite *CleanerSuite) TestCleaner(c *C) {
 
 	queue.AddConsumer("consumer2", consumer)
 	time.Sleep(10 * time.Millisecond)
-	c.Check(queue.UnackedCount(), Equals, 3)
-	c.Check(queue.ReadyCount(), Equals, 4)
-	c.Check(consumer.LastDelivery.Payload(), Equals, "del5")
+	c.Check(unackedCount(c, queue), Equals, 3)
+	c.Check(readyCount(c, queue), Equals, 4)
+	c.Check(consumer.Last().Payload(), Equals, "del5")
 
 	consumer.Finish() // unacked
 	time.Sleep(10 * time.Millisecond)
-	c.Check(queue.UnackedCount(), Equals, 4)
-	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(unackedCount(c, queue), Equals, 4)
+	c.Check(readyCount(c, queue), Equals, 3)
 
-	c.Check(consumer.LastDelivery.Payload(), Equals, "del6")
-	c.Check(consumer.LastDelivery.Ack(), Equals, true)
+	c.Check(consumer.Last().Payload(), Equals, "del6")
+	c.Check(consumer.Last().Ack(), IsNil)
 	time.Sleep(10 * time.Millisecond)
-	c.Check(queue.UnackedCount(), Equals, 3)
-	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(unackedCount(c, queue), Equals, 3)
+	c.Check(readyCount(c, queue), Equals, 3)
 
 	queue.StopConsuming()
 	conn.StopHeartbeat()
 	time.Sleep(time.Millisecond)
 
-	cleanerConn := OpenConnection("cleaner-conn", "tcp", "localhost:6379", 1)
+	cleanerConn := openConnection(c, "cleaner-conn")
 	cleaner := NewCleaner(cleanerConn)
-	c.Check(cleaner.Clean(), IsNil)
-	c.Check(queue.ReadyCount(), Equals, 9) // 2 of 11 were acked above
-	c.Check(conn.GetOpenQueues(), HasLen, 2)
-
-	conn = OpenConnection("cleaner-conn1", "tcp", "localhost:6379", 1)
-	queue = conn.OpenQueue("q1").(*redisQueue)
+	result, err := cleaner.Clean()
+	c.Check(err, IsNil)
+	c.Check(result.Connections, HasLen, 2)
+	c.Check(result.Returned, DeepEquals, map[string]int{"q1": 6})
+	c.Check(readyCount(c, queue), Equals, 9) // 2 of 11 were acked above
+	c.Check(openQueues(c, conn), HasLen, 2)
+
+	conn = openConnection(c, "cleaner-conn1")
+	queue = openQueue(c, conn, "q1")
 	queue.StartConsuming(10, time.Millisecond)
 	consumer = NewTestConsumer("c-C")
 
 	queue.AddConsumer("consumer3", consumer)
 	time.Sleep(10 * time.Millisecond)
-	c.Check(consumer.LastDeliveries, HasLen, 9)
+	c.Check(consumer.Deliveries(), HasLen, 9)
 
 	queue.StopConsuming()
 	conn.StopHeartbeat()
 	time.Sleep(time.Millisecond)
 
-	c.Check(cleaner.Clean(), IsNil)
+	result, err = cleaner.Clean()
+	c.Check(err, IsNil)
+	c.Check(result.Connections, HasLen, 1)
+	c.Check(result.Returned, DeepEquals, map[string]int{"q1": 0})
+	cleanerConn.StopHeartbeat()
+}
+
+func (suite *CleanerSuite) TestCleanerRun(c *C) {
+	flushConn := openConnection(c, "cleaner-flush")
+	flushConn.flushDb()
+	flushConn.StopHeartbeat()
+
+	conn := openConnection(c, "cleaner-run-conn")
+	queue := openQueue(c, conn, "cleaner-run-q")
+	_, err := queue.PurgeReady()
+	c.Check(err, IsNil)
+	c.Check(queue.Publish("run-d1", "run-d2"), IsNil)
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	consumer := NewTestConsumer("cleaner-run-cons")
+	consumer.AutoAck = false
+	_, err = queue.AddConsumer("cleaner-run-cons", consumer)
+	c.Check(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.Deliveries(), HasLen, 2)
+	<-queue.StopConsuming()
+	conn.StopHeartbeat()
+	time.Sleep(time.Millisecond)
+
+	cleanerConn1 := openConnection(c, "cleaner-run1")
+	cleanerConn2 := openConnection(c, "cleaner-run2")
+	cleaner1 := NewCleaner(cleanerConn1)
+	cleaner2 := NewCleaner(cleanerConn2)
+
+	results := make(chan CleanResult, 10)
+	onClean := func(result CleanResult, err error) {
+		c.Check(err, IsNil)
+		results <- result
+	}
+	cleaner1.OnClean(onClean)
+	cleaner2.OnClean(onClean)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	done1 := make(chan error)
+	go func() { done1 <- cleaner1.Run(ctx1, time.Hour) }()
+	result := <-results
+	c.Check(result.Connections, DeepEquals, []string{conn.Name})
+	c.Check(result.Returned, DeepEquals, map[string]int{"cleaner-run-q": 2})
+	c.Check(readyCount(c, queue), Equals, 2)
+
+	// cleaner1 holds the lock, so cleaner2 doesn't clean
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	done2 := make(chan error)
+	go func() { done2 <- cleaner2.Run(ctx2, 5*time.Millisecond) }()
+	time.Sleep(20 * time.Millisecond)
+	c.Check(results, HasLen, 0)
+
+	// cleaner2 takes over once cleaner1 released the lock
+	cancel1()
+	c.Check(<-done1, Equals, context.Canceled)
+	select {
+	case <-results:
+	case <-time.After(time.Second):
+		c.Error("cleaner2 didn't take over")
+	}
+	cancel2()
+	c.Check(<-done2, Equals, context.Canceled)
+
+	cleanerConn1.StopHeartbeat()
+	cleanerConn2.StopHeartbeat()
+}
+
+func (suite *CleanerSuite) TestCleanerLeases(c *C) {
+	conn := openConnection(c, "cleaner-lease-conn")
+	queue := openQueue(c, conn, "cleaner-lease-q")
+	_, err := queue.PurgeReady()
+	c.Check(err, IsNil)
+	queue.SetLeaseDuration(20 * time.Millisecond)
+	c.Check(queue.Publish("lease-d1"), IsNil)
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	consumer := NewTestConsumer("cleaner-lease-cons")
+	consumer.AutoAck = false
+	_, err = queue.AddConsumer("cleaner-lease-cons", consumer)
+	c.Check(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.Deliveries(), HasLen, 1)
+	<-queue.StopConsuming()
+
+	// the connection is still active, but the lease expired
+	cleanerConn := openConnection(c, "cleaner-lease")
+	result, err := NewCleaner(cleanerConn).Clean()
+	c.Check(err, IsNil)
+	c.Check(result.Returned["cleaner-lease-q"], Equals, 0)
+	time.Sleep(20 * time.Millisecond)
+	result, err = NewCleaner(cleanerConn).Clean()
+	c.Check(err, IsNil)
+	c.Check(result.Returned["cleaner-lease-q"], Equals, 1)
+	c.Check(readyCount(c, queue), Equals, 1)
+	c.Check(unackedCount(c, queue), Equals, 0)
+
+	conn.StopHeartbeat()
 	cleanerConn.StopHeartbeat()
 }
@@ -1,22 +1,31 @@
 package rmq
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/adjust/uniuri"
 	"github.com/go-redis/redis/v7"
 )
 
-const heartbeatDuration = time.Minute
+const (
+	heartbeatDuration = time.Minute
+	heartbeatInterval = time.Second
+)
 
 // Connection is an interface that can be used to test publishing
 type Connection interface {
-	OpenQueue(name string) Queue
-	CollectStats(queueList []string) Stats
-	GetOpenQueues() []string
+	OpenQueue(name string) (Queue, error)
+	OpenQueueContext(ctx context.Context, name string) (Queue, error)
+	StopAllConsuming() <-chan struct{}
+	ConsumeMany(queues []Queue, weights []int, prefetchLimit int) (MultiQueue, error)
+	HeartbeatErrors() <-chan error
+	CollectStats(queueList []string) (Stats, error)
+	CollectStatsContext(ctx context.Context, queueList []string) (Stats, error)
+	GetOpenQueues() ([]string, error)
 }
 
 // Connection is the entry point. Use a connection to access queues, consumers and deliveries
@@ -26,152 +35,378 @@ type redisConnection struct {
 	heartbeatKey     string // key to keep alive
 	queuesKey        string // key to list of queues consumed by this connection
 	redisClient      RedisClient
+	errChan          chan<- error // optional channel to report consume errors to
+	keys             keyTemplates
+	consumingQueues  *sync.Map // *redisQueue or *multiQueue -> struct{}, see StopAllConsuming
+	logger           Logger
 	heartbeatStopped bool
+
+	heartbeatInterval time.Duration // time between heartbeat updates
+	heartbeatTTL      time.Duration // time until the heartbeat dies without updates
+	heartbeatErrors   chan error    // see HeartbeatErrors
+	stopWhenDead      bool          // see ConnectionOptions.StopConsumingWhenDead
+	heartbeatMu       sync.Mutex    // guards heartbeatStopped against concurrent updates
+}
+
+// ConnectionOptions configure a connection opened by OpenConnectionWithOptions
+type ConnectionOptions struct {
+	// Namespace prefixes all keys of the connection, like "myapp" for
+	// "myapp::rmq::queues". Connections only see connections, queues and
+	// cleaners of their own namespace. Empty for no prefix
+	Namespace string
+
+	// KeyLayout determines how the keys of queues are named, use ClusterKeys
+	// for Redis Cluster
+	KeyLayout KeyLayout
+
+	// ErrChan receives errors while consuming if it's not nil
+	ErrChan chan<- error
+
+	// Logger receives the log events of the connection, its queues and their
+	// deliveries. Nil for no logging
+	Logger Logger
+
+	// HeartbeatInterval is the time between heartbeat updates, one second
+	// by default
+	HeartbeatInterval time.Duration
+
+	// HeartbeatTTL is the time after which the heartbeat of the connection
+	// expires without updates, one minute by default. Cleaners of other
+	// connections return the unacked deliveries of connections with an
+	// expired heartbeat. Opening the connection fails with ErrInvalidHeartbeat
+	// if it isn't longer than HeartbeatInterval
+	HeartbeatTTL time.Duration
+
+	// StopConsumingWhenDead stops all consuming on the connection once its
+	// heartbeat couldn't be updated for HeartbeatTTL, so consumers don't work
+	// on deliveries which cleaners might have returned already
+	StopConsumingWhenDead bool
+}
+
+// OpenConnectionWithOptions opens and returns a new connection which uses
+// any go-redis client, like redis.Client, redis.ClusterClient or a
+// redis.UniversalClient
+func OpenConnectionWithOptions(tag string, redisClient redis.Cmdable, options ConnectionOptions) (*redisConnection, error) {
+	return openConnectionWithRedisClient(tag, RedisWrapper{redisClient}, options)
 }
 
 // OpenConnectionWithRedisClient opens and returns a new connection
-func OpenConnectionWithRedisClient(tag string, redisClient *redis.Client) *redisConnection {
-	return openConnectionWithRedisClient(tag, RedisWrapper{redisClient})
+// errors while consuming are sent to errChan if it is not nil
+func OpenConnectionWithRedisClient(tag string, redisClient *redis.Client, errChan chan<- error) (*redisConnection, error) {
+	return openConnectionWithRedisClient(tag, RedisWrapper{redisClient}, ConnectionOptions{ErrChan: errChan})
+}
+
+// OpenConnectionWithUniversalClient opens and returns a new connection
+// which uses any redis.UniversalClient, like the failover client returned by
+// redis.NewUniversalClient if MasterName is set. Use OpenClusterConnection
+// if it's a redis.ClusterClient
+// errors while consuming are sent to errChan if it is not nil
+func OpenConnectionWithUniversalClient(tag string, redisClient redis.UniversalClient, errChan chan<- error) (*redisConnection, error) {
+	return openConnectionWithRedisClient(tag, RedisWrapper{redisClient}, ConnectionOptions{ErrChan: errChan})
+}
+
+// OpenClusterConnection opens and returns a new connection which uses the
+// ClusterKeys layout, so that it works with Redis Cluster. It accepts a
+// redis.ClusterClient as well as any other redis.UniversalClient
+// errors while consuming are sent to errChan if it is not nil
+func OpenClusterConnection(tag string, redisClient redis.UniversalClient, errChan chan<- error) (*redisConnection, error) {
+	return openConnectionWithRedisClient(tag, RedisWrapper{redisClient}, ConnectionOptions{KeyLayout: ClusterKeys, ErrChan: errChan})
 }
 
 // OpenConnectionWithTestRedisClient opens and returns a new connection which
 // uses a test redis client internally. This is useful in integration tests.
-func OpenConnectionWithTestRedisClient(tag string) *redisConnection {
-	return openConnectionWithRedisClient(tag, NewTestRedisClient())
+func OpenConnectionWithTestRedisClient(tag string, errChan chan<- error) (*redisConnection, error) {
+	return openConnectionWithRedisClient(tag, NewTestRedisClient(), ConnectionOptions{ErrChan: errChan})
 }
 
-func openConnectionWithRedisClient(tag string, redisClient RedisClient) *redisConnection {
+func openConnectionWithRedisClient(tag string, redisClient RedisClient, options ConnectionOptions) (*redisConnection, error) {
 	name := fmt.Sprintf("%s-%s", tag, uniuri.NewLen(6))
+	keys := newKeyTemplates(options.Namespace, options.KeyLayout)
+	logger := options.Logger
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	interval := options.HeartbeatInterval
+	if interval <= 0 {
+		interval = heartbeatInterval
+	}
+	ttl := options.HeartbeatTTL
+	if ttl <= 0 {
+		ttl = heartbeatDuration
+	}
+	if interval >= ttl {
+		return nil, ErrInvalidHeartbeat // the heartbeat would expire between updates
+	}
 
 	connection := &redisConnection{
-		Name:         name,
-		heartbeatKey: strings.Replace(connectionHeartbeatTemplate, phConnection, name, 1),
-		queuesKey:    strings.Replace(connectionQueuesTemplate, phConnection, name, 1),
-		redisClient:  redisClient,
+		Name:            name,
+		heartbeatKey:    strings.Replace(keys.connectionHeartbeat, phConnection, name, 1),
+		queuesKey:       strings.Replace(keys.connectionQueues, phConnection, name, 1),
+		redisClient:     redisClient,
+		errChan:         options.ErrChan,
+		keys:            keys,
+		consumingQueues: &sync.Map{},
+		logger:          logger,
+
+		heartbeatInterval: interval,
+		heartbeatTTL:      ttl,
+		heartbeatErrors:   make(chan error, 10),
+		stopWhenDead:      options.StopConsumingWhenDead,
 	}
 
-	if !connection.updateHeartbeat() { // checks the connection
-		log.Panicf("rmq connection failed to update heartbeat %s", connection)
+	if err := connection.updateHeartbeat(); err != nil { // checks the connection
+		return nil, err
 	}
 
 	// add to connection set after setting heartbeat to avoid race with cleaner
-	redisClient.SAdd(connectionsKey, name)
+	if _, err := redisClient.SAdd(keys.connections, name); err != nil {
+		return nil, err
+	}
 
 	go connection.heartbeat()
-	// log.Printf("rmq connection connected to %s %s:%s %d", name, network, address, db)
-	return connection
+	logger.Info("connected", "connection", name)
+	return connection, nil
 }
 
 // OpenConnection opens and returns a new connection
-func OpenConnection(tag, network, address string, db int) *redisConnection {
+// errors while consuming are sent to errChan if it is not nil
+func OpenConnection(tag, network, address string, db int, errChan chan<- error) (*redisConnection, error) {
 	redisClient := redis.NewClient(&redis.Options{
 		Network: network,
 		Addr:    address,
 		DB:      db,
 	})
-	return OpenConnectionWithRedisClient(tag, redisClient)
+	return OpenConnectionWithRedisClient(tag, redisClient, errChan)
+}
+
+// OpenFailoverConnection opens and returns a new connection to the master
+// called masterName which is monitored by the Redis Sentinels at
+// sentinelAddrs. For more options pass a client created by
+// redis.NewFailoverClient to OpenConnectionWithRedisClient
+// errors while consuming are sent to errChan if it is not nil
+func OpenFailoverConnection(tag, masterName string, sentinelAddrs []string, db int, errChan chan<- error) (*redisConnection, error) {
+	redisClient := redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:    masterName,
+		SentinelAddrs: sentinelAddrs,
+		DB:            db,
+	})
+	return OpenConnectionWithRedisClient(tag, redisClient, errChan)
 }
 
 // OpenQueue opens and returns the queue with a given name
-func (connection *redisConnection) OpenQueue(name string) Queue {
-	connection.redisClient.SAdd(queuesKey, name)
-	queue := newQueue(name, connection.Name, connection.queuesKey, connection.redisClient)
-	return queue
+func (connection *redisConnection) OpenQueue(name string) (Queue, error) {
+	if _, err := connection.redisClient.SAdd(connection.keys.queues, name); err != nil {
+		return nil, err
+	}
+	return connection.openQueue(name), nil
+}
+
+// OpenQueueContext is like OpenQueue, but fails if ctx is done and passes it
+// on to the Redis client if that supports it (see ContextRedisClient)
+// the returned queue doesn't use ctx
+func (connection *redisConnection) OpenQueueContext(ctx context.Context, name string) (Queue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := withContext(ctx, connection.redisClient).SAdd(connection.keys.queues, name); err != nil {
+		return nil, err
+	}
+	return connection.openQueue(name), nil
 }
 
-func (connection *redisConnection) CollectStats(queueList []string) Stats {
+func (connection *redisConnection) CollectStats(queueList []string) (Stats, error) {
 	return CollectStats(queueList, connection)
 }
 
+// CollectStatsContext is like CollectStats, but fails if ctx is done and
+// passes it on to the Redis client if that supports it (see ContextRedisClient)
+func (connection *redisConnection) CollectStatsContext(ctx context.Context, queueList []string) (Stats, error) {
+	if err := ctx.Err(); err != nil {
+		return NewStats(), err
+	}
+	contextConnection := connection.hijackConnection(connection.Name)
+	contextConnection.redisClient = withContext(ctx, connection.redisClient)
+	return CollectStats(queueList, contextConnection)
+}
+
 func (connection *redisConnection) String() string {
 	return connection.Name
 }
 
 // GetConnections returns a list of all open connections
-func (connection *redisConnection) GetConnections() []string {
-	return connection.redisClient.SMembers(connectionsKey)
+func (connection *redisConnection) GetConnections() ([]string, error) {
+	return connection.redisClient.SMembers(connection.keys.connections)
 }
 
-// Check retuns true if the connection is currently active in terms of heartbeat
-func (connection *redisConnection) Check() bool {
-	heartbeatKey := strings.Replace(connectionHeartbeatTemplate, phConnection, connection.Name, 1)
-	ttl, _ := connection.redisClient.TTL(heartbeatKey)
-	return ttl > 0
+// Check returns nil if the connection is currently active in terms of
+// heartbeat and ErrNotFound if it isn't
+func (connection *redisConnection) Check() error {
+	heartbeatKey := strings.Replace(connection.keys.connectionHeartbeat, phConnection, connection.Name, 1)
+	ttl, err := connection.redisClient.TTL(heartbeatKey)
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
 // StopHeartbeat stops the heartbeat of the connection
 // it does not remove it from the list of connections so it can later be found by the cleaner
-func (connection *redisConnection) StopHeartbeat() bool {
+func (connection *redisConnection) StopHeartbeat() error {
+	connection.heartbeatMu.Lock()
+	defer connection.heartbeatMu.Unlock()
 	connection.heartbeatStopped = true
-	_, ok := connection.redisClient.Del(connection.heartbeatKey)
-	return ok
+	_, err := connection.redisClient.Del(connection.heartbeatKey)
+	return err
+}
+
+// Close removes the connection from the list of connections
+// returns ErrNotFound if it wasn't in that list
+func (connection *redisConnection) Close() error {
+	count, err := connection.redisClient.SRem(connection.keys.connections, connection.Name)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// StopAllConsuming calls StopConsuming on all queues of this connection which
+// started consuming, including the ones of ConsumeMany, the returned channel
+// is closed once all of them finished
+func (connection *redisConnection) StopAllConsuming() <-chan struct{} {
+	finishedChans := []<-chan struct{}{}
+	if connection.consumingQueues != nil {
+		connection.consumingQueues.Range(func(queue, _ interface{}) bool {
+			finishedChans = append(finishedChans, queue.(interface{ StopConsuming() <-chan struct{} }).StopConsuming())
+			return true
+		})
+	}
+
+	finishedChan := make(chan struct{})
+	go func() {
+		for _, queueFinishedChan := range finishedChans {
+			<-queueFinishedChan
+		}
+		close(finishedChan)
+	}()
+	return finishedChan
 }
 
-func (connection *redisConnection) Close() bool {
-	_, ok := connection.redisClient.SRem(connectionsKey, connection.Name)
-	return ok
+// HeartbeatErrors returns a channel which receives a *HeartbeatError for each
+// failed heartbeat update. Errors get dropped if nobody reads them
+func (connection *redisConnection) HeartbeatErrors() <-chan error {
+	return connection.heartbeatErrors
 }
 
 // GetOpenQueues returns a list of all open queues
-func (connection *redisConnection) GetOpenQueues() []string {
-	return connection.redisClient.SMembers(queuesKey)
+func (connection *redisConnection) GetOpenQueues() ([]string, error) {
+	return connection.redisClient.SMembers(connection.keys.queues)
 }
 
 // CloseAllQueues closes all queues by removing them from the global list
-func (connection *redisConnection) CloseAllQueues() int {
-	count, _ := connection.redisClient.Del(queuesKey)
-	return count
+func (connection *redisConnection) CloseAllQueues() (int, error) {
+	return connection.redisClient.Del(connection.keys.queues)
 }
 
 // CloseAllQueuesInConnection closes all queues in the associated connection by removing all related keys
 func (connection *redisConnection) CloseAllQueuesInConnection() error {
-	connection.redisClient.Del(connection.queuesKey)
-	// debug(fmt.Sprintf("connection closed all queues %s %d", connection, connection.queuesKey)) // COMMENTOUT
-	return nil
+	_, err := connection.redisClient.Del(connection.queuesKey)
+	return err
 }
 
 // GetConsumingQueues returns a list of all queues consumed by this connection
-func (connection *redisConnection) GetConsumingQueues() []string {
+func (connection *redisConnection) GetConsumingQueues() ([]string, error) {
 	return connection.redisClient.SMembers(connection.queuesKey)
 }
 
-// heartbeat keeps the heartbeat key alive
+// heartbeat keeps the heartbeat key alive until StopHeartbeat is called
 func (connection *redisConnection) heartbeat() {
+	lastUpdate := time.Now()
+	errorCount := 0
+	dead := false
+
 	for {
-		if !connection.updateHeartbeat() {
-			// log.Printf("rmq connection failed to update heartbeat %s", connection)
+		time.Sleep(connection.heartbeatInterval)
+
+		stopped, err := connection.tryUpdateHeartbeat()
+		if stopped {
+			connection.logger.Info("stopped heartbeat", "connection", connection.Name)
+			return
+		}
+		if err == nil {
+			if dead {
+				connection.logger.Info("heartbeat recovered", "connection", connection.Name)
+			}
+			lastUpdate = time.Now()
+			errorCount = 0
+			dead = false
+			continue
 		}
 
-		time.Sleep(time.Second)
+		errorCount++
+		connection.logger.Error("failed to update heartbeat", "connection", connection.Name, "error", err, "count", errorCount)
+		heartbeatErr := &HeartbeatError{RedisErr: err, Count: errorCount, Dead: time.Since(lastUpdate) >= connection.heartbeatTTL}
+		select { // try to send error without blocking
+		case connection.heartbeatErrors <- heartbeatErr:
+		default:
+		}
 
-		if connection.heartbeatStopped {
-			// log.Printf("rmq connection stopped heartbeat %s", connection)
-			return
+		if heartbeatErr.Dead && !dead {
+			dead = true
+			connection.logger.Error("heartbeat dead", "connection", connection.Name, "stop_consuming", connection.stopWhenDead)
+			if connection.stopWhenDead {
+				connection.StopAllConsuming()
+			}
 		}
 	}
 }
 
-func (connection *redisConnection) updateHeartbeat() bool {
-	ok := connection.redisClient.Set(connection.heartbeatKey, "1", heartbeatDuration)
-	return ok
+// tryUpdateHeartbeat updates the heartbeat unless it was stopped, returns
+// whether it was stopped
+func (connection *redisConnection) tryUpdateHeartbeat() (stopped bool, err error) {
+	connection.heartbeatMu.Lock()
+	defer connection.heartbeatMu.Unlock()
+	if connection.heartbeatStopped {
+		return true, nil
+	}
+	return false, connection.updateHeartbeat()
+}
+
+func (connection *redisConnection) updateHeartbeat() error {
+	ttl := connection.heartbeatTTL
+	if ttl <= 0 { // hijacked connection
+		ttl = heartbeatDuration
+	}
+	return connection.redisClient.Set(connection.heartbeatKey, "1", ttl)
 }
 
 // hijackConnection reopens an existing connection for inspection purposes without starting a heartbeat
 func (connection *redisConnection) hijackConnection(name string) *redisConnection {
 	return &redisConnection{
 		Name:         name,
-		heartbeatKey: strings.Replace(connectionHeartbeatTemplate, phConnection, name, 1),
-		queuesKey:    strings.Replace(connectionQueuesTemplate, phConnection, name, 1),
+		heartbeatKey: strings.Replace(connection.keys.connectionHeartbeat, phConnection, name, 1),
+		queuesKey:    strings.Replace(connection.keys.connectionQueues, phConnection, name, 1),
 		redisClient:  connection.redisClient,
+		errChan:      connection.errChan,
+		keys:         connection.keys,
+		logger:       connection.logger,
 	}
 }
 
 // openQueue opens a queue without adding it to the set of queues
 func (connection *redisConnection) openQueue(name string) *redisQueue {
-	return newQueue(name, connection.Name, connection.queuesKey, connection.redisClient)
+	queue := newQueue(name, connection.Name, connection.queuesKey, connection.keys, connection.redisClient, connection.errChan)
+	queue.consumingQueues = connection.consumingQueues
+	queue.logger = connection.logger
+	return queue
 }
 
 // flushDb flushes the redis database to reset everything, used in tests
-func (connection *redisConnection) flushDb() {
-	connection.redisClient.FlushDb()
+func (connection *redisConnection) flushDb() error {
+	return connection.redisClient.FlushDb()
 }
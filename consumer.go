@@ -1,5 +1,7 @@
 package rmq
 
+import "context"
+
 type Consumer interface {
 	Consume(delivery Delivery)
 }
@@ -9,3 +11,24 @@ type ConsumerFunc func(Delivery)
 func (consumerFunc ConsumerFunc) Consume(delivery Delivery) {
 	consumerFunc(delivery)
 }
+
+// ConsumerWithContext is like Consumer, but gets a context which is cancelled
+// when the queue stops consuming or the consume timeout of the queue elapses
+type ConsumerWithContext interface {
+	Consume(ctx context.Context, delivery Delivery)
+}
+
+type ContextConsumerFunc func(context.Context, Delivery)
+
+func (consumerFunc ContextConsumerFunc) Consume(ctx context.Context, delivery Delivery) {
+	consumerFunc(ctx, delivery)
+}
+
+// contextConsumer adapts a Consumer to ConsumerWithContext
+type contextConsumer struct {
+	consumer Consumer
+}
+
+func (consumer contextConsumer) Consume(ctx context.Context, delivery Delivery) {
+	consumer.consumer.Consume(delivery)
+}
@@ -0,0 +1,83 @@
+package rmq
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Counters counts deliveries of one queue handled by this process
+type Counters struct {
+	Published int64
+	Acked     int64
+	Rejected  int64
+	Pushed    int64
+	Retried   int64
+	Expired   int64
+}
+
+// queueCounters are updated atomically by queues and deliveries
+type queueCounters struct {
+	published int64
+	acked     int64
+	rejected  int64
+	pushed    int64
+	retried   int64
+	expired   int64
+}
+
+// countersKey identifies a queue across namespaces, queues with the same name
+// in different namespaces are different queues
+type countersKey struct {
+	namespace string
+	queueName string
+}
+
+var deliveryCounters sync.Map // countersKey -> *queueCounters
+
+// countersFor returns the counters of the queue with the given name in the
+// given namespace
+func countersFor(namespace, queueName string) *queueCounters {
+	counters, _ := deliveryCounters.LoadOrStore(countersKey{namespace, queueName}, &queueCounters{})
+	return counters.(*queueCounters)
+}
+
+// load returns a snapshot of the counters
+func (counters *queueCounters) load() Counters {
+	return Counters{
+		Published: atomic.LoadInt64(&counters.published),
+		Acked:     atomic.LoadInt64(&counters.acked),
+		Rejected:  atomic.LoadInt64(&counters.rejected),
+		Pushed:    atomic.LoadInt64(&counters.pushed),
+		Retried:   atomic.LoadInt64(&counters.retried),
+		Expired:   atomic.LoadInt64(&counters.expired),
+	}
+}
+
+// allCounters returns the delivery counters of all queues of all namespaces
+func allCounters() map[countersKey]Counters {
+	result := map[countersKey]Counters{}
+	deliveryCounters.Range(func(key, value interface{}) bool {
+		result[key.(countersKey)] = value.(*queueCounters).load()
+		return true
+	})
+	return result
+}
+
+// GetCounters returns the delivery counters of all queues without namespace
+// used by this process, see GetNamespaceCounters
+func GetCounters() map[string]Counters {
+	return GetNamespaceCounters("")
+}
+
+// GetNamespaceCounters returns the delivery counters of all queues in the
+// given namespace (see ConnectionOptions.Namespace) used by this process
+func GetNamespaceCounters(namespace string) map[string]Counters {
+	result := map[string]Counters{}
+	deliveryCounters.Range(func(key, value interface{}) bool {
+		if key := key.(countersKey); key.namespace == namespace {
+			result[key.queueName] = value.(*queueCounters).load()
+		}
+		return true
+	})
+	return result
+}
@@ -1,33 +1,47 @@
 package rmq
 
+import "time"
+
 type Deliveries []Delivery
 
-func (deliveries Deliveries) Ack() int {
-	failedCount := 0
-	for _, delivery := range deliveries {
-		if !delivery.Ack() {
-			failedCount++
-		}
-	}
-	return failedCount
+// Ack acks all deliveries and returns a map from delivery index to error
+// for all deliveries that failed, nil if all succeeded
+func (deliveries Deliveries) Ack() (errMap map[int]error) {
+	return deliveries.each(Delivery.Ack)
 }
 
-func (deliveries Deliveries) Reject() int {
-	failedCount := 0
-	for _, delivery := range deliveries {
-		if !delivery.Reject() {
-			failedCount++
-		}
-	}
-	return failedCount
+func (deliveries Deliveries) Reject() (errMap map[int]error) {
+	return deliveries.each(Delivery.Reject)
+}
+
+func (deliveries Deliveries) RejectWithReason(reason string) (errMap map[int]error) {
+	return deliveries.each(func(delivery Delivery) error {
+		return delivery.RejectWithReason(reason)
+	})
+}
+
+func (deliveries Deliveries) Push() (errMap map[int]error) {
+	return deliveries.each(Delivery.Push)
+}
+
+func (deliveries Deliveries) Retry() (errMap map[int]error) {
+	return deliveries.each(Delivery.Retry)
+}
+
+func (deliveries Deliveries) ExtendLease(duration time.Duration) (errMap map[int]error) {
+	return deliveries.each(func(delivery Delivery) error {
+		return delivery.ExtendLease(duration)
+	})
 }
 
-func (deliveries Deliveries) Push() int {
-	failedCount := 0
-	for _, delivery := range deliveries {
-		if !delivery.Push() {
-			failedCount++
+func (deliveries Deliveries) each(f func(Delivery) error) (errMap map[int]error) {
+	for i, delivery := range deliveries {
+		if err := f(delivery); err != nil {
+			if errMap == nil { // create error map lazily on demand
+				errMap = map[int]error{}
+			}
+			errMap[i] = err
 		}
 	}
-	return failedCount
+	return errMap
 }
@@ -2,69 +2,239 @@ package rmq
 
 import (
 	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 type Delivery interface {
+	ID() string
 	Payload() string
-	Ack() bool
-	Reject() bool
-	Push() bool
+	Headers() map[string]string
+	PublishedAt() time.Time
+	Queue() string
+	Ack() error
+	Reject() error
+	RejectWithReason(reason string) error
+	Push() error
+	Retry() error
+	ExtendLease(duration time.Duration) error
 }
 
 type wrapDelivery struct {
-	payload     string
-	unackedKey  string
-	rejectedKey string
-	pushKey     string
-	redisClient RedisClient
+	value         string // as stored in Redis, identifies the delivery in the unacked list
+	envelope      *envelope
+	queueName     string
+	namespace     string // of the keys of the queue, see ConnectionOptions.Namespace
+	unackedKey    string
+	leasesKey     string // empty if the queue doesn't use leases
+	rejectedKey   string
+	pushKey       string
+	delayedKey    string
+	deadLetterKey string       // empty if the queue has no dead letter queue
+	maxRejections int          // number of rejections before moving to the dead letter queue
+	keyLayout     KeyLayout    // keys of different queues are in different slots with ClusterKeys
+	retryPolicy   *RetryPolicy // nil if the queue has no retry policy
+	redisClient   RedisClient
+	logger        Logger
 }
 
-func newDelivery(payload, unackedKey, rejectedKey, pushKey string, redisClient RedisClient) *wrapDelivery {
-	return &wrapDelivery{
-		payload:     payload,
-		unackedKey:  unackedKey,
-		rejectedKey: rejectedKey,
-		pushKey:     pushKey,
-		redisClient: redisClient,
-	}
+func (delivery *wrapDelivery) String() string {
+	return fmt.Sprintf("[%s %s]", delivery.envelope.Payload, delivery.unackedKey)
 }
 
-func (delivery *wrapDelivery) String() string {
-	return fmt.Sprintf("[%s %s]", delivery.payload, delivery.unackedKey)
+// ID returns the unique ID the delivery was published with
+// deliveries published by older versions of rmq have an empty ID
+func (delivery *wrapDelivery) ID() string {
+	return delivery.envelope.ID
 }
 
 func (delivery *wrapDelivery) Payload() string {
-	return delivery.payload
+	return delivery.envelope.Payload
 }
 
-func (delivery *wrapDelivery) Ack() bool {
-	// debug(fmt.Sprintf("delivery ack %s", delivery)) // COMMENTOUT
+func (delivery *wrapDelivery) Headers() map[string]string {
+	return delivery.envelope.Headers
+}
 
-	count, ok := delivery.redisClient.LRem(delivery.unackedKey, 1, delivery.payload)
-	return ok && count == 1
+// PublishedAt returns the time the delivery was published at
+// it's the zero time for deliveries published by older versions of rmq
+func (delivery *wrapDelivery) PublishedAt() time.Time {
+	return delivery.envelope.PublishedAt
 }
 
-func (delivery *wrapDelivery) Reject() bool {
-	return delivery.move(delivery.rejectedKey)
+// Queue returns the name of the queue the delivery was fetched from
+func (delivery *wrapDelivery) Queue() string {
+	return delivery.queueName
 }
 
-func (delivery *wrapDelivery) Push() bool {
-	if delivery.pushKey != "" {
-		return delivery.move(delivery.pushKey)
+// Ack removes the delivery from the unacked list, returns ErrNotFound if it
+// wasn't found there (for example because it was acked before)
+func (delivery *wrapDelivery) Ack() error {
+	count, err := delivery.redisClient.LRem(delivery.unackedKey, 1, delivery.value)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	delivery.releaseLease()
+	atomic.AddInt64(&countersFor(delivery.namespace, delivery.queueName).acked, 1)
+	delivery.logger.Debug("delivery acked", "queue", delivery.queueName, "delivery", delivery.ID())
+	return nil
+}
+
+func (delivery *wrapDelivery) Reject() error {
+	return delivery.RejectWithReason("")
+}
+
+// RejectWithReason moves the delivery to the rejected list and records reason
+// and time of the rejection in its headers. If the queue has a dead letter
+// queue and the delivery has been rejected often enough, it's moved to the
+// dead letter queue instead
+func (delivery *wrapDelivery) RejectWithReason(reason string) error {
+	return delivery.reject(delivery.envelope.clone(), reason)
+}
+
+func (delivery *wrapDelivery) reject(rejected *envelope, reason string) error {
+	rejected.Rejections++
+	rejected.setHeader(HeaderRejectReason, reason)
+	rejected.setHeader(HeaderRejectedAt, time.Now().Format(time.RFC3339))
+
+	key := delivery.rejectedKey
+	if delivery.deadLetterKey != "" && rejected.Rejections >= delivery.maxRejections {
+		// start over in the dead letter queue
+		key = delivery.deadLetterKey
+		rejected.Rejections = 0
+		rejected.setHeader(HeaderDeadLetteredBy, delivery.queueName)
+	}
+
+	if err := delivery.move(key, rejected.encode()); err != nil {
+		return err
+	}
+	atomic.AddInt64(&countersFor(delivery.namespace, delivery.queueName).rejected, 1)
+	if key == delivery.deadLetterKey {
+		delivery.logger.Info("delivery dead lettered", "queue", delivery.queueName, "delivery", delivery.ID(), "reason", reason)
 	} else {
-		return delivery.move(delivery.rejectedKey)
+		delivery.logger.Debug("delivery rejected", "queue", delivery.queueName, "delivery", delivery.ID(), "reason", reason)
+	}
+	return nil
+}
+
+func (delivery *wrapDelivery) Push() error {
+	key := delivery.rejectedKey
+	if delivery.pushKey != "" {
+		key = delivery.pushKey
 	}
+
+	if err := delivery.move(key, delivery.value); err != nil {
+		return err
+	}
+	atomic.AddInt64(&countersFor(delivery.namespace, delivery.queueName).pushed, 1)
+	delivery.logger.Debug("delivery pushed", "queue", delivery.queueName, "delivery", delivery.ID())
+	return nil
 }
 
-func (delivery *wrapDelivery) move(key string) bool {
-	if ok := delivery.redisClient.LPush(key, delivery.payload); !ok {
-		return false
+// Retry schedules the delivery to be consumed again after the backoff defined
+// by the retry policy of its queue. Once the policy's max attempts are used up
+// the delivery gets rejected instead (which counts as rejection for the dead
+// letter queue). Returns ErrNoRetryPolicy if the queue
+// has no retry policy and ErrNotFound if the delivery isn't unacked anymore
+func (delivery *wrapDelivery) Retry() error {
+	if delivery.retryPolicy == nil {
+		return ErrNoRetryPolicy
 	}
 
-	if _, ok := delivery.redisClient.LRem(delivery.unackedKey, 1, delivery.payload); !ok {
-		return false
+	retried := delivery.envelope.clone()
+	retried.Attempts++
+
+	if delivery.retryPolicy.exhausted(retried.Attempts) {
+		retried.Attempts = 0 // start over if it gets returned
+		return delivery.reject(retried, "retry attempts exhausted")
 	}
 
-	// debug(fmt.Sprintf("delivery rejected %s", delivery)) // COMMENTOUT
-	return true
+	dueTime := time.Now().Add(delivery.retryPolicy.Backoff(retried.Attempts))
+	score := strconv.FormatFloat(unixMilli(dueTime), 'f', -1, 64)
+	keys := []string{delivery.unackedKey, delivery.delayedKey}
+	count, err := delivery.redisClient.RunScript(delayScript, keys, delivery.value, score, retried.encode())
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	delivery.releaseLease()
+	atomic.AddInt64(&countersFor(delivery.namespace, delivery.queueName).retried, 1)
+
+	delivery.logger.Debug("delivery retried", "queue", delivery.queueName, "delivery", delivery.ID(), "attempt", retried.Attempts)
+	return nil
+}
+
+// ExtendLease sets the lease of the delivery to expire after the given
+// duration from now. Returns ErrNoLease if the queue doesn't use leases and
+// ErrNotFound if the lease expired already and the delivery was returned to
+// ready (or if it isn't unacked anymore)
+func (delivery *wrapDelivery) ExtendLease(duration time.Duration) error {
+	if delivery.leasesKey == "" {
+		return ErrNoLease
+	}
+
+	deadline := strconv.FormatFloat(unixMilli(time.Now().Add(duration)), 'f', -1, 64)
+	count, err := delivery.redisClient.RunScript(extendLeaseScript, []string{delivery.leasesKey}, deadline, delivery.value)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// releaseLease removes the lease of a delivery which isn't unacked anymore
+// errors are ignored, stale leases get removed when they expire
+func (delivery *wrapDelivery) releaseLease() {
+	if delivery.leasesKey != "" {
+		delivery.redisClient.ZRem(delivery.leasesKey, delivery.value)
+	}
+}
+
+// move removes the delivery from the unacked list and pushes value to the
+// list at key in one atomic step, returns ErrNotFound if the delivery wasn't
+// unacked anymore (for example because it was acked before)
+func (delivery *wrapDelivery) move(key, value string) error {
+	if delivery.keyLayout == ClusterKeys && hashTag(key) != hashTag(delivery.unackedKey) {
+		return delivery.moveAcrossSlots(key, value)
+	}
+
+	count, err := delivery.redisClient.RunScript(moveScript, []string{delivery.unackedKey, key}, delivery.value, value)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	delivery.releaseLease()
+	return nil
+}
+
+// moveAcrossSlots is like move for keys in different Redis Cluster slots,
+// which can't be used in one script (like the ready list of a push queue).
+// It pushes before removing, so the delivery is never lost, but it can be
+// in both lists for a moment
+func (delivery *wrapDelivery) moveAcrossSlots(key, value string) error {
+	if _, err := delivery.redisClient.LPush(key, value); err != nil {
+		return err
+	}
+	count, err := delivery.redisClient.LRem(delivery.unackedKey, 1, delivery.value)
+	if err != nil {
+		return err
+	}
+	if count == 0 { // not unacked anymore, take it back
+		if _, err := delivery.redisClient.LRem(key, 1, value); err != nil {
+			return err
+		}
+		return ErrNotFound
+	}
+	delivery.releaseLease()
+	return nil
 }
@@ -0,0 +1,95 @@
+package rmq
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/adjust/uniuri"
+)
+
+// envelopePrefix marks values in Redis which are encoded envelopes
+// values without it are raw payloads published by older versions of rmq
+const envelopePrefix = "rmq::envelope::"
+
+// headers set by rmq when rejecting deliveries
+const (
+	HeaderRejectReason   = "rmq-reject-reason"    // reason passed to Delivery.RejectWithReason()
+	HeaderRejectedAt     = "rmq-rejected-at"      // time of the last rejection in RFC 3339 format
+	HeaderDeadLetteredBy = "rmq-dead-lettered-by" // name of the queue which moved the delivery to its dead letter queue
+)
+
+// envelope wraps the payload of each published delivery so that deliveries
+// with equal payloads can be told apart
+type envelope struct {
+	ID          string            `json:"id"`
+	PublishedAt time.Time         `json:"published_at"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Attempts    int               `json:"attempts,omitempty"`   // number of failed attempts, see Delivery.Retry()
+	Rejections  int               `json:"rejections,omitempty"` // number of rejections, see Queue.SetDeadLetterQueue()
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"` // nil if the delivery doesn't expire, see Queue.PublishWithTTL()
+	Priority    int               `json:"priority,omitempty"`   // ready list it returns to, see Queue.PublishWithPriority()
+	Payload     string            `json:"payload"`
+}
+
+func newEnvelope(payload string, headers map[string]string) *envelope {
+	return &envelope{
+		ID:          uniuri.NewLen(20),
+		PublishedAt: time.Now(),
+		Headers:     headers,
+		Payload:     payload,
+	}
+}
+
+// decodeEnvelope decodes a value read from Redis
+// raw payloads are returned as envelope without ID (compatibility mode)
+func decodeEnvelope(value string) *envelope {
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return &envelope{Payload: value}
+	}
+
+	decoded := &envelope{}
+	if err := json.Unmarshal([]byte(value[len(envelopePrefix):]), decoded); err != nil {
+		return &envelope{Payload: value} // looked like an envelope, but wasn't
+	}
+	return decoded
+}
+
+// clone returns a copy of envelope which can be changed and stored again
+// raw payloads get wrapped into a new envelope
+func (envelope *envelope) clone() *envelope {
+	if envelope.ID == "" {
+		return newEnvelope(envelope.Payload, nil)
+	}
+
+	clone := *envelope
+	if envelope.Headers != nil {
+		clone.Headers = make(map[string]string, len(envelope.Headers))
+		for key, value := range envelope.Headers {
+			clone.Headers[key] = value
+		}
+	}
+	return &clone
+}
+
+// expired returns true if the delivery has an expiry time which has passed
+func (envelope *envelope) expired(now time.Time) bool {
+	return envelope.ExpiresAt != nil && envelope.ExpiresAt.Before(now)
+}
+
+// setHeader sets a header, removes it if value is empty
+func (envelope *envelope) setHeader(key, value string) {
+	if value == "" {
+		delete(envelope.Headers, key)
+		return
+	}
+	if envelope.Headers == nil {
+		envelope.Headers = map[string]string{}
+	}
+	envelope.Headers[key] = value
+}
+
+func (envelope *envelope) encode() string {
+	bytes, _ := json.Marshal(envelope) // can't fail, all fields are marshallable
+	return envelopePrefix + string(bytes)
+}
@@ -0,0 +1,52 @@
+package rmq
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotFound         = errors.New("rmq entity not found") // entity being connection/queue/delivery
+	ErrAlreadyConsuming = errors.New("rmq queue must not call StartConsuming() multiple times")
+	ErrNotConsuming     = errors.New("rmq queue must call StartConsuming() before adding consumers")
+	ErrConsumingStopped = errors.New("rmq queue consuming stopped")
+	ErrNoRetryPolicy    = errors.New("rmq queue must call SetRetryPolicy() before retrying deliveries")
+	ErrNoLease          = errors.New("rmq queue must call SetLeaseDuration() before extending leases")
+	ErrDuplicate        = errors.New("rmq delivery with this key was published within the window")
+	ErrInvalidWeights   = errors.New("rmq ConsumeMany needs one positive weight for each queue")
+	ErrForeignQueue     = errors.New("rmq ConsumeMany needs queues opened by its connection")
+	ErrDuplicateQueue   = errors.New("rmq ConsumeMany must not get the same queue twice")
+	ErrConsumingMany    = errors.New("rmq queue is consumed by ConsumeMany, use its MultiQueue instead")
+	ErrInvalidHeartbeat = errors.New("rmq connection heartbeat interval must be shorter than its TTL")
+)
+
+// ConsumeError is sent to the connection's error channel when the consume
+// loop of a queue fails to fetch deliveries from Redis
+type ConsumeError struct {
+	RedisErr error
+	Count    int // number of consecutive errors
+}
+
+func (e *ConsumeError) Error() string {
+	return fmt.Sprintf("rmq.ConsumeError (%d): %s", e.Count, e.RedisErr)
+}
+
+func (e *ConsumeError) Unwrap() error {
+	return e.RedisErr
+}
+
+// HeartbeatError is sent to the connection's heartbeat error channel when the
+// heartbeat of the connection fails to be updated
+type HeartbeatError struct {
+	RedisErr error
+	Count    int  // number of consecutive errors
+	Dead     bool // whether the heartbeat failed for longer than its TTL
+}
+
+func (e *HeartbeatError) Error() string {
+	return fmt.Sprintf("rmq.HeartbeatError (%d): %s", e.Count, e.RedisErr)
+}
+
+func (e *HeartbeatError) Unwrap() error {
+	return e.RedisErr
+}
@@ -4,21 +4,29 @@ import (
 	"log"
 	"time"
 
-	"github.com/adjust/rmq/v2"
+	"github.com/adjust/rmq/v3"
 )
 
 const unackedLimit = 1000
 
 func main() {
-	connection := rmq.OpenConnection("consumer", "tcp", "localhost:6379", 2)
-
-	queue := connection.OpenQueue("things")
-	queue.StartConsuming(unackedLimit, 500*time.Millisecond)
-	queue.AddBatchConsumer("things", 111, NewBatchConsumer("things"))
-
-	queue = connection.OpenQueue("balls")
-	queue.StartConsuming(unackedLimit, 500*time.Millisecond)
-	queue.AddBatchConsumer("balls", 111, NewBatchConsumer("balls"))
+	connection, err := rmq.OpenConnection("consumer", "tcp", "localhost:6379", 2, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, queueName := range []string{"things", "balls"} {
+		queue, err := connection.OpenQueue(queueName)
+		if err != nil {
+			panic(err)
+		}
+		if err := queue.StartConsuming(unackedLimit, 500*time.Millisecond); err != nil {
+			panic(err)
+		}
+		if _, err := queue.AddBatchConsumer(queueName, 111, NewBatchConsumer(queueName)); err != nil {
+			panic(err)
+		}
+	}
 
 	select {}
 }
@@ -34,5 +42,7 @@ func NewBatchConsumer(tag string) *BatchConsumer {
 func (consumer *BatchConsumer) Consume(batch rmq.Deliveries) {
 	time.Sleep(time.Millisecond)
 	log.Printf("%s consumed %d: %s", consumer.tag, len(batch), batch[0])
-	batch.Ack()
+	if errMap := batch.Ack(); len(errMap) > 0 {
+		log.Printf("%s failed to ack %d deliveries", consumer.tag, len(errMap))
+	}
 }
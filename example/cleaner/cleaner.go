@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
+	"log"
 	"time"
 
-	"github.com/adjust/rmq/v2"
+	"github.com/adjust/rmq/v3"
 )
 
 func main() {
-	connection := rmq.OpenConnection("cleaner", "tcp", "localhost:6379", 2)
+	connection, err := rmq.OpenConnection("cleaner", "tcp", "localhost:6379", 2, nil)
+	if err != nil {
+		panic(err)
+	}
 	cleaner := rmq.NewCleaner(connection)
+	cleaner.OnClean(func(result rmq.CleanResult, err error) {
+		if err != nil {
+			log.Printf("failed to clean: %s", err)
+			return
+		}
+		if len(result.Connections) > 0 {
+			log.Printf("cleaned connections %v, returned %v", result.Connections, result.Returned)
+		}
+	})
 
-	for _ = range time.Tick(time.Second) {
-		cleaner.Clean()
-	}
+	cleaner.Run(context.Background(), time.Second)
 }
@@ -5,7 +5,7 @@ import (
 	"log"
 	"time"
 
-	"github.com/adjust/rmq/v2"
+	"github.com/adjust/rmq/v3"
 )
 
 const (
@@ -15,12 +15,28 @@ const (
 )
 
 func main() {
-	connection := rmq.OpenConnection("consumer", "tcp", "localhost:6379", 2)
-	queue := connection.OpenQueue("things")
-	queue.StartConsuming(unackedLimit, 500*time.Millisecond)
+	errChan := make(chan error, 10)
+	go logErrors(errChan)
+
+	connection, err := rmq.OpenConnection("consumer", "tcp", "localhost:6379", 2, errChan)
+	if err != nil {
+		panic(err)
+	}
+
+	queue, err := connection.OpenQueue("things")
+	if err != nil {
+		panic(err)
+	}
+
+	if err := queue.StartConsuming(unackedLimit, 500*time.Millisecond); err != nil {
+		panic(err)
+	}
+
 	for i := 0; i < numConsumers; i++ {
 		name := fmt.Sprintf("consumer %d", i)
-		queue.AddConsumer(name, NewConsumer(i))
+		if _, err := queue.AddConsumer(name, NewConsumer(i)); err != nil {
+			panic(err)
+		}
 	}
 	select {}
 }
@@ -49,8 +65,18 @@ func (consumer *Consumer) Consume(delivery rmq.Delivery) {
 	}
 	time.Sleep(time.Millisecond)
 	if consumer.count%batchSize == 0 {
-		delivery.Reject()
+		if err := delivery.Reject(); err != nil {
+			log.Printf("%s failed to reject %s: %s", consumer.name, delivery.Payload(), err)
+		}
 	} else {
-		delivery.Ack()
+		if err := delivery.Ack(); err != nil {
+			log.Printf("%s failed to ack %s: %s", consumer.name, delivery.Payload(), err)
+		}
+	}
+}
+
+func logErrors(errChan <-chan error) {
+	for err := range errChan {
+		log.Printf("consumer error: %s", err)
 	}
 }
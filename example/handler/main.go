@@ -5,13 +5,17 @@ import (
 	"log"
 	"net/http"
 
-	"github.com/adjust/rmq/v2"
+	"github.com/adjust/rmq/v3"
 )
 
 func main() {
-	connection := rmq.OpenConnection("handler", "tcp", "localhost:6379", 2)
+	connection, err := rmq.OpenConnection("handler", "tcp", "localhost:6379", 2, nil)
+	if err != nil {
+		panic(err)
+	}
 	http.Handle("/overview", NewHandler(connection))
-	fmt.Printf("Handler listening on http://localhost:3333/overview\n")
+	http.Handle("/metrics", rmq.NewMetricsHandler(connection))
+	fmt.Printf("Handler listening on http://localhost:3333/overview and http://localhost:3333/metrics\n")
 	http.ListenAndServe(":3333", nil)
 }
 
@@ -27,8 +31,16 @@ func (handler *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Requ
 	layout := request.FormValue("layout")
 	refresh := request.FormValue("refresh")
 
-	queues := handler.connection.GetOpenQueues()
-	stats := handler.connection.CollectStats(queues)
+	queues, err := handler.connection.GetOpenQueues()
+	if err != nil {
+		panic(err)
+	}
+
+	stats, err := handler.connection.CollectStats(queues)
+	if err != nil {
+		panic(err)
+	}
+
 	log.Printf("queue stats\n%s", stats)
 	fmt.Fprint(writer, stats.GetHtml(layout, refresh))
 }
@@ -1,11 +1,26 @@
 package main
 
 import (
-	"github.com/adjust/rmq/v2"
+	"log"
+
+	"github.com/adjust/rmq/v3"
 )
 
 func main() {
-	connection := rmq.OpenConnection("cleaner", "tcp", "localhost:6379", 2)
-	queue := connection.OpenQueue("things")
-	queue.PurgeReady()
+	connection, err := rmq.OpenConnection("cleaner", "tcp", "localhost:6379", 2, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	queue, err := connection.OpenQueue("things")
+	if err != nil {
+		panic(err)
+	}
+
+	purged, err := queue.PurgeReady()
+	if err != nil {
+		log.Printf("failed to purge: %s", err)
+		return
+	}
+	log.Printf("purged %d", purged)
 }
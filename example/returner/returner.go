@@ -3,12 +3,24 @@ package main
 import (
 	"log"
 
-	"github.com/adjust/rmq/v2"
+	"github.com/adjust/rmq/v3"
 )
 
 func main() {
-	connection := rmq.OpenConnection("returner", "tcp", "localhost:6379", 2)
-	queue := connection.OpenQueue("things")
-	returned := queue.ReturnAllRejected()
+	connection, err := rmq.OpenConnection("returner", "tcp", "localhost:6379", 2, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	queue, err := connection.OpenQueue("things")
+	if err != nil {
+		panic(err)
+	}
+
+	returned, err := queue.ReturnAllRejected()
+	if err != nil {
+		log.Printf("failed to return all rejected: %s", err)
+		return
+	}
 	log.Printf("queue returner returned %d rejected deliveries", returned)
 }
@@ -0,0 +1,219 @@
+package rmq
+
+import (
+	"strconv"
+	"strings"
+)
+
+// KeyLayout determines how the Redis keys of queues are named
+type KeyLayout int
+
+const (
+	// LegacyKeys is the default layout. The keys of a queue land in different
+	// Redis Cluster slots, so it can't be used with Redis Cluster
+	LegacyKeys KeyLayout = iota
+
+	// ClusterKeys uses the queue name as hash tag, so all keys of a queue
+	// land in the same Redis Cluster slot. Use MigrateKeys to switch existing
+	// queues to this layout
+	ClusterKeys
+)
+
+// keyTemplates are the keys and key templates used by a connection and its
+// queues
+type keyTemplates struct {
+	namespace                string
+	layout                   KeyLayout
+	connections              string
+	cleanerLock              string
+	queues                   string
+	connectionHeartbeat      string
+	connectionQueues         string
+	connectionQueueConsumers string
+	connectionQueueUnacked   string
+	queueReady               string
+	queueRejected            string
+	queueDelayed             string
+	queuePriorities          string
+	queueUnique              string
+	queueExpired             string
+	connectionQueueLeases    string
+	queueRateLimit           string
+}
+
+// newKeyTemplates returns the keys of the given layout, all of them
+// prefixed with the namespace unless it's empty
+func newKeyTemplates(namespace string, layout KeyLayout) keyTemplates {
+	templates := keyTemplates{
+		namespace:                namespace,
+		layout:                   layout,
+		connections:              connectionsKey,
+		cleanerLock:              cleanerLockKey,
+		queues:                   queuesKey,
+		connectionHeartbeat:      connectionHeartbeatTemplate,
+		connectionQueues:         connectionQueuesTemplate,
+		connectionQueueConsumers: connectionQueueConsumersTemplate,
+		connectionQueueUnacked:   connectionQueueUnackedTemplate,
+		queueReady:               queueReadyTemplate,
+		queueRejected:            queueRejectedTemplate,
+		queueDelayed:             queueDelayedTemplate,
+		queuePriorities:          queuePrioritiesTemplate,
+		queueUnique:              queueUniqueTemplate,
+		queueExpired:             queueExpiredTemplate,
+		connectionQueueLeases:    connectionQueueLeasesTemplate,
+		queueRateLimit:           queueRateLimitTemplate,
+	}
+
+	if layout == ClusterKeys {
+		templates.connectionQueueConsumers = clusterConnectionQueueConsumersTemplate
+		templates.connectionQueueUnacked = clusterConnectionQueueUnackedTemplate
+		templates.queueReady = clusterQueueReadyTemplate
+		templates.queueRejected = clusterQueueRejectedTemplate
+		templates.queueDelayed = clusterQueueDelayedTemplate
+		templates.queuePriorities = clusterQueuePrioritiesTemplate
+		templates.queueUnique = clusterQueueUniqueTemplate
+		templates.queueExpired = clusterQueueExpiredTemplate
+		templates.connectionQueueLeases = clusterConnectionQueueLeasesTemplate
+		templates.queueRateLimit = clusterQueueRateLimitTemplate
+	}
+
+	if namespace == "" {
+		return templates
+	}
+
+	prefix := namespace + "::"
+	for _, template := range []*string{
+		&templates.connections,
+		&templates.cleanerLock,
+		&templates.queues,
+		&templates.connectionHeartbeat,
+		&templates.connectionQueues,
+		&templates.connectionQueueConsumers,
+		&templates.connectionQueueUnacked,
+		&templates.queueReady,
+		&templates.queueRejected,
+		&templates.queueDelayed,
+		&templates.queuePriorities,
+		&templates.queueUnique,
+		&templates.queueExpired,
+		&templates.connectionQueueLeases,
+		&templates.queueRateLimit,
+	} {
+		*template = prefix + *template
+	}
+	return templates
+}
+
+// hashTag returns the part of key which Redis Cluster uses to find its slot
+func hashTag(key string) string {
+	start := strings.Index(key, "{")
+	if start < 0 {
+		return key
+	}
+	end := strings.Index(key[start+1:], "}")
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+// MigrateKeys moves the ready, rejected, delayed, expired and unacked deliveries and
+// the consumers of all queues from the given layout to the layout of this
+// connection and returns the number of migrated keys. Migrated deliveries are
+// consumed before the ones which are already stored in the new layout.
+// Stop all consumers before migrating. As migrating a key is a single step
+// which uses both layouts, migrate on a single Redis instance before moving
+// the data to Redis Cluster
+func (connection *redisConnection) MigrateKeys(from KeyLayout) (int, error) {
+	if from == connection.keys.layout {
+		return 0, nil
+	}
+
+	fromKeys := newKeyTemplates(connection.keys.namespace, from)
+	migrated := 0
+	migrate := func(fromKey, toKey, kind string) error {
+		if kind != "list" {
+			count, err := connection.redisClient.RunScript(migrateScript, []string{fromKey, toKey}, kind)
+			migrated += count
+			return err
+		}
+
+		// move lists in batches, so a long list doesn't block Redis
+		batchSize := strconv.Itoa(migrateBatchSize)
+		moved := 0
+		for {
+			count, err := connection.redisClient.RunScript(migrateListScript, []string{fromKey, toKey}, batchSize)
+			moved += count
+			if err != nil || count < migrateBatchSize {
+				if moved > 0 {
+					migrated++
+				}
+				return err
+			}
+		}
+	}
+
+	queueNames, err := connection.GetOpenQueues()
+	if err != nil {
+		return migrated, err
+	}
+	for _, queueName := range queueNames {
+		fromQueue := newQueue(queueName, connection.Name, connection.queuesKey, fromKeys, connection.redisClient, nil)
+		toQueue := connection.openQueue(queueName)
+		if err := migrate(fromQueue.readyKey, toQueue.readyKey, "list"); err != nil {
+			return migrated, err
+		}
+		if err := migrate(fromQueue.rejectedKey, toQueue.rejectedKey, "list"); err != nil {
+			return migrated, err
+		}
+		if err := migrate(fromQueue.delayedKey, toQueue.delayedKey, "zset"); err != nil {
+			return migrated, err
+		}
+		if err := migrate(fromQueue.expiredKey, toQueue.expiredKey, "list"); err != nil {
+			return migrated, err
+		}
+		if err := migrate(fromQueue.prioritiesKey, toQueue.prioritiesKey, "set"); err != nil {
+			return migrated, err
+		}
+		priorities, err := toQueue.priorities()
+		if err != nil {
+			return migrated, err
+		}
+		for _, priority := range priorities {
+			if priority == 0 {
+				continue // migrated with the ready key above
+			}
+			if err := migrate(fromQueue.priorityReadyKey(priority), toQueue.priorityReadyKey(priority), "list"); err != nil {
+				return migrated, err
+			}
+		}
+	}
+
+	connectionNames, err := connection.GetConnections()
+	if err != nil {
+		return migrated, err
+	}
+	for _, connectionName := range connectionNames {
+		hijackedConnection := connection.hijackConnection(connectionName)
+		queueNames, err := hijackedConnection.GetConsumingQueues()
+		if err != nil {
+			return migrated, err
+		}
+		for _, queueName := range queueNames {
+			fromQueue := newQueue(queueName, connectionName, hijackedConnection.queuesKey, fromKeys, connection.redisClient, nil)
+			toQueue := hijackedConnection.openQueue(queueName)
+			if err := migrate(fromQueue.unackedKey, toQueue.unackedKey, "list"); err != nil {
+				return migrated, err
+			}
+			if err := migrate(fromQueue.consumersKey, toQueue.consumersKey, "set"); err != nil {
+				return migrated, err
+			}
+			if err := migrate(fromQueue.leasesKey, toQueue.leasesKey, "zset"); err != nil {
+				return migrated, err
+			}
+		}
+	}
+
+	connection.logger.Debug("migrated keys", "connection", connection.Name, "migrated", migrated)
+	return migrated, nil
+}
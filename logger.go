@@ -0,0 +1,69 @@
+package rmq
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives the log events of connections, queues, deliveries and
+// cleaners. keyvals are alternating keys and values like "queue", "things".
+// Set it with ConnectionOptions, by default nothing is logged
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// nopLogger is the default Logger which discards all events
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (nopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (nopLogger) Error(msg string, keyvals ...interface{}) {}
+
+// StdLogger is a Logger which writes events as lines like
+// `rmq info: started consuming queue=things prefetch=10` to a log.Logger
+type StdLogger struct {
+	logger *log.Logger
+	debug  bool // whether to log debug events
+}
+
+// NewStdLogger returns a Logger which writes to logger, debug events only if
+// debug is true
+func NewStdLogger(logger *log.Logger, debug bool) *StdLogger {
+	return &StdLogger{logger: logger, debug: debug}
+}
+
+func (logger *StdLogger) Debug(msg string, keyvals ...interface{}) {
+	if logger.debug {
+		logger.print("debug", msg, keyvals)
+	}
+}
+
+func (logger *StdLogger) Info(msg string, keyvals ...interface{}) {
+	logger.print("info", msg, keyvals)
+}
+
+func (logger *StdLogger) Warn(msg string, keyvals ...interface{}) {
+	logger.print("warn", msg, keyvals)
+}
+
+func (logger *StdLogger) Error(msg string, keyvals ...interface{}) {
+	logger.print("error", msg, keyvals)
+}
+
+func (logger *StdLogger) print(level, msg string, keyvals []interface{}) {
+	builder := &strings.Builder{}
+	fmt.Fprintf(builder, "rmq %s: %s", level, msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(builder, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(builder, " %v=", keyvals[i]) // missing value
+		}
+	}
+	logger.logger.Print(builder.String())
+}
@@ -0,0 +1,171 @@
+package rmq
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricsHandler serves the stats of all open queues and the delivery
+// counters of this process in the Prometheus text exposition format
+type MetricsHandler struct {
+	connection Connection
+}
+
+func NewMetricsHandler(connection Connection) *MetricsHandler {
+	return &MetricsHandler{connection: connection}
+}
+
+func (handler *MetricsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	queues, err := handler.connection.GetOpenQueues()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stats, err := handler.connection.CollectStatsContext(request.Context(), queues)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(writer, stats.GetMetrics())
+	fmt.Fprint(writer, GetCounterMetrics())
+}
+
+// GetMetrics returns gauges for queues and connections in the Prometheus text
+// exposition format
+func (stats Stats) GetMetrics() string {
+	queueNames := stats.sortedQueueNames()
+	buffer := &bytes.Buffer{}
+
+	writeMetric(buffer, "rmq_queue_ready", "gauge", "Number of ready deliveries.")
+	for _, queueName := range queueNames {
+		writeSample(buffer, "rmq_queue_ready", stats.QueueStats[queueName].ReadyCount, "queue", queueName)
+	}
+	writeMetric(buffer, "rmq_queue_ready_by_priority", "gauge", "Number of ready deliveries per priority of queues using priorities.")
+	for _, queueName := range queueNames {
+		readyCounts := stats.QueueStats[queueName].ReadyCountByPriority
+		priorities := make([]int, 0, len(readyCounts))
+		for priority := range readyCounts {
+			priorities = append(priorities, priority)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+		for _, priority := range priorities {
+			writeSample(buffer, "rmq_queue_ready_by_priority", readyCounts[priority], "queue", queueName, "priority", strconv.Itoa(priority))
+		}
+	}
+	writeMetric(buffer, "rmq_queue_rejected", "gauge", "Number of rejected deliveries.")
+	for _, queueName := range queueNames {
+		writeSample(buffer, "rmq_queue_rejected", stats.QueueStats[queueName].RejectedCount, "queue", queueName)
+	}
+	writeMetric(buffer, "rmq_queue_expired", "gauge", "Number of expired deliveries.")
+	for _, queueName := range queueNames {
+		writeSample(buffer, "rmq_queue_expired", stats.QueueStats[queueName].ExpiredCount, "queue", queueName)
+	}
+	writeMetric(buffer, "rmq_queue_delayed", "gauge", "Number of delayed deliveries.")
+	for _, queueName := range queueNames {
+		writeSample(buffer, "rmq_queue_delayed", stats.QueueStats[queueName].DelayedCount, "queue", queueName)
+	}
+	writeMetric(buffer, "rmq_queue_unacked", "gauge", "Number of unacked deliveries of all connections.")
+	for _, queueName := range queueNames {
+		writeSample(buffer, "rmq_queue_unacked", stats.QueueStats[queueName].UnackedCount(), "queue", queueName)
+	}
+	writeMetric(buffer, "rmq_queue_consumers", "gauge", "Number of consumers of all connections.")
+	for _, queueName := range queueNames {
+		writeSample(buffer, "rmq_queue_consumers", stats.QueueStats[queueName].ConsumerCount(), "queue", queueName)
+	}
+
+	writeMetric(buffer, "rmq_connection_unacked", "gauge", "Number of unacked deliveries per connection.")
+	for _, queueName := range queueNames {
+		connectionStats := stats.QueueStats[queueName].connectionStats
+		for _, connectionName := range connectionStats.sortedNames() {
+			writeSample(buffer, "rmq_connection_unacked", connectionStats[connectionName].unackedCount, "queue", queueName, "connection", connectionName)
+		}
+	}
+	writeMetric(buffer, "rmq_connection_consumers", "gauge", "Number of consumers per connection.")
+	for _, queueName := range queueNames {
+		connectionStats := stats.QueueStats[queueName].connectionStats
+		for _, connectionName := range connectionStats.sortedNames() {
+			writeSample(buffer, "rmq_connection_consumers", len(connectionStats[connectionName].consumers), "queue", queueName, "connection", connectionName)
+		}
+	}
+
+	active := map[string]bool{}
+	for connectionName, connectionActive := range stats.otherConnections {
+		active[connectionName] = connectionActive
+	}
+	for _, queueStat := range stats.QueueStats {
+		for connectionName, connectionStat := range queueStat.connectionStats {
+			active[connectionName] = connectionStat.active
+		}
+	}
+	connectionNames := make([]string, 0, len(active))
+	for connectionName := range active {
+		connectionNames = append(connectionNames, connectionName)
+	}
+	sort.Strings(connectionNames)
+
+	writeMetric(buffer, "rmq_connection_active", "gauge", "Whether the heartbeat of the connection is alive (1) or not (0).")
+	for _, connectionName := range connectionNames {
+		value := 0
+		if active[connectionName] {
+			value = 1
+		}
+		writeSample(buffer, "rmq_connection_active", value, "connection", connectionName)
+	}
+
+	return buffer.String()
+}
+
+// GetCounterMetrics returns the delivery counters of this process (see
+// GetNamespaceCounters) in the Prometheus text exposition format, labelled
+// with namespace and queue
+func GetCounterMetrics() string {
+	counters := allCounters()
+	keys := make([]countersKey, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].namespace != keys[j].namespace {
+			return keys[i].namespace < keys[j].namespace
+		}
+		return keys[i].queueName < keys[j].queueName
+	})
+
+	buffer := &bytes.Buffer{}
+	writeCounters := func(name, help string, value func(Counters) int64) {
+		writeMetric(buffer, name, "counter", help)
+		for _, key := range keys {
+			writeSample(buffer, name, value(counters[key]), "namespace", key.namespace, "queue", key.queueName)
+		}
+	}
+
+	writeCounters("rmq_published_total", "Number of deliveries published by this process.", func(c Counters) int64 { return c.Published })
+	writeCounters("rmq_acked_total", "Number of deliveries acked by this process.", func(c Counters) int64 { return c.Acked })
+	writeCounters("rmq_rejected_total", "Number of deliveries rejected by this process.", func(c Counters) int64 { return c.Rejected })
+	writeCounters("rmq_pushed_total", "Number of deliveries pushed by this process.", func(c Counters) int64 { return c.Pushed })
+	writeCounters("rmq_retried_total", "Number of deliveries retried by this process.", func(c Counters) int64 { return c.Retried })
+	writeCounters("rmq_expired_total", "Number of expired deliveries fetched by this process.", func(c Counters) int64 { return c.Expired })
+	return buffer.String()
+}
+
+func writeMetric(buffer *bytes.Buffer, name, metricType, help string) {
+	fmt.Fprintf(buffer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// writeSample writes one sample, labels are given as name value pairs
+func writeSample(buffer *bytes.Buffer, name string, value interface{}, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	fmt.Fprintf(buffer, "%s{%s} %d\n", name, strings.Join(pairs, ","), value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,75 @@
+package rmq
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+)
+
+func TestMetricsSuite(t *testing.T) {
+	TestingSuiteT(&MetricsSuite{}, t)
+}
+
+type MetricsSuite struct{}
+
+func (suite *MetricsSuite) TestMetrics(c *C) {
+	connection := openConnection(c, "metrics-conn")
+	_, err := NewCleaner(connection).Clean()
+	c.Assert(err, IsNil)
+	queue := openQueue(c, connection, "metrics-q")
+	_, err = queue.PurgeReady()
+	c.Check(err, IsNil)
+	_, err = queue.PurgeRejected()
+	c.Check(err, IsNil)
+	counters := GetCounters()["metrics-q"]
+
+	consumer := NewTestConsumer("metrics-cons")
+	consumer.AutoAck = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err = queue.AddConsumer("metrics-cons", consumer)
+	c.Check(err, IsNil)
+	c.Check(queue.Publish("metrics-d1", "metrics-d2", "metrics-d3"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 3)
+	c.Check(consumer.Deliveries()[0].Ack(), IsNil)
+	c.Check(consumer.Deliveries()[0].Ack(), Equals, ErrNotFound) // not counted
+	c.Check(consumer.Deliveries()[1].Reject(), IsNil)
+	<-queue.StopConsuming()
+	c.Check(queue.Publish("metrics-d4"), IsNil)
+
+	c.Check(GetCounters()["metrics-q"], DeepEquals, Counters{
+		Published: counters.Published + 4,
+		Acked:     counters.Acked + 1,
+		Rejected:  counters.Rejected + 1,
+		Pushed:    counters.Pushed,
+		Retried:   counters.Retried,
+	})
+
+	stats, err := connection.CollectStats([]string{"metrics-q"})
+	c.Assert(err, IsNil)
+	metrics := stats.GetMetrics()
+	c.Check(metrics, Matches, `(?s).*# TYPE rmq_queue_ready gauge\nrmq_queue_ready\{queue="metrics-q"\} 1\n.*`)
+	c.Check(metrics, Matches, `(?s).*\nrmq_queue_rejected\{queue="metrics-q"\} 1\n.*`)
+	c.Check(metrics, Matches, `(?s).*\nrmq_queue_unacked\{queue="metrics-q"\} 1\n.*`)
+	c.Check(metrics, Matches, `(?s).*\nrmq_connection_unacked\{queue="metrics-q",connection="`+connection.Name+`"\} 1\n.*`)
+	c.Check(metrics, Matches, `(?s).*\nrmq_connection_active\{connection="`+connection.Name+`"\} 1\n.*`)
+
+	recorder := httptest.NewRecorder()
+	NewMetricsHandler(connection).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	c.Check(recorder.Code, Equals, 200)
+	body, err := ioutil.ReadAll(recorder.Body)
+	c.Check(err, IsNil)
+	c.Check(string(body), Matches, `(?s).*# TYPE rmq_published_total counter\n.*rmq_published_total\{namespace="",queue="metrics-q"\} \d+\n.*`)
+	c.Check(string(body), Matches, `(?s).*\nrmq_queue_ready\{queue="metrics-q"\} 1\n.*`)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *MetricsSuite) TestLabelEscaping(c *C) {
+	stats := NewStats()
+	stats.QueueStats["a\"b\\c\nd"] = NewQueueStat(1, 2)
+	c.Check(stats.GetMetrics(), Matches, `(?s).*\nrmq_queue_ready\{queue="a\\"b\\\\c\\nd"\} 1\n.*`)
+}
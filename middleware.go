@@ -0,0 +1,127 @@
+package rmq
+
+import (
+	"context"
+	"time"
+)
+
+// Middleware wraps a consumer, for example to log, time or authorize
+// deliveries before passing them on to it. See Queue.Use
+type Middleware func(Consumer) Consumer
+
+// BatchMiddleware is like Middleware for batch consumers, see Queue.UseBatch
+type BatchMiddleware func(BatchConsumer) BatchConsumer
+
+// TimingMiddleware calls observe with the duration the consumer took for each
+// delivery
+func TimingMiddleware(observe func(delivery Delivery, duration time.Duration)) Middleware {
+	return func(next Consumer) Consumer {
+		return ConsumerFunc(func(delivery Delivery) {
+			start := time.Now()
+			next.Consume(delivery)
+			observe(delivery, time.Since(start))
+		})
+	}
+}
+
+// RecoveryMiddleware recovers panics of the consumer and calls handler with
+// the delivery and the recovered value, the handler can reject or retry the
+// delivery. See also Queue.SetPanicPolicy
+func RecoveryMiddleware(handler func(delivery Delivery, recovered interface{})) Middleware {
+	return func(next Consumer) Consumer {
+		return ConsumerFunc(func(delivery Delivery) {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					handler(delivery, recovered)
+				}
+			}()
+			next.Consume(delivery)
+		})
+	}
+}
+
+// AutoAckMiddleware acks each delivery when the consumer returns, unless the
+// consumer acked, rejected, pushed or retried it already
+func AutoAckMiddleware() Middleware {
+	return func(next Consumer) Consumer {
+		return ConsumerFunc(func(delivery Delivery) {
+			next.Consume(delivery)
+			delivery.Ack() // ErrNotFound if the consumer handled it already
+		})
+	}
+}
+
+// middlewareConsumer runs a ConsumerWithContext behind middlewares, which
+// only know Consumer. The context of the current delivery is passed around
+// them, so middlewares must call the next consumer before returning
+type middlewareConsumer struct {
+	chain Consumer
+	ctx   context.Context // of the delivery being consumed
+}
+
+func (consumer *middlewareConsumer) Consume(ctx context.Context, delivery Delivery) {
+	consumer.ctx = ctx
+	consumer.chain.Consume(delivery)
+}
+
+// middlewareBatchConsumer is like middlewareConsumer for batch consumers
+type middlewareBatchConsumer struct {
+	chain BatchConsumer
+	ctx   context.Context // of the batch being consumed
+}
+
+func (consumer *middlewareBatchConsumer) Consume(ctx context.Context, batch Deliveries) {
+	consumer.ctx = ctx
+	consumer.chain.Consume(batch)
+}
+
+type batchConsumerFunc func(Deliveries)
+
+func (consumerFunc batchConsumerFunc) Consume(batch Deliveries) {
+	consumerFunc(batch)
+}
+
+// wrapConsumer returns the consumer wrapped in the middlewares of the queue,
+// the first one being the outermost
+func (queue *redisQueue) wrapConsumer(consumer ConsumerWithContext) ConsumerWithContext {
+	if len(queue.middlewares) == 0 {
+		return consumer
+	}
+	wrap := func(next Consumer) Consumer {
+		for i := len(queue.middlewares) - 1; i >= 0; i-- {
+			next = queue.middlewares[i](next)
+		}
+		return next
+	}
+
+	if plain, ok := consumer.(contextConsumer); ok {
+		return contextConsumer{wrap(plain.consumer)}
+	}
+	wrapped := &middlewareConsumer{}
+	wrapped.chain = wrap(ConsumerFunc(func(delivery Delivery) {
+		consumer.Consume(wrapped.ctx, delivery)
+	}))
+	return wrapped
+}
+
+// wrapBatchConsumer is like wrapConsumer for batch consumers
+func (queue *redisQueue) wrapBatchConsumer(consumer BatchConsumerWithContext) BatchConsumerWithContext {
+	if len(queue.batchMiddlewares) == 0 {
+		return consumer
+	}
+	wrap := func(next BatchConsumer) BatchConsumer {
+		for i := len(queue.batchMiddlewares) - 1; i >= 0; i-- {
+			next = queue.batchMiddlewares[i](next)
+		}
+		return next
+	}
+
+	if plain, ok := consumer.(contextBatchConsumer); ok {
+		return contextBatchConsumer{wrap(plain.consumer)}
+	}
+	wrapped := &middlewareBatchConsumer{}
+	wrapped.chain = wrap(batchConsumerFunc(func(batch Deliveries) {
+		consumer.Consume(wrapped.ctx, batch)
+	}))
+	return wrapped
+}
@@ -0,0 +1,55 @@
+package rmq
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+)
+
+func TestMiddlewareSuite(t *testing.T) {
+	TestingSuiteT(&MiddlewareSuite{}, t)
+}
+
+type MiddlewareSuite struct{}
+
+func (suite *MiddlewareSuite) TestTimingMiddleware(c *C) {
+	var observed time.Duration
+	consumer := TimingMiddleware(func(delivery Delivery, duration time.Duration) {
+		observed = duration
+	})(ConsumerFunc(func(delivery Delivery) {
+		time.Sleep(5 * time.Millisecond)
+	}))
+
+	consumer.Consume(NewTestDelivery("timing"))
+	c.Check(observed >= 5*time.Millisecond, Equals, true)
+}
+
+func (suite *MiddlewareSuite) TestRecoveryMiddleware(c *C) {
+	consumer := RecoveryMiddleware(func(delivery Delivery, recovered interface{}) {
+		delivery.RejectWithReason(recovered.(string))
+	})(ConsumerFunc(func(delivery Delivery) {
+		panic("recovery failed")
+	}))
+
+	delivery := NewTestDelivery("recovery")
+	consumer.Consume(delivery)
+	c.Check(delivery.State, Equals, Rejected)
+	c.Check(delivery.RejectReason, Equals, "recovery failed")
+}
+
+func (suite *MiddlewareSuite) TestAutoAckMiddleware(c *C) {
+	consumer := AutoAckMiddleware()(ConsumerFunc(func(delivery Delivery) {
+		if delivery.Payload() == "reject" {
+			delivery.Reject()
+		}
+	}))
+
+	delivery := NewTestDelivery("ack")
+	consumer.Consume(delivery)
+	c.Check(delivery.State, Equals, Acked)
+
+	delivery = NewTestDelivery("reject")
+	consumer.Consume(delivery)
+	c.Check(delivery.State, Equals, Rejected)
+}
@@ -0,0 +1,243 @@
+package rmq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adjust/uniuri"
+)
+
+// consumeManyPollDuration is the time ConsumeMany waits after a round which
+// fetched no deliveries
+const consumeManyPollDuration = 100 * time.Millisecond
+
+// MultiQueue consumes several queues into one shared prefetch buffer, see
+// Connection.ConsumeMany. Consumers can tell where a delivery came from by
+// its Queue()
+type MultiQueue interface {
+	AddConsumer(tag string, consumer Consumer) (string, error)
+	AddConsumerFunc(tag string, consumerFunc ConsumerFunc) (string, error)
+	AddConsumerWithContext(tag string, consumer ConsumerWithContext) (string, error)
+	StopConsuming() <-chan struct{}
+}
+
+type multiQueue struct {
+	queues           []*redisQueue
+	weights          []int
+	queuesByName     map[string]*redisQueue
+	prefetchLimit    int
+	deliveryChan     chan Delivery
+	taken            chan struct{} // signalled when consumers take deliveries, so a full buffer can be refilled
+	consumingStopped int32         // 1 for stopped, 0 for consuming
+	stopWg           sync.WaitGroup
+}
+
+// ConsumeMany starts consuming the given queues of this connection into one
+// shared channel of size prefetchLimit, instead of one per queue. Deliveries
+// are fetched with weighted round-robin: in each round up to weights[i]
+// deliveries of queues[i] are fetched. Settings like retry, rate limit and
+// panic policies and middlewares of the queues still apply to their
+// deliveries, but SetBlockingFetch is ignored as the queues are polled in
+// turns, waiting 100ms once all were empty. Add consumers to and stop the
+// returned MultiQueue instead of the queues, StopConsuming of a queue only
+// stops fetching from it. Returns ErrForeignQueue for queues which weren't
+// opened by this connection and ErrDuplicateQueue if a queue is given twice
+func (connection *redisConnection) ConsumeMany(queues []Queue, weights []int, prefetchLimit int) (MultiQueue, error) {
+	if len(queues) == 0 || len(queues) != len(weights) {
+		return nil, ErrInvalidWeights
+	}
+
+	multi := &multiQueue{
+		weights:       weights,
+		queuesByName:  map[string]*redisQueue{},
+		prefetchLimit: prefetchLimit,
+		deliveryChan:  make(chan Delivery, prefetchLimit),
+		taken:         make(chan struct{}, 1),
+	}
+	for i, queue := range queues {
+		if weights[i] <= 0 {
+			return nil, ErrInvalidWeights
+		}
+		redisQueue, ok := queue.(*redisQueue)
+		if !ok || redisQueue.connectionName != connection.Name {
+			return nil, ErrForeignQueue
+		}
+		if redisQueue.deliveryChan != nil {
+			return nil, ErrAlreadyConsuming
+		}
+		if _, found := multi.queuesByName[redisQueue.name]; found {
+			return nil, ErrDuplicateQueue
+		}
+		multi.queues = append(multi.queues, redisQueue)
+		multi.queuesByName[redisQueue.name] = redisQueue
+	}
+
+	for _, queue := range multi.queues {
+		// add queue to list of queues consumed on this connection
+		if _, err := queue.redisClient.SAdd(queue.queuesKey, queue.name); err != nil {
+			return nil, err
+		}
+	}
+	for _, queue := range multi.queues {
+		queue.prefetchLimit = prefetchLimit
+		queue.pollDuration = consumeManyPollDuration
+		queue.deliveryChan = multi.deliveryChan
+		queue.consumingMany = true
+		queue.consumeCtx, queue.cancelConsume = context.WithCancel(context.Background())
+		atomic.StoreInt32(&queue.consumingStopped, 0)
+	}
+	if connection.consumingQueues != nil {
+		connection.consumingQueues.Store(multi, struct{}{})
+	}
+
+	connection.logger.Info("started consuming many", "connection", connection.Name, "queues", multi, "prefetch", prefetchLimit)
+	go multi.consume()
+	return multi, nil
+}
+
+func (multi *multiQueue) String() string {
+	names := make([]string, len(multi.queues))
+	for i, queue := range multi.queues {
+		names[i] = fmt.Sprintf("%s:%d", queue.name, multi.weights[i])
+	}
+	return fmt.Sprint(names)
+}
+
+// consume fetches deliveries of all queues into the shared delivery channel
+// until consuming is stopped. It's the turn of each queue until it fetched its
+// weight of deliveries in this round or has no more ready, queues which were
+// stopped on their own are skipped. Redis errors are reported to the error
+// channel as ConsumeError
+func (multi *multiQueue) consume() {
+	errorCounts := make([]int, len(multi.queues)) // number of consecutive errors per queue
+	current := 0                                  // index of the queue whose turn it is
+	credit := multi.weights[current]              // number of deliveries it may still fetch in this round
+	idleTurns := 0                                // number of consecutive turns which fetched nothing
+
+	for {
+		if atomic.LoadInt32(&multi.consumingStopped) == int32(1) {
+			close(multi.deliveryChan)
+			return
+		}
+
+		limit := multi.prefetchLimit - len(multi.deliveryChan)
+		if limit <= 0 {
+			multi.waitForConsumers()
+			continue
+		}
+		if limit > credit {
+			limit = credit
+		}
+
+		queue := multi.queues[current]
+		fetched := 0
+		if atomic.LoadInt32(&queue.consumingStopped) == int32(0) {
+			var err error
+			fetched, _, err = queue.fetchBatch(limit)
+			if err != nil {
+				errorCounts[current]++
+				queue.logger.Error("failed to consume", "queue", queue.name, "connection", queue.connectionName, "error", err, "count", errorCounts[current])
+				queue.sendError(&ConsumeError{RedisErr: err, Count: errorCounts[current]})
+			} else {
+				errorCounts[current] = 0
+			}
+		}
+
+		credit -= fetched
+		if fetched < limit || credit == 0 { // next queue's turn
+			current = (current + 1) % len(multi.queues)
+			credit = multi.weights[current]
+		}
+
+		if fetched > 0 {
+			idleTurns = 0
+			continue
+		}
+		idleTurns++
+		if idleTurns >= len(multi.queues) { // all queues are empty
+			idleTurns = 0
+			time.Sleep(consumeManyPollDuration)
+		}
+	}
+}
+
+// waitForConsumers waits until a consumer took a delivery from the full
+// buffer, but at most the poll duration
+func (multi *multiQueue) waitForConsumers() {
+	timer := time.NewTimer(consumeManyPollDuration)
+	defer timer.Stop()
+	select {
+	case <-multi.taken:
+	case <-timer.C:
+	}
+}
+
+func (multi *multiQueue) AddConsumer(tag string, consumer Consumer) (string, error) {
+	return multi.AddConsumerWithContext(tag, contextConsumer{consumer})
+}
+
+func (multi *multiQueue) AddConsumerFunc(tag string, consumerFunc ConsumerFunc) (string, error) {
+	return multi.AddConsumer(tag, consumerFunc)
+}
+
+// AddConsumerWithContext adds a consumer to all queues, it gets the
+// deliveries of all of them. Each delivery is consumed like by a consumer
+// added to its queue, including its middlewares and panic policy
+func (multi *multiQueue) AddConsumerWithContext(tag string, consumer ConsumerWithContext) (string, error) {
+	if atomic.LoadInt32(&multi.consumingStopped) == int32(1) {
+		return "", ErrConsumingStopped
+	}
+
+	name := fmt.Sprintf("%s-%s", tag, uniuri.NewLen(6))
+	consumers := make(map[string]ConsumerWithContext, len(multi.queues))
+	for _, queue := range multi.queues {
+		// add consumer to list of consumers of each queue
+		if _, err := queue.redisClient.SAdd(queue.consumersKey, name); err != nil {
+			return "", err
+		}
+		consumers[queue.name] = queue.wrapConsumer(consumer)
+	}
+
+	multi.stopWg.Add(1)
+	go multi.consumerConsume(consumers)
+	return name, nil
+}
+
+func (multi *multiQueue) consumerConsume(consumers map[string]ConsumerWithContext) {
+	defer multi.stopWg.Done()
+	for delivery := range multi.deliveryChan {
+		select {
+		case multi.taken <- struct{}{}:
+		default: // consume loop was signalled already
+		}
+		queue := multi.queuesByName[delivery.Queue()]
+		if queue.returnPrefetched(delivery) {
+			continue
+		}
+		queue.startLeases(delivery)
+		queue.consumeDelivery(consumers[queue.name], delivery)
+	}
+}
+
+// StopConsuming stops fetching from all queues, the returned channel is
+// closed once the consumers finished the prefetched deliveries
+func (multi *multiQueue) StopConsuming() <-chan struct{} {
+	finishedChan := make(chan struct{})
+	if !atomic.CompareAndSwapInt32(&multi.consumingStopped, 0, 1) {
+		close(finishedChan) // already stopped
+		return finishedChan
+	}
+
+	for _, queue := range multi.queues {
+		atomic.StoreInt32(&queue.consumingStopped, 1)
+		queue.cancelConsume()
+	}
+	go func() {
+		multi.stopWg.Wait()
+		close(finishedChan)
+	}()
+	return finishedChan
+}
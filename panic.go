@@ -0,0 +1,62 @@
+package rmq
+
+import "fmt"
+
+// PanicPolicy defines what happens to the deliveries of a consumer which
+// panics, see Queue.SetPanicPolicy
+type PanicPolicy int
+
+const (
+	// PanicRepanic panics again after calling the panic handler, which
+	// crashes the process like without recovery. The deliveries stay unacked
+	// until the cleaner returns them. This is the default
+	PanicRepanic PanicPolicy = iota
+
+	// PanicReject rejects the deliveries with the recovered value as reason
+	PanicReject
+
+	// PanicRetry retries the deliveries, they get rejected if the queue has
+	// no retry policy
+	PanicRetry
+
+	// PanicPush pushes the deliveries
+	PanicPush
+)
+
+// PanicHandler gets called with the name of the queue, the delivery and the
+// value recovered from a panicking consumer. Batch consumers call it for each
+// delivery of the batch
+type PanicHandler func(queue string, delivery Delivery, recovered interface{})
+
+// recoverPanic handles a panic of a consumer of the given deliveries according
+// to the panic policy of the queue, must be deferred
+func (queue *redisQueue) recoverPanic(deliveries ...Delivery) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	for _, delivery := range deliveries {
+		queue.logger.Error("consumer panicked", "queue", queue.name, "delivery", delivery.ID(), "recovered", recovered, "policy", queue.panicPolicy)
+		if queue.panicHandler != nil {
+			queue.panicHandler(queue.name, delivery, recovered)
+		}
+
+		// errors are ignored, the delivery stays unacked then (or the consumer
+		// acked it before panicking)
+		switch queue.panicPolicy {
+		case PanicReject:
+			delivery.RejectWithReason(fmt.Sprintf("panic: %v", recovered))
+		case PanicRetry:
+			if err := delivery.Retry(); err == ErrNoRetryPolicy {
+				delivery.RejectWithReason(fmt.Sprintf("panic: %v", recovered))
+			}
+		case PanicPush:
+			delivery.Push()
+		}
+	}
+
+	if queue.panicPolicy == PanicRepanic {
+		panic(recovered)
+	}
+}
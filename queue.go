@@ -1,8 +1,10 @@
 package rmq
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -13,6 +15,7 @@ import (
 
 const (
 	connectionsKey                   = "rmq::connections"                                           // Set of connection names
+	cleanerLockKey                   = "rmq::cleaner::lock"                                         // holds the token of the cleaner currently cleaning
 	connectionHeartbeatTemplate      = "rmq::connection::{connection}::heartbeat"                   // expires after {connection} died
 	connectionQueuesTemplate         = "rmq::connection::{connection}::queues"                      // Set of queues consumers of {connection} are consuming
 	connectionQueueConsumersTemplate = "rmq::connection::{connection}::queue::[{queue}]::consumers" // Set of all consumers from {connection} consuming from {queue}
@@ -21,30 +24,87 @@ const (
 	queuesKey             = "rmq::queues"                     // Set of all open queues
 	queueReadyTemplate    = "rmq::queue::[{queue}]::ready"    // List of deliveries in that {queue} (right is first and oldest, left is last and youngest)
 	queueRejectedTemplate = "rmq::queue::[{queue}]::rejected" // List of rejected deliveries from that {queue}
+	queueDelayedTemplate  = "rmq::queue::[{queue}]::delayed"  // Sorted set of delayed deliveries for that {queue} (scored by due time in unix milliseconds)
+
+	// Set of priorities other than 0 of that {queue}, each has its own ready list (ready key with ::priority::{priority} suffix)
+	// also holds pausedMember while that {queue} is paused, so fetching reads both in one step
+	queuePrioritiesTemplate = "rmq::queue::[{queue}]::priorities"
+	// prefix of the keys which exist while a delivery with that key (the suffix) can't be published to that {queue} again
+	queueUniqueTemplate = "rmq::queue::[{queue}]::unique::"
+	// List of deliveries of that {queue} whose TTL passed before they were consumed
+	queueExpiredTemplate = "rmq::queue::[{queue}]::expired"
+	// Sorted set of the unacked deliveries of {connection} consuming from {queue} (scored by lease deadline in unix milliseconds)
+	connectionQueueLeasesTemplate = "rmq::connection::{connection}::queue::[{queue}]::leases"
+	// Token bucket shared by all consumers of that {queue}, see SetSharedRateLimit
+	queueRateLimitTemplate = "rmq::queue::[{queue}]::ratelimit"
+
+	// templates of ClusterKeys, the same as above but with {queue} as hash tag
+	clusterConnectionQueueConsumersTemplate = "rmq::queue::{{queue}}::connection::{connection}::consumers"
+	clusterConnectionQueueUnackedTemplate   = "rmq::queue::{{queue}}::connection::{connection}::unacked"
+	clusterQueueReadyTemplate               = "rmq::queue::{{queue}}::ready"
+	clusterQueueRejectedTemplate            = "rmq::queue::{{queue}}::rejected"
+	clusterQueueDelayedTemplate             = "rmq::queue::{{queue}}::delayed"
+	clusterQueuePrioritiesTemplate          = "rmq::queue::{{queue}}::priorities"
+	clusterQueueUniqueTemplate              = "rmq::queue::{{queue}}::unique::"
+	clusterQueueExpiredTemplate             = "rmq::queue::{{queue}}::expired"
+	clusterConnectionQueueLeasesTemplate    = "rmq::queue::{{queue}}::connection::{connection}::leases"
+	clusterQueueRateLimitTemplate           = "rmq::queue::{{queue}}::ratelimit"
 
 	phConnection = "{connection}" // connection name
 	phQueue      = "{queue}"      // queue name
 	phConsumer   = "{consumer}"   // consumer name (consisting of tag and token)
 
+	pausedMember = "paused" // member of the priorities set of paused queues, see Pause
+
 	defaultBatchTimeout = time.Second
 	purgeBatchSize      = 100
+	delayedBatchSize    = 100
+	returnBatchSize     = 100 // elements moved by a single returnScript call, to not block Redis
+	migrateBatchSize    = 100 // elements moved by a single migrateListScript call
 )
 
 type Queue interface {
-	Publish(payload ...string) bool
-	PublishBytes(payload ...[]byte) bool
+	Publish(payload ...string) error
+	PublishBytes(payload ...[]byte) error
+	PublishWithHeaders(headers map[string]string, payload ...string) error
+	PublishContext(ctx context.Context, payload ...string) error
+	PublishDelayed(payload string, delay time.Duration) error
+	PublishAt(payload string, dueTime time.Time) error
+	PublishWithPriority(priority int, payload ...string) error
+	PublishUnique(key string, payload string, window time.Duration) error
+	PublishWithTTL(ttl time.Duration, payload ...string) error
 	SetPushQueue(pushQueue Queue)
-	StartConsuming(prefetchLimit int, pollDuration time.Duration) bool
+	SetDeadLetterQueue(deadLetterQueue Queue, maxRejections int)
+	SetRetryPolicy(policy RetryPolicy)
+	SetBlockingFetch(blockTimeout time.Duration)
+	SetConsumeTimeout(timeout time.Duration)
+	SetStarvationLimit(batches int)
+	SetLeaseDuration(duration time.Duration)
+	SetPanicPolicy(policy PanicPolicy)
+	OnConsumerPanic(handler PanicHandler)
+	Use(middlewares ...Middleware)
+	UseBatch(middlewares ...BatchMiddleware)
+	SetRateLimit(n int, per time.Duration)
+	SetSharedRateLimit(n int, per time.Duration)
+	StartConsuming(prefetchLimit int, pollDuration time.Duration) error
 	StopConsuming() <-chan struct{}
-	AddConsumer(tag string, consumer Consumer) string
-	AddConsumerFunc(tag string, consumerFunc ConsumerFunc) string
-	AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string
-	AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string
-	PurgeReady() int
-	PurgeRejected() int
-	ReturnRejected(count int) int
-	ReturnAllRejected() int
-	Close() bool
+	StopConsumingWithTimeout(ctx context.Context, returnPrefetched bool) (StopResult, error)
+	AddConsumer(tag string, consumer Consumer) (string, error)
+	AddConsumerFunc(tag string, consumerFunc ConsumerFunc) (string, error)
+	AddConsumerWithContext(tag string, consumer ConsumerWithContext) (string, error)
+	AddContextConsumerFunc(tag string, consumerFunc ContextConsumerFunc) (string, error)
+	AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) (string, error)
+	AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) (string, error)
+	AddBatchConsumerWithContext(tag string, batchSize int, timeout time.Duration, consumer BatchConsumerWithContext) (string, error)
+	PurgeReady() (int, error)
+	PurgeRejected() (int, error)
+	PurgeExpired() (int, error)
+	Pause() error
+	Resume() error
+	Paused() (bool, error)
+	ReturnRejected(count int) (int, error)
+	ReturnAllRejected() (int, error)
+	Close() error
 }
 
 type redisQueue struct {
@@ -54,26 +114,61 @@ type redisQueue struct {
 	consumersKey     string // key to set of consumers using this connection
 	readyKey         string // key to list of ready deliveries
 	rejectedKey      string // key to list of rejected deliveries
+	delayedKey       string // key to sorted set of delayed deliveries
+	prioritiesKey    string // key to set of priorities with their own ready list
+	uniqueKey        string // prefix of the keys which block publishing a delivery with the same key
+	expiredKey       string // key to list of expired deliveries
 	unackedKey       string // key to list of currently consuming deliveries
+	leasesKey        string // key to sorted set of leases of unacked deliveries
 	pushKey          string // key to list of pushed deliveries
+	deadLetterKey    string // key to list of ready deliveries of the dead letter queue
+	maxRejections    int    // number of rejections before moving to the dead letter queue
+	keys             keyTemplates
 	redisClient      RedisClient
+	retryPolicy      *RetryPolicy  // nil if deliveries can't be retried
+	errChan          chan<- error  // optional channel to report consume errors to
 	deliveryChan     chan Delivery // nil for publish channels, not nil for consuming channels
 	prefetchLimit    int           // max number of prefetched deliveries number of unacked can go up to prefetchLimit + numConsumers
 	pollDuration     time.Duration
-	consumingStopped int32 // queue status, 1 for stopped, 0 for consuming
+	blockTimeout     time.Duration // zero for polling, see SetBlockingFetch
+	consumeTimeout   time.Duration // zero for no deadline, see SetConsumeTimeout
+	starvationLimit  int           // zero for strict priorities, see SetStarvationLimit
+	leaseDuration    time.Duration // zero for no leases, see SetLeaseDuration
+	panicPolicy      PanicPolicy   // see SetPanicPolicy
+	panicHandler     PanicHandler  // optional, see OnConsumerPanic
+	starvedBatches   map[int]int   // priority -> number of batches it was starved, only used by consume
+	consumingStopped int32         // queue status, 1 for stopped, 0 for consuming
+	draining         int32         // 1 if prefetched deliveries get returned to ready, see StopConsumingWithTimeout
+	drained          int32         // number of prefetched deliveries returned to ready
+	consumingQueues  *sync.Map     // queues of the connection which started consuming, nil for hijacked connections
 	stopWg           sync.WaitGroup
+	consumeCtx       context.Context    // cancelled on StopConsuming
+	cancelConsume    context.CancelFunc // cancels consumeCtx
+
+	middlewares      []Middleware      // wrap consumers added afterwards, see Use
+	batchMiddlewares []BatchMiddleware // wrap batch consumers added afterwards, see UseBatch
+	logger           Logger
+	rateLimiter      rateLimiter // nil for no rate limit, see SetRateLimit
+	consumingMany    bool        // deliveryChan is shared with other queues, see ConsumeMany
 }
 
-func newQueue(name, connectionName, queuesKey string, redisClient RedisClient) *redisQueue {
-	consumersKey := strings.Replace(connectionQueueConsumersTemplate, phConnection, connectionName, 1)
+func newQueue(name, connectionName, queuesKey string, keys keyTemplates, redisClient RedisClient, errChan chan<- error) *redisQueue {
+	consumersKey := strings.Replace(keys.connectionQueueConsumers, phConnection, connectionName, 1)
 	consumersKey = strings.Replace(consumersKey, phQueue, name, 1)
 
-	readyKey := strings.Replace(queueReadyTemplate, phQueue, name, 1)
-	rejectedKey := strings.Replace(queueRejectedTemplate, phQueue, name, 1)
+	readyKey := strings.Replace(keys.queueReady, phQueue, name, 1)
+	rejectedKey := strings.Replace(keys.queueRejected, phQueue, name, 1)
+	delayedKey := strings.Replace(keys.queueDelayed, phQueue, name, 1)
+	prioritiesKey := strings.Replace(keys.queuePriorities, phQueue, name, 1)
+	uniqueKey := strings.Replace(keys.queueUnique, phQueue, name, 1)
+	expiredKey := strings.Replace(keys.queueExpired, phQueue, name, 1)
 
-	unackedKey := strings.Replace(connectionQueueUnackedTemplate, phConnection, connectionName, 1)
+	unackedKey := strings.Replace(keys.connectionQueueUnacked, phConnection, connectionName, 1)
 	unackedKey = strings.Replace(unackedKey, phQueue, name, 1)
 
+	leasesKey := strings.Replace(keys.connectionQueueLeases, phConnection, connectionName, 1)
+	leasesKey = strings.Replace(leasesKey, phQueue, name, 1)
+
 	queue := &redisQueue{
 		name:             name,
 		connectionName:   connectionName,
@@ -81,9 +176,17 @@ func newQueue(name, connectionName, queuesKey string, redisClient RedisClient) *
 		consumersKey:     consumersKey,
 		readyKey:         readyKey,
 		rejectedKey:      rejectedKey,
+		delayedKey:       delayedKey,
+		prioritiesKey:    prioritiesKey,
+		uniqueKey:        uniqueKey,
+		expiredKey:       expiredKey,
 		unackedKey:       unackedKey,
+		leasesKey:        leasesKey,
+		keys:             keys,
 		redisClient:      redisClient,
+		errChan:          errChan,
 		consumingStopped: 1, // start with stopped status
+		logger:           nopLogger{},
 	}
 	return queue
 }
@@ -93,12 +196,100 @@ func (queue *redisQueue) String() string {
 }
 
 // Publish adds a delivery with the given payload to the queue
-func (queue *redisQueue) Publish(payload ...string) bool {
-	return queue.redisClient.LPush(queue.readyKey, payload...)
+func (queue *redisQueue) Publish(payload ...string) error {
+	return queue.PublishWithHeaders(nil, payload...)
+}
+
+// PublishWithHeaders adds deliveries with the given payloads to the queue,
+// each of them carrying the given headers
+func (queue *redisQueue) PublishWithHeaders(headers map[string]string, payload ...string) error {
+	return queue.publish(queue.redisClient, queue.readyKey, headers, payload...)
+}
+
+// PublishContext is like Publish, but fails if ctx is done and passes it on
+// to the Redis client if that supports it (see ContextRedisClient)
+func (queue *redisQueue) PublishContext(ctx context.Context, payload ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return queue.publish(withContext(ctx, queue.redisClient), queue.readyKey, nil, payload...)
+}
+
+// PublishWithPriority adds deliveries with the given payloads to the ready
+// list of the given priority. Consumers fetch deliveries of higher priorities
+// first, Publish uses priority 0. Negative priorities are consumed after
+// priority 0
+func (queue *redisQueue) PublishWithPriority(priority int, payload ...string) error {
+	if priority != 0 {
+		if _, err := queue.redisClient.SAdd(queue.prioritiesKey, strconv.Itoa(priority)); err != nil {
+			return err
+		}
+	}
+	return queue.publishEnvelopes(queue.redisClient, queue.priorityReadyKey(priority), payload, func(envelope *envelope) {
+		envelope.Priority = priority
+	})
+}
+
+// PublishUnique adds a delivery with the given payload to the queue unless a
+// delivery with the same key was published with PublishUnique within the
+// window before, in that case it returns ErrDuplicate. Checking the key and
+// publishing happen in one atomic step
+func (queue *redisQueue) PublishUnique(key string, payload string, window time.Duration) error {
+	windowMillis := int64(window / time.Millisecond)
+	if windowMillis < 1 {
+		windowMillis = 1
+	}
+
+	published, err := queue.redisClient.RunScript(publishUniqueScript,
+		[]string{queue.uniqueKey + key, queue.readyKey},
+		strconv.FormatInt(windowMillis, 10), newEnvelope(payload, nil).encode(),
+	)
+	if err != nil {
+		return err
+	}
+	if published == 0 {
+		return ErrDuplicate
+	}
+
+	atomic.AddInt64(&countersFor(queue.keys.namespace, queue.name).published, 1)
+	return nil
+}
+
+// PublishWithTTL adds deliveries with the given payloads to the queue which
+// expire after the given TTL. Consuming queues move deliveries which expired
+// before they were fetched to the expired list of the queue instead of
+// passing them to consumers
+func (queue *redisQueue) PublishWithTTL(ttl time.Duration, payload ...string) error {
+	expiresAt := time.Now().Add(ttl)
+	return queue.publishEnvelopes(queue.redisClient, queue.readyKey, payload, func(envelope *envelope) {
+		envelope.ExpiresAt = &expiresAt
+	})
+}
+
+func (queue *redisQueue) publish(redisClient RedisClient, readyKey string, headers map[string]string, payload ...string) error {
+	return queue.publishEnvelopes(redisClient, readyKey, payload, func(envelope *envelope) {
+		envelope.Headers = headers
+	})
+}
+
+// publishEnvelopes publishes envelopes with the given payloads to the list at
+// readyKey, setup is called for each envelope before encoding it
+func (queue *redisQueue) publishEnvelopes(redisClient RedisClient, readyKey string, payload []string, setup func(*envelope)) error {
+	values := make([]string, len(payload))
+	for i, p := range payload {
+		envelope := newEnvelope(p, nil)
+		setup(envelope)
+		values[i] = envelope.encode()
+	}
+	if _, err := redisClient.LPush(readyKey, values...); err != nil {
+		return err
+	}
+	atomic.AddInt64(&countersFor(queue.keys.namespace, queue.name).published, int64(len(payload)))
+	return nil
 }
 
 // PublishBytes just casts the bytes and calls Publish
-func (queue *redisQueue) PublishBytes(payload ...[]byte) bool {
+func (queue *redisQueue) PublishBytes(payload ...[]byte) error {
 	stringifiedBytes := make([]string, len(payload))
 	for i, b := range payload {
 		stringifiedBytes[i] = string(b)
@@ -106,89 +297,297 @@ func (queue *redisQueue) PublishBytes(payload ...[]byte) bool {
 	return queue.Publish(stringifiedBytes...)
 }
 
-// PurgeReady removes all ready deliveries from the queue and returns the number of purged deliveries
-func (queue *redisQueue) PurgeReady() int {
-	return queue.deleteRedisList(queue.readyKey)
+// PublishDelayed adds a delivery with the given payload to the queue which
+// becomes ready to be consumed after the given delay
+func (queue *redisQueue) PublishDelayed(payload string, delay time.Duration) error {
+	return queue.PublishAt(payload, time.Now().Add(delay))
+}
+
+// PublishAt adds a delivery with the given payload to the queue which becomes
+// ready to be consumed at the given time. Until then it's kept in the delayed
+// set of the queue, consuming queues move due deliveries to the ready list
+func (queue *redisQueue) PublishAt(payload string, dueTime time.Time) error {
+	if _, err := queue.redisClient.ZAdd(queue.delayedKey, unixMilli(dueTime), newEnvelope(payload, nil).encode()); err != nil {
+		return err
+	}
+	atomic.AddInt64(&countersFor(queue.keys.namespace, queue.name).published, 1)
+	return nil
+}
+
+// PurgeReady removes all ready deliveries of all priorities from the queue and
+// returns the number of purged deliveries
+func (queue *redisQueue) PurgeReady() (int, error) {
+	priorities, err := queue.priorities()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, priority := range priorities {
+		count, err := queue.deleteRedisList(queue.priorityReadyKey(priority))
+		purged += count
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
 }
 
 // PurgeRejected removes all rejected deliveries from the queue and returns the number of purged deliveries
-func (queue *redisQueue) PurgeRejected() int {
+func (queue *redisQueue) PurgeRejected() (int, error) {
 	return queue.deleteRedisList(queue.rejectedKey)
 }
 
+// PurgeExpired removes all expired deliveries from the queue and returns the number of purged deliveries
+func (queue *redisQueue) PurgeExpired() (int, error) {
+	return queue.deleteRedisList(queue.expiredKey)
+}
+
+// Pause stops all connections consuming this queue from fetching deliveries
+// until Resume is called. Deliveries which were fetched already are still
+// consumed, publishing is not affected
+func (queue *redisQueue) Pause() error {
+	if _, err := queue.redisClient.SAdd(queue.prioritiesKey, pausedMember); err != nil {
+		return err
+	}
+	queue.logger.Info("paused", "queue", queue.name, "connection", queue.connectionName)
+	return nil
+}
+
+// Resume lets all connections consuming this queue fetch deliveries again
+func (queue *redisQueue) Resume() error {
+	if _, err := queue.redisClient.SRem(queue.prioritiesKey, pausedMember); err != nil {
+		return err
+	}
+	queue.logger.Info("resumed", "queue", queue.name, "connection", queue.connectionName)
+	return nil
+}
+
+// Paused returns whether the queue is paused, see Pause
+func (queue *redisQueue) Paused() (bool, error) {
+	_, paused, err := queue.prioritiesAndPaused()
+	return paused, err
+}
+
 // Close purges and removes the queue from the list of queues
-func (queue *redisQueue) Close() bool {
-	queue.PurgeRejected()
-	queue.PurgeReady()
-	count, _ := queue.redisClient.SRem(queuesKey, queue.name)
-	return count > 0
+// returns ErrNotFound if the queue wasn't open
+func (queue *redisQueue) Close() error {
+	if _, err := queue.PurgeRejected(); err != nil {
+		return err
+	}
+	if _, err := queue.PurgeReady(); err != nil {
+		return err
+	}
+	if _, err := queue.PurgeExpired(); err != nil {
+		return err
+	}
+	if _, err := queue.redisClient.Del(queue.delayedKey); err != nil {
+		return err
+	}
+	if _, err := queue.redisClient.Del(queue.prioritiesKey); err != nil {
+		return err
+	}
+	count, err := queue.redisClient.SRem(queue.keys.queues, queue.name)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ReadyCount returns the number of ready deliveries of all priorities
+func (queue *redisQueue) ReadyCount() (int, error) {
+	counts, err := queue.ReadyCountByPriority()
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return total, err
+}
+
+// ReadyCountByPriority returns the number of ready deliveries per priority
+func (queue *redisQueue) ReadyCountByPriority() (map[int]int, error) {
+	priorities, err := queue.priorities()
+	if err != nil {
+		return map[int]int{}, err
+	}
+	return queue.readyCounts(priorities)
+}
+
+// readyCounts returns the number of ready deliveries of the given priorities
+func (queue *redisQueue) readyCounts(priorities []int) (map[int]int, error) {
+	counts := map[int]int{}
+	for _, priority := range priorities {
+		count, err := queue.redisClient.LLen(queue.priorityReadyKey(priority))
+		if err != nil {
+			return counts, err
+		}
+		counts[priority] = count
+	}
+	return counts, nil
 }
 
-func (queue *redisQueue) ReadyCount() int {
-	count, _ := queue.redisClient.LLen(queue.readyKey)
-	return count
+func (queue *redisQueue) UnackedCount() (int, error) {
+	return queue.redisClient.LLen(queue.unackedKey)
 }
 
-func (queue *redisQueue) UnackedCount() int {
-	count, _ := queue.redisClient.LLen(queue.unackedKey)
-	return count
+func (queue *redisQueue) RejectedCount() (int, error) {
+	return queue.redisClient.LLen(queue.rejectedKey)
+}
+
+func (queue *redisQueue) ExpiredCount() (int, error) {
+	return queue.redisClient.LLen(queue.expiredKey)
+}
+
+func (queue *redisQueue) DelayedCount() (int, error) {
+	return queue.redisClient.ZCard(queue.delayedKey)
+}
+
+// priorities returns all priorities with a ready list in descending order,
+// which always includes priority 0
+func (queue *redisQueue) priorities() ([]int, error) {
+	priorities, _, err := queue.prioritiesAndPaused()
+	return priorities, err
+}
+
+// prioritiesAndPaused is priorities which also returns whether the queue is
+// paused, both are stored in the priorities set
+func (queue *redisQueue) prioritiesAndPaused() (priorities []int, paused bool, err error) {
+	members, err := queue.redisClient.SMembers(queue.prioritiesKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	priorities = []int{0}
+	for _, member := range members {
+		if member == pausedMember {
+			paused = true
+			continue
+		}
+		priority, err := strconv.Atoi(member)
+		if err != nil || priority == 0 {
+			continue
+		}
+		priorities = append(priorities, priority)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+	return priorities, paused, nil
 }
 
-func (queue *redisQueue) RejectedCount() int {
-	count, _ := queue.redisClient.LLen(queue.rejectedKey)
-	return count
+// priorityReadyKey returns the key to the list of ready deliveries with the
+// given priority
+func (queue *redisQueue) priorityReadyKey(priority int) string {
+	if priority == 0 {
+		return queue.readyKey
+	}
+	return queue.readyKey + "::priority::" + strconv.Itoa(priority)
 }
 
 // ReturnAllUnacked moves all unacked deliveries back to the ready
 // queue and deletes the unacked key afterwards, returns number of returned
 // deliveries
-func (queue *redisQueue) ReturnAllUnacked() int {
-	count, ok := queue.redisClient.LLen(queue.unackedKey)
-	if !ok {
-		return 0
+func (queue *redisQueue) ReturnAllUnacked() (int, error) {
+	count, err := queue.returnToReady(queue.unackedKey, -1)
+	if err != nil {
+		return count, err
 	}
+	queue.logger.Debug("returned unacked", "queue", queue.name, "connection", queue.connectionName, "returned", count)
+	_, err = queue.redisClient.Del(queue.leasesKey)
+	return count, err
+}
 
-	unackedCount := count
-	for i := 0; i < unackedCount; i++ {
-		if _, ok := queue.redisClient.RPopLPush(queue.unackedKey, queue.readyKey); !ok {
-			return i
-		}
-		// debug(fmt.Sprintf("rmq queue returned unacked delivery %s %s", count, queue.readyKey)) // COMMENTOUT
+// ReturnExpiredLeases moves unacked deliveries whose lease expired back to the
+// ready list and returns the number of returned deliveries. Consuming queues
+// call it regularly if they use leases, see SetLeaseDuration
+func (queue *redisQueue) ReturnExpiredLeases() (int, error) {
+	now := strconv.FormatFloat(unixMilli(time.Now()), 'f', -1, 64)
+	keys := []string{queue.leasesKey, queue.unackedKey, queue.readyKey, queue.prioritiesKey}
+	returned, err := queue.redisClient.RunScript(returnLeasesScript, keys, now)
+	if returned > 0 {
+		queue.logger.Debug("returned leases", "queue", queue.name, "connection", queue.connectionName, "returned", returned)
+	}
+	return returned, err
+}
+
+// MoveDueDelayed moves delayed deliveries which are due to the ready list and
+// returns the number of moved deliveries. It's safe to be called concurrently,
+// each delayed delivery gets moved at most once. Deliveries are moved in
+// atomic batches, so none get lost if Redis fails in between
+func (queue *redisQueue) MoveDueDelayed() (int, error) {
+	nowMilli := unixMilli(time.Now())
+	due, err := queue.redisClient.ZRangeByScore(queue.delayedKey, 0, nowMilli, 1)
+	if err != nil || len(due) == 0 {
+		return 0, err // skip the script in the common case of nothing due
 	}
 
-	return unackedCount
+	now := strconv.FormatFloat(nowMilli, 'f', -1, 64)
+	batchSize := strconv.Itoa(delayedBatchSize)
+	moved := 0
+	for {
+		count, err := queue.redisClient.RunScript(moveDelayedScript, []string{queue.delayedKey, queue.readyKey, queue.prioritiesKey}, now, batchSize)
+		moved += count
+		if err != nil || count < delayedBatchSize {
+			queue.logger.Debug("moved delayed", "queue", queue.name, "moved", moved)
+			return moved, err
+		}
+	}
 }
 
 // ReturnAllRejected moves all rejected deliveries back to the ready
 // list and returns the number of returned deliveries
-func (queue *redisQueue) ReturnAllRejected() int {
-	rejectedCount, _ := queue.redisClient.LLen(queue.rejectedKey)
-	return queue.ReturnRejected(rejectedCount)
+func (queue *redisQueue) ReturnAllRejected() (int, error) {
+	return queue.returnRejected(-1)
 }
 
 // ReturnRejected tries to return count rejected deliveries back to
 // the ready list and returns the number of returned deliveries
-func (queue *redisQueue) ReturnRejected(count int) int {
-	if count == 0 {
-		return 0
+func (queue *redisQueue) ReturnRejected(count int) (int, error) {
+	if count <= 0 {
+		return 0, nil
 	}
+	return queue.returnRejected(count)
+}
 
-	for i := 0; i < count; i++ {
-		_, ok := queue.redisClient.RPopLPush(queue.rejectedKey, queue.readyKey)
-		if !ok {
-			return i
+// returnRejected moves up to count rejected deliveries back to ready, all of
+// them if count is negative
+func (queue *redisQueue) returnRejected(count int) (int, error) {
+	returned, err := queue.returnToReady(queue.rejectedKey, count)
+	queue.logger.Debug("returned rejected", "queue", queue.name, "returned", returned)
+	return returned, err
+}
+
+// returnToReady moves up to count deliveries from the tail of the list source
+// to the head of the ready list of their priority, all of them if count is
+// negative. Each script call moves at most returnBatchSize deliveries, so a
+// long list doesn't block Redis
+func (queue *redisQueue) returnToReady(source string, count int) (int, error) {
+	returned := 0
+	for count < 0 || returned < count {
+		batchSize := returnBatchSize
+		if count >= 0 && count-returned < batchSize {
+			batchSize = count - returned
+		}
+		moved, err := queue.redisClient.RunScript(returnScript, []string{source, queue.readyKey, queue.prioritiesKey}, strconv.Itoa(batchSize))
+		returned += moved
+		if err != nil || moved < batchSize {
+			return returned, err
 		}
-		// debug(fmt.Sprintf("rmq queue returned rejected delivery %s %s", value, queue.readyKey)) // COMMENTOUT
 	}
-
-	return count
+	return returned, nil
 }
 
 // CloseInConnection closes the queue in the associated connection by removing all related keys
-func (queue *redisQueue) CloseInConnection() {
-	queue.redisClient.Del(queue.unackedKey)
-	queue.redisClient.Del(queue.consumersKey)
-	queue.redisClient.SRem(queue.queuesKey, queue.name)
+func (queue *redisQueue) CloseInConnection() error {
+	if _, err := queue.redisClient.Del(queue.unackedKey); err != nil {
+		return err
+	}
+	if _, err := queue.redisClient.Del(queue.consumersKey); err != nil {
+		return err
+	}
+	_, err := queue.redisClient.SRem(queue.queuesKey, queue.name)
+	return err
 }
 
 func (queue *redisQueue) SetPushQueue(pushQueue Queue) {
@@ -200,26 +599,144 @@ func (queue *redisQueue) SetPushQueue(pushQueue Queue) {
 	queue.pushKey = redisPushQueue.readyKey
 }
 
+// SetDeadLetterQueue makes deliveries which have been rejected maxRejections
+// times move to the ready list of deadLetterQueue instead of the rejected list
+// the number of rejections is tracked in the envelope of each delivery, so
+// returning rejected deliveries doesn't reset it
+// the dead letter queue is a normal queue which may have a dead letter queue
+// itself. must be called before StartConsuming to apply to all deliveries
+func (queue *redisQueue) SetDeadLetterQueue(deadLetterQueue Queue, maxRejections int) {
+	redisDeadLetterQueue, ok := deadLetterQueue.(*redisQueue)
+	if !ok {
+		return
+	}
+
+	if maxRejections < 1 {
+		maxRejections = 1
+	}
+	queue.deadLetterKey = redisDeadLetterQueue.readyKey
+	queue.maxRejections = maxRejections
+}
+
+// SetRetryPolicy enables Delivery.Retry() for deliveries of this queue
+// must be called before StartConsuming to apply to all deliveries
+// the number of attempts is tracked in the envelope of each delivery
+func (queue *redisQueue) SetRetryPolicy(policy RetryPolicy) {
+	queue.retryPolicy = &policy
+}
+
+// SetBlockingFetch makes the queue wait for new deliveries with BRPOPLPUSH
+// instead of polling. Idle queues then don't cost any LLEN calls and new
+// deliveries are consumed right away. Each call blocks for up to blockTimeout
+// (Redis only supports whole seconds), which is also the longest delay for
+// delayed deliveries to be moved and for StopConsuming to take effect.
+// must be called before StartConsuming, a zero blockTimeout switches back to polling
+func (queue *redisQueue) SetBlockingFetch(blockTimeout time.Duration) {
+	queue.blockTimeout = blockTimeout
+}
+
+// SetConsumeTimeout sets a deadline for each delivery (or batch) handed to
+// consumers added with context, their context gets cancelled when it elapses
+// zero means no deadline, the context is only cancelled by StopConsuming
+func (queue *redisQueue) SetConsumeTimeout(timeout time.Duration) {
+	queue.consumeTimeout = timeout
+}
+
+// SetStarvationLimit protects deliveries of lower priorities from waiting
+// forever while higher priorities keep consumers busy. A priority which had
+// ready deliveries but didn't get any in that many consecutive batches is
+// fetched first in the next batch. Zero (the default) means strict priorities
+func (queue *redisQueue) SetStarvationLimit(batches int) {
+	queue.starvationLimit = batches
+}
+
+// SetLeaseDuration makes consumers lease the deliveries they fetch for the
+// given duration. Deliveries which are neither acked, rejected, pushed nor
+// retried when their lease expires are returned to the ready list, even if
+// their connection is still alive. Consumers can call ExtendLease on
+// deliveries which take longer. Leases start when a consumer takes the
+// deliveries, the time they wait in the prefetch buffer doesn't count
+func (queue *redisQueue) SetLeaseDuration(duration time.Duration) {
+	queue.leaseDuration = duration
+}
+
+// SetPanicPolicy makes consumers of this queue recover from panics and
+// reject, retry or push the delivery they were consuming (see PanicPolicy)
+// must be called before adding consumers
+func (queue *redisQueue) SetPanicPolicy(policy PanicPolicy) {
+	queue.panicPolicy = policy
+}
+
+// OnConsumerPanic sets a function which gets called when a consumer of this
+// queue panics, before the panic policy is applied
+// must be called before adding consumers
+func (queue *redisQueue) OnConsumerPanic(handler PanicHandler) {
+	queue.panicHandler = handler
+}
+
+// Use adds middlewares which wrap all consumers added afterwards, the first
+// one being the outermost. Panics in consumers are handled outside of all
+// middlewares (see SetPanicPolicy)
+func (queue *redisQueue) Use(middlewares ...Middleware) {
+	queue.middlewares = append(queue.middlewares, middlewares...)
+}
+
+// UseBatch is like Use for batch consumers
+func (queue *redisQueue) UseBatch(middlewares ...BatchMiddleware) {
+	queue.batchMiddlewares = append(queue.batchMiddlewares, middlewares...)
+}
+
+// SetRateLimit limits how many deliveries this queue fetches for its
+// consumers to n per given duration, in bursts of up to n. Deliveries are only
+// fetched once they may be consumed, so they don't wait in the unacked list.
+// The limit applies to this queue of this connection only, n <= 0 removes it
+// must be called before StartConsuming
+func (queue *redisQueue) SetRateLimit(n int, per time.Duration) {
+	if n <= 0 || per <= 0 {
+		queue.rateLimiter = nil
+		return
+	}
+	queue.rateLimiter = newLocalRateLimiter(n, per)
+}
+
+// SetSharedRateLimit is like SetRateLimit, but the limit is stored in Redis
+// and shared among all connections which use it on this queue. per is rounded
+// up to whole milliseconds
+// must be called before StartConsuming
+func (queue *redisQueue) SetSharedRateLimit(n int, per time.Duration) {
+	if n <= 0 || per <= 0 {
+		queue.rateLimiter = nil
+		return
+	}
+	key := strings.Replace(queue.keys.queueRateLimit, phQueue, queue.name, 1)
+	queue.rateLimiter = newRedisRateLimiter(queue.redisClient, key, n, per)
+}
+
 // StartConsuming starts consuming into a channel of size prefetchLimit
 // must be called before consumers can be added!
 // pollDuration is the duration the queue sleeps before checking for new deliveries
-func (queue *redisQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) bool {
+// with blocking fetch it's only used to wait while the prefetch buffer is full
+func (queue *redisQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) error {
 	if queue.deliveryChan != nil {
-		return false // already consuming
+		return ErrAlreadyConsuming
 	}
 
 	// add queue to list of queues consumed on this connection
-	if ok := queue.redisClient.SAdd(queue.queuesKey, queue.name); !ok {
-		log.Panicf("rmq queue failed to start consuming %s", queue)
+	if _, err := queue.redisClient.SAdd(queue.queuesKey, queue.name); err != nil {
+		return err
 	}
 
 	queue.prefetchLimit = prefetchLimit
 	queue.pollDuration = pollDuration
 	queue.deliveryChan = make(chan Delivery, prefetchLimit)
+	queue.consumeCtx, queue.cancelConsume = context.WithCancel(context.Background())
 	atomic.StoreInt32(&queue.consumingStopped, 0)
-	// log.Printf("rmq queue started consuming %s %d %s", queue, prefetchLimit, pollDuration)
+	if queue.consumingQueues != nil {
+		queue.consumingQueues.Store(queue, struct{}{})
+	}
+	queue.logger.Info("started consuming", "queue", queue.name, "connection", queue.connectionName, "prefetch", prefetchLimit, "poll", pollDuration)
 	go queue.consume()
-	return true
+	return nil
 }
 
 func (queue *redisQueue) StopConsuming() <-chan struct{} {
@@ -229,147 +746,574 @@ func (queue *redisQueue) StopConsuming() <-chan struct{} {
 		return finishedChan
 	}
 
-	// log.Printf("rmq queue stopping %s", queue)
+	queue.logger.Info("stopping consuming", "queue", queue.name, "connection", queue.connectionName)
 	atomic.StoreInt32(&queue.consumingStopped, 1)
+	queue.cancelConsume()
 	go func() {
 		queue.stopWg.Wait()
+		queue.logger.Info("stopped consuming", "queue", queue.name, "connection", queue.connectionName)
 		close(finishedChan)
-		// log.Printf("rmq queue stopped consuming %s", queue)
 	}()
 
 	return finishedChan
 }
 
+// StopResult reports what StopConsumingWithTimeout did
+type StopResult struct {
+	Returned int // prefetched deliveries returned to ready without being consumed
+	Unacked  int // deliveries of the queue left unacked by this connection
+}
+
+// StopConsumingWithTimeout stops fetching and waits until the consumers
+// finished the deliveries they are working on or until ctx is done, then the
+// contexts of the consumers are cancelled (see AddConsumerWithContext). If
+// returnPrefetched is true, prefetched deliveries which no consumer started
+// yet are returned to the ready list instead of being consumed. Returns
+// ctx.Err() if ctx is done before the consumers finished. Deliveries which
+// are left unacked are returned by the cleaner once the connection is gone
+func (queue *redisQueue) StopConsumingWithTimeout(ctx context.Context, returnPrefetched bool) (StopResult, error) {
+	if queue.deliveryChan == nil {
+		return StopResult{}, nil // not consuming
+	}
+	if queue.consumingMany {
+		return StopResult{}, ErrConsumingMany
+	}
+
+	queue.logger.Info("stopping consuming", "queue", queue.name, "connection", queue.connectionName, "return_prefetched", returnPrefetched)
+	if returnPrefetched {
+		atomic.StoreInt32(&queue.draining, 1)
+	}
+	atomic.StoreInt32(&queue.consumingStopped, 1)
+
+	drainWg := sync.WaitGroup{}
+	if returnPrefetched {
+		// return deliveries even if all consumers are busy
+		drainWg.Add(1)
+		go func() {
+			for delivery := range queue.deliveryChan {
+				queue.returnPrefetched(delivery)
+			}
+			drainWg.Done()
+		}()
+	}
+
+	finishedChan := make(chan struct{})
+	go func() {
+		queue.stopWg.Wait()
+		drainWg.Wait()
+		close(finishedChan)
+	}()
+
+	var err error
+	select {
+	case <-finishedChan:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	queue.cancelConsume()
+
+	result := StopResult{Returned: int(atomic.LoadInt32(&queue.drained))}
+	unacked, unackedErr := queue.redisClient.LLen(queue.unackedKey)
+	if err == nil {
+		err = unackedErr
+	}
+	result.Unacked = unacked
+	queue.logger.Info("stopped consuming", "queue", queue.name, "connection", queue.connectionName, "returned", result.Returned, "unacked", result.Unacked, "error", err)
+	return result, err
+}
+
 // AddConsumer adds a consumer to the queue and returns its internal name
-// panics if StartConsuming wasn't called before!
-func (queue *redisQueue) AddConsumer(tag string, consumer Consumer) string {
-	queue.stopWg.Add(1)
-	name := queue.addConsumer(tag)
-	go queue.consumerConsume(consumer)
-	return name
+// returns ErrNotConsuming if StartConsuming wasn't called before!
+func (queue *redisQueue) AddConsumer(tag string, consumer Consumer) (string, error) {
+	return queue.AddConsumerWithContext(tag, contextConsumer{consumer})
 }
 
-func (queue *redisQueue) AddConsumerFunc(tag string, consumerFunc ConsumerFunc) string {
+func (queue *redisQueue) AddConsumerFunc(tag string, consumerFunc ConsumerFunc) (string, error) {
 	return queue.AddConsumer(tag, consumerFunc)
 }
 
+// AddConsumerWithContext is like AddConsumer, but the consumer gets a context
+// for each delivery which is cancelled when consuming is stopped or when the
+// consume timeout elapses (see SetConsumeTimeout)
+func (queue *redisQueue) AddConsumerWithContext(tag string, consumer ConsumerWithContext) (string, error) {
+	name, err := queue.addConsumer(tag)
+	if err != nil {
+		return "", err
+	}
+	queue.stopWg.Add(1)
+	go queue.consumerConsume(queue.wrapConsumer(consumer))
+	return name, nil
+}
+
+func (queue *redisQueue) AddContextConsumerFunc(tag string, consumerFunc ContextConsumerFunc) (string, error) {
+	return queue.AddConsumerWithContext(tag, consumerFunc)
+}
+
 // AddBatchConsumer is similar to AddConsumer, but for batches of deliveries
-func (queue *redisQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string {
+func (queue *redisQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) (string, error) {
 	return queue.AddBatchConsumerWithTimeout(tag, batchSize, defaultBatchTimeout, consumer)
 }
 
 // Timeout limits the amount of time waiting to fill an entire batch
 // The timer is only started when the first message in a batch is received
-func (queue *redisQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string {
+func (queue *redisQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) (string, error) {
+	return queue.AddBatchConsumerWithContext(tag, batchSize, timeout, contextBatchConsumer{consumer})
+}
+
+// AddBatchConsumerWithContext is like AddBatchConsumerWithTimeout, but the
+// consumer gets a context for each batch like in AddConsumerWithContext
+func (queue *redisQueue) AddBatchConsumerWithContext(tag string, batchSize int, timeout time.Duration, consumer BatchConsumerWithContext) (string, error) {
+	name, err := queue.addConsumer(tag)
+	if err != nil {
+		return "", err
+	}
 	queue.stopWg.Add(1)
-	name := queue.addConsumer(tag)
-	go queue.consumerBatchConsume(batchSize, timeout, consumer)
-	return name
+	go queue.consumerBatchConsume(batchSize, timeout, queue.wrapBatchConsumer(consumer))
+	return name, nil
 }
 
-func (queue *redisQueue) GetConsumers() []string {
+func (queue *redisQueue) GetConsumers() ([]string, error) {
 	return queue.redisClient.SMembers(queue.consumersKey)
 }
 
-func (queue *redisQueue) RemoveConsumer(name string) bool {
-	count, _ := queue.redisClient.SRem(queue.consumersKey, name)
-	return count > 0
+func (queue *redisQueue) RemoveConsumer(name string) (bool, error) {
+	count, err := queue.redisClient.SRem(queue.consumersKey, name)
+	return count > 0, err
 }
 
-func (queue *redisQueue) addConsumer(tag string) string {
+func (queue *redisQueue) addConsumer(tag string) (string, error) {
 	if queue.deliveryChan == nil {
-		log.Panicf("rmq queue failed to add consumer, call StartConsuming first! %s", queue)
+		return "", ErrNotConsuming
+	}
+	if queue.consumingMany {
+		return "", ErrConsumingMany
+	}
+	if atomic.LoadInt32(&queue.consumingStopped) == int32(1) {
+		return "", ErrConsumingStopped
 	}
 
 	name := fmt.Sprintf("%s-%s", tag, uniuri.NewLen(6))
 
 	// add consumer to list of consumers of this queue
-	if ok := queue.redisClient.SAdd(queue.consumersKey, name); !ok {
-		log.Panicf("rmq queue failed to add consumer %s %s", queue, tag)
+	if _, err := queue.redisClient.SAdd(queue.consumersKey, name); err != nil {
+		return "", err
 	}
 
-	// log.Printf("rmq queue added consumer %s %s", queue, name)
-	return name
+	queue.logger.Debug("added consumer", "queue", queue.name, "consumer", name)
+	return name, nil
 }
 
-func (queue *redisQueue) RemoveAllConsumers() int {
-	count, _ := queue.redisClient.Del(queue.consumersKey)
-	return count
+func (queue *redisQueue) RemoveAllConsumers() (int, error) {
+	return queue.redisClient.Del(queue.consumersKey)
 }
 
+// consume fetches deliveries into the delivery channel until consuming is
+// stopped, redis errors are reported to the error channel as ConsumeError
 func (queue *redisQueue) consume() {
+	errorCount := 0 // number of consecutive errors
+	consumeBatch := queue.consumeBatch
+	if queue.blockTimeout > 0 {
+		consumeBatch = queue.consumeBlocking
+	}
+
 	for {
-		batchSize := queue.batchSize()
-		wantMore := queue.consumeBatch(batchSize)
+		// check before fetching, so returned prefetched deliveries aren't
+		// fetched again (see StopConsumingWithTimeout)
+		if atomic.LoadInt32(&queue.consumingStopped) == int32(1) {
+			close(queue.deliveryChan)
+			queue.logger.Info("stopped fetching", "queue", queue.name, "connection", queue.connectionName)
+			return
+		}
+
+		wantMore, err := consumeBatch()
+		if err != nil {
+			errorCount++
+			queue.logger.Error("failed to consume", "queue", queue.name, "connection", queue.connectionName, "error", err, "count", errorCount)
+			queue.sendError(&ConsumeError{RedisErr: err, Count: errorCount})
+		} else {
+			errorCount = 0
+		}
 
 		if !wantMore {
 			time.Sleep(queue.pollDuration)
 		}
+	}
+}
 
-		if atomic.LoadInt32(&queue.consumingStopped) == int32(1) {
-			// log.Printf("rmq queue stopped consuming %s", queue)
-			close(queue.deliveryChan)
-			// log.Printf("rmq queue stopped fetching %s", queue)
-			return
+func (queue *redisQueue) batchSize(prefetchLimit int, priorities []int) (int, error) {
+	// TODO: ignore ready count here and just return prefetchLimit?
+	counts, err := queue.readyCounts(priorities)
+	if err != nil {
+		return 0, err
+	}
+	readyCount := 0
+	for _, count := range counts {
+		readyCount += count
+	}
+	if readyCount < prefetchLimit {
+		return readyCount, nil
+	}
+	return prefetchLimit, nil
+}
+
+// consumeBatch tries to read a batch of deliveries, returns true if any and all were consumed
+func (queue *redisQueue) consumeBatch() (wantMore bool, err error) {
+	_, wantMore, err = queue.fetchBatch(queue.prefetchLimit - len(queue.deliveryChan))
+	return wantMore, err
+}
+
+// fetchBatch tries to fetch up to limit deliveries into the delivery channel,
+// returns the number of fetched deliveries and true if any and all were fetched
+// due delayed deliveries are moved to the ready list first
+func (queue *redisQueue) fetchBatch(limit int) (fetched int, wantMore bool, err error) {
+	if err := queue.maintain(); err != nil {
+		return 0, false, err
+	}
+	priorities, paused, err := queue.prioritiesAndPaused()
+	if err != nil {
+		return 0, false, err
+	}
+	if paused {
+		queue.logger.Debug("paused", "queue", queue.name)
+		return 0, false, nil
+	}
+	batchSize, err := queue.batchSize(limit, priorities)
+	if err != nil {
+		return 0, false, err
+	}
+	if batchSize <= 0 {
+		return 0, false, nil
+	}
+
+	if queue.rateLimiter != nil {
+		if batchSize, err = queue.rateLimiter.take(batchSize); err != nil {
+			return 0, false, err
+		}
+		if batchSize == 0 {
+			queue.logger.Debug("rate limited", "queue", queue.name)
+			return 0, false, nil
 		}
 	}
+
+	fetched, err = queue.fetch(priorities, batchSize)
+	if fetched < batchSize {
+		err = queue.giveBackTokens(batchSize-fetched, err)
+	}
+	if err != nil {
+		return fetched, false, err
+	}
+
+	queue.logger.Debug("consumed batch", "queue", queue.name, "fetched", fetched, "batch_size", batchSize)
+	return fetched, fetched == batchSize, nil
 }
 
-func (queue *redisQueue) batchSize() int {
-	prefetchCount := len(queue.deliveryChan)
-	prefetchLimit := queue.prefetchLimit - prefetchCount
-	// TODO: ignore ready count here and just return prefetchLimit?
-	if readyCount := queue.ReadyCount(); readyCount < prefetchLimit {
-		return readyCount
+// maintain moves due delayed deliveries to the ready list and returns
+// deliveries with expired leases, called before fetching
+func (queue *redisQueue) maintain() error {
+	if _, err := queue.MoveDueDelayed(); err != nil {
+		return err
 	}
-	return prefetchLimit
+	if queue.leaseDuration > 0 {
+		if _, err := queue.ReturnExpiredLeases(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// consumeBatch tries to read batchSize deliveries, returns true if any and all were consumed
-func (queue *redisQueue) consumeBatch(batchSize int) bool {
-	if batchSize == 0 {
-		return false
+// fetch moves up to count deliveries from the ready lists to the unacked list
+// and into the delivery channel, higher priorities first unless lower ones are
+// starving, returns the number of fetched deliveries
+func (queue *redisQueue) fetch(priorities []int, count int) (fetched int, err error) {
+	priorities = queue.starvingFirst(priorities)
+	for _, priority := range priorities {
+		if fetched == count {
+			if err := queue.starve(priority); err != nil {
+				return fetched, err
+			}
+			continue
+		}
+
+		delete(queue.starvedBatches, priority)
+		for fetched < count {
+			if atomic.LoadInt32(&queue.draining) == int32(1) {
+				return fetched, nil // don't fetch deliveries StopConsumingWithTimeout returns
+			}
+			value, err := queue.redisClient.RPopLPush(queue.priorityReadyKey(priority), queue.unackedKey)
+			if err == ErrNotFound {
+				break
+			}
+			if err != nil {
+				return fetched, err
+			}
+
+			delivered, err := queue.deliver(value)
+			if err != nil {
+				return fetched, err
+			}
+			if delivered {
+				fetched++
+			}
+		}
 	}
 
-	for i := 0; i < batchSize; i++ {
-		value, ok := queue.redisClient.RPopLPush(queue.readyKey, queue.unackedKey)
-		if !ok {
-			// debug(fmt.Sprintf("rmq queue consumed last batch %s %d", queue, i)) // COMMENTOUT
-			return false
+	return fetched, nil
+}
+
+// starvingFirst returns the priorities with the ones which reached the
+// starvation limit moved to the front
+func (queue *redisQueue) starvingFirst(priorities []int) []int {
+	if queue.starvationLimit <= 0 || len(queue.starvedBatches) == 0 {
+		return priorities
+	}
+
+	ordered := make([]int, 0, len(priorities))
+	for _, priority := range priorities {
+		if queue.starvedBatches[priority] >= queue.starvationLimit {
+			ordered = append(ordered, priority)
 		}
+	}
+	for _, priority := range priorities {
+		if queue.starvedBatches[priority] < queue.starvationLimit {
+			ordered = append(ordered, priority)
+		}
+	}
+	return ordered
+}
 
-		// debug(fmt.Sprintf("consume %d/%d %s %s", i, batchSize, value, queue)) // COMMENTOUT
-		queue.deliveryChan <- newDelivery(value, queue.unackedKey, queue.rejectedKey, queue.pushKey, queue.redisClient)
+// starve counts a batch in which the priority didn't get any deliveries if it
+// has ready deliveries
+func (queue *redisQueue) starve(priority int) error {
+	if queue.starvationLimit <= 0 {
+		return nil
 	}
 
-	// debug(fmt.Sprintf("rmq queue consumed batch %s %d", queue, batchSize)) // COMMENTOUT
-	return true
+	readyCount, err := queue.redisClient.LLen(queue.priorityReadyKey(priority))
+	if err != nil {
+		return err
+	}
+	if readyCount == 0 {
+		delete(queue.starvedBatches, priority)
+		return nil
+	}
+
+	if queue.starvedBatches == nil {
+		queue.starvedBatches = map[int]int{}
+	}
+	queue.starvedBatches[priority]++
+	return nil
+}
+
+// consumeBlocking waits up to blockTimeout for a delivery to consume, returns
+// false if the prefetch buffer is full
+// due delayed deliveries are moved to the ready list first
+func (queue *redisQueue) consumeBlocking() (wantMore bool, err error) {
+	if err := queue.maintain(); err != nil {
+		return false, err
+	}
+	if len(queue.deliveryChan) >= queue.prefetchLimit {
+		return false, nil
+	}
+
+	priorities, paused, err := queue.prioritiesAndPaused()
+	if err != nil {
+		return false, err
+	}
+	if paused {
+		queue.logger.Debug("paused", "queue", queue.name)
+		return false, nil
+	}
+
+	if queue.rateLimiter != nil {
+		taken, err := queue.rateLimiter.take(1)
+		if err != nil || taken == 0 {
+			return false, err
+		}
+	}
+
+	// with other priorities than 0 in use only block if all are empty
+	if len(priorities) > 1 {
+		fetched, err := queue.fetch(priorities, 1)
+		if err != nil || fetched > 0 {
+			if fetched == 0 {
+				err = queue.giveBackTokens(1, err)
+			}
+			return err == nil, err
+		}
+	}
+
+	if atomic.LoadInt32(&queue.draining) == int32(1) {
+		return false, queue.giveBackTokens(1, nil) // don't fetch deliveries StopConsumingWithTimeout returns
+	}
+	value, err := queue.redisClient.BRPopLPush(queue.readyKey, queue.unackedKey, queue.blockTimeout)
+	if err == ErrNotFound {
+		queue.logger.Debug("block timeout", "queue", queue.name)
+		return true, queue.giveBackTokens(1, nil) // nothing to sleep for, we just waited
+	}
+	if err != nil {
+		return false, queue.giveBackTokens(1, err)
+	}
+
+	delivered, err := queue.deliver(value)
+	if !delivered {
+		err = queue.giveBackTokens(1, err)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// giveBackTokens gives count unused tokens back to the rate limiter, if any,
+// returns err or the error of giving them back if err is nil
+func (queue *redisQueue) giveBackTokens(count int, err error) error {
+	if queue.rateLimiter == nil || count <= 0 {
+		return err
+	}
+	if giveBackErr := queue.rateLimiter.giveBack(count); err == nil {
+		return giveBackErr
+	}
+	return err
+}
+
+// deliver passes a fetched delivery on to the consumers, unless it expired
+// already, then it's moved to the expired list and deliver returns false.
+// Leases start once a consumer takes the delivery, see startLeases
+func (queue *redisQueue) deliver(value string) (delivered bool, err error) {
+	delivery := queue.newDelivery(value)
+	if !delivery.envelope.expired(time.Now()) {
+		queue.deliveryChan <- delivery
+		return true, nil
+	}
+
+	if _, err := queue.redisClient.RunScript(moveScript, []string{queue.unackedKey, queue.expiredKey}, value, value); err != nil {
+		return false, err
+	}
+	atomic.AddInt64(&countersFor(queue.keys.namespace, queue.name).expired, 1)
+	queue.logger.Debug("delivery expired", "queue", queue.name, "delivery", delivery.ID())
+	return false, nil
+}
+
+func (queue *redisQueue) newDelivery(value string) *wrapDelivery {
+	return &wrapDelivery{
+		value:         value,
+		envelope:      decodeEnvelope(value),
+		queueName:     queue.name,
+		namespace:     queue.keys.namespace,
+		unackedKey:    queue.unackedKey,
+		leasesKey:     queue.leasesKeyIfLeasing(),
+		rejectedKey:   queue.rejectedKey,
+		pushKey:       queue.pushKey,
+		delayedKey:    queue.delayedKey,
+		deadLetterKey: queue.deadLetterKey,
+		maxRejections: queue.maxRejections,
+		keyLayout:     queue.keys.layout,
+		retryPolicy:   queue.retryPolicy,
+		redisClient:   queue.redisClient,
+		logger:        queue.logger,
+	}
+}
+
+// leasesKeyIfLeasing returns the key to the leases if the queue uses leases,
+// otherwise empty
+func (queue *redisQueue) leasesKeyIfLeasing() string {
+	if queue.leaseDuration <= 0 {
+		return ""
+	}
+	return queue.leasesKey
 }
 
-func (queue *redisQueue) consumerConsume(consumer Consumer) {
+// sendError tries to report err to the error channel, but never blocks
+func (queue *redisQueue) sendError(err error) {
+	select {
+	case queue.errChan <- err:
+	default:
+	}
+}
+
+func (queue *redisQueue) consumerConsume(consumer ConsumerWithContext) {
 	for delivery := range queue.deliveryChan {
-		// debug(fmt.Sprintf("consumer consume %s %s", delivery, consumer)) // COMMENTOUT
-		consumer.Consume(delivery)
+		if queue.returnPrefetched(delivery) {
+			continue
+		}
+		queue.startLeases(delivery)
+		queue.consumeDelivery(consumer, delivery)
 	}
 	queue.stopWg.Done()
 }
 
-func (queue *redisQueue) consumerBatchConsume(batchSize int, timeout time.Duration, consumer BatchConsumer) {
+// consumeDelivery passes one delivery to the consumer, see recoverPanic
+func (queue *redisQueue) consumeDelivery(consumer ConsumerWithContext, delivery Delivery) {
+	ctx, cancel := queue.consumerContext()
+	defer cancel()
+	defer queue.recoverPanic(delivery)
+	consumer.Consume(ctx, delivery)
+}
+
+// consumeDeliveries passes one batch to the consumer, see recoverPanic
+func (queue *redisQueue) consumeDeliveries(consumer BatchConsumerWithContext, batch []Delivery) {
+	ctx, cancel := queue.consumerContext()
+	defer cancel()
+	defer queue.recoverPanic(batch...)
+	consumer.Consume(ctx, batch)
+}
+
+// returnPrefetched returns the deliveries to the ready list instead of
+// consuming them if StopConsumingWithTimeout is draining the queue, returns
+// true if it is. Deliveries which fail to be returned stay unacked
+func (queue *redisQueue) returnPrefetched(deliveries ...Delivery) bool {
+	if atomic.LoadInt32(&queue.draining) == 0 {
+		return false
+	}
+	for _, delivery := range deliveries {
+		wrapped := delivery.(*wrapDelivery)
+		if err := wrapped.move(queue.priorityReadyKey(wrapped.envelope.Priority), wrapped.value); err == nil {
+			atomic.AddInt32(&queue.drained, 1)
+		}
+	}
+	return true
+}
+
+// startLeases leases the deliveries a consumer is about to take for the lease
+// duration if the queue uses leases. Deliveries whose lease fails to start
+// stay unacked without a lease, like the ones of queues without leases
+func (queue *redisQueue) startLeases(deliveries ...Delivery) {
+	if queue.leaseDuration <= 0 {
+		return
+	}
+	deadline := unixMilli(time.Now().Add(queue.leaseDuration))
+	for _, delivery := range deliveries {
+		wrapped := delivery.(*wrapDelivery)
+		if _, err := queue.redisClient.ZAdd(wrapped.leasesKey, deadline, wrapped.value); err != nil {
+			queue.logger.Error("failed to start lease", "queue", queue.name, "delivery", wrapped.ID(), "error", err)
+		}
+	}
+}
+
+// consumerContext returns the context for one delivery or batch
+func (queue *redisQueue) consumerContext() (context.Context, context.CancelFunc) {
+	if queue.consumeTimeout > 0 {
+		return context.WithTimeout(queue.consumeCtx, queue.consumeTimeout)
+	}
+	return context.WithCancel(queue.consumeCtx)
+}
+
+func (queue *redisQueue) consumerBatchConsume(batchSize int, timeout time.Duration, consumer BatchConsumerWithContext) {
 	defer queue.stopWg.Done()
 	batch := []Delivery{}
 	for {
 		// Wait for first delivery
 		delivery, ok := <-queue.deliveryChan
 		if !ok {
-			// debug("batch channel closed") // COMMENTOUT
 			return
 		}
 		batch = append(batch, delivery)
-		// debug(fmt.Sprintf("batch consume added delivery %d", len(batch))) // COMMENTOUT
 		batch, ok = queue.batchTimeout(batchSize, batch, timeout)
-		consumer.Consume(batch)
+		if !queue.returnPrefetched(batch...) {
+			queue.startLeases(batch...)
+			queue.consumeDeliveries(consumer, batch)
+		}
 		if !ok {
-			// debug("batch channel closed") // COMMENTOUT
 			return
 		}
 		batch = batch[:0] // reset batch
@@ -382,18 +1326,13 @@ func (queue *redisQueue) batchTimeout(batchSize int, batch []Delivery, timeout t
 	for {
 		select {
 		case <-timer.C:
-			// debug("batch timer fired") // COMMENTOUT
-			// debug(fmt.Sprintf("batch consume consume %d", len(batch))) // COMMENTOUT
 			return batch, true
 		case delivery, ok := <-queue.deliveryChan:
 			if !ok {
-				// debug("batch channel closed") // COMMENTOUT
 				return batch, false
 			}
 			batch = append(batch, delivery)
-			// debug(fmt.Sprintf("batch consume added delivery %d", len(batch))) // COMMENTOUT
 			if len(batch) >= batchSize {
-				// debug(fmt.Sprintf("batch consume wait %d < %d", len(batch), batchSize)) // COMMENTOUT
 				return batch, true
 			}
 		}
@@ -402,10 +1341,13 @@ func (queue *redisQueue) batchTimeout(batchSize int, batch []Delivery, timeout t
 
 // return number of deleted list items
 // https://www.redisgreen.net/blog/deleting-large-lists
-func (queue *redisQueue) deleteRedisList(key string) int {
-	total, _ := queue.redisClient.LLen(key)
+func (queue *redisQueue) deleteRedisList(key string) (int, error) {
+	total, err := queue.redisClient.LLen(key)
+	if err != nil {
+		return 0, err
+	}
 	if total == 0 {
-		return 0 // nothing to do
+		return 0, nil // nothing to do
 	}
 
 	// delete elements without blocking
@@ -417,12 +1359,14 @@ func (queue *redisQueue) deleteRedisList(key string) int {
 		}
 
 		// remove one batch
-		queue.redisClient.LTrim(key, 0, -1-batchSize)
+		if err := queue.redisClient.LTrim(key, 0, -1-batchSize); err != nil {
+			return 0, err
+		}
 	}
 
-	return total
+	return total, nil
 }
 
-func debug(message string) {
-	// log.Printf("rmq debug: %s", message) // COMMENTOUT
+func unixMilli(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Millisecond))
 }
@@ -1,12 +1,20 @@
 package rmq
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	. "github.com/adjust/gocheck"
+	"github.com/go-redis/redis/v7"
 )
 
 func TestQueueSuite(t *testing.T) {
@@ -16,119 +24,253 @@ func TestQueueSuite(t *testing.T) {
 type QueueSuite struct{}
 
 func (suite *QueueSuite) TestConnections(c *C) {
-	flushConn := OpenConnection("conns-flush", "tcp", "localhost:6379", 1)
-	flushConn.flushDb()
-	flushConn.StopHeartbeat()
+	flushConn := openConnection(c, "conns-flush")
+	c.Check(flushConn.flushDb(), IsNil)
+	c.Check(flushConn.StopHeartbeat(), IsNil)
 
-	connection := OpenConnection("conns-conn", "tcp", "localhost:6379", 1)
+	connection := openConnection(c, "conns-conn")
 	c.Assert(connection, NotNil)
-	c.Assert(NewCleaner(connection).Clean(), IsNil)
+	_, err := NewCleaner(connection).Clean()
+	c.Assert(err, IsNil)
 
-	c.Check(connection.GetConnections(), HasLen, 1, Commentf("cleaner %s", connection.Name)) // cleaner connection remains
+	c.Check(connections(c, connection), HasLen, 1, Commentf("cleaner %s", connection.Name)) // cleaner connection remains
 
-	conn1 := OpenConnection("conns-conn1", "tcp", "localhost:6379", 1)
-	c.Check(connection.GetConnections(), HasLen, 2)
-	c.Check(connection.hijackConnection("nope").Check(), Equals, false)
-	c.Check(conn1.Check(), Equals, true)
-	conn2 := OpenConnection("conns-conn2", "tcp", "localhost:6379", 1)
-	c.Check(connection.GetConnections(), HasLen, 3)
-	c.Check(conn1.Check(), Equals, true)
-	c.Check(conn2.Check(), Equals, true)
+	conn1 := openConnection(c, "conns-conn1")
+	c.Check(connections(c, connection), HasLen, 2)
+	c.Check(connection.hijackConnection("nope").Check(), Equals, ErrNotFound)
+	c.Check(conn1.Check(), IsNil)
+	conn2 := openConnection(c, "conns-conn2")
+	c.Check(connections(c, connection), HasLen, 3)
+	c.Check(conn1.Check(), IsNil)
+	c.Check(conn2.Check(), IsNil)
 
 	connection.hijackConnection("nope").StopHeartbeat()
 	conn1.StopHeartbeat()
-	c.Check(conn1.Check(), Equals, false)
-	c.Check(conn2.Check(), Equals, true)
-	c.Check(connection.GetConnections(), HasLen, 3)
+	c.Check(conn1.Check(), Equals, ErrNotFound)
+	c.Check(conn2.Check(), IsNil)
+	c.Check(connections(c, connection), HasLen, 3)
 
 	conn2.StopHeartbeat()
-	c.Check(conn1.Check(), Equals, false)
-	c.Check(conn2.Check(), Equals, false)
-	c.Check(connection.GetConnections(), HasLen, 3)
+	c.Check(conn1.Check(), Equals, ErrNotFound)
+	c.Check(conn2.Check(), Equals, ErrNotFound)
+	c.Check(connections(c, connection), HasLen, 3)
 
 	connection.StopHeartbeat()
 }
 
+func (suite *QueueSuite) TestHeartbeatErrors(c *C) {
+	rawClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	redisClient := &failingRedisClient{RedisClient: RedisWrapper{rawClient}}
+	connection, err := openConnectionWithRedisClient("heartbeat-conn", redisClient, ConnectionOptions{
+		HeartbeatInterval:     time.Millisecond,
+		HeartbeatTTL:          20 * time.Millisecond,
+		StopConsumingWhenDead: true,
+	})
+	c.Assert(err, IsNil)
+	queue := openQueue(c, connection, "heartbeat-q")
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(rawClient.Exists(connection.heartbeatKey).Val(), Equals, int64(1))
+	c.Check(connection.HeartbeatErrors(), HasLen, 0)
+
+	atomic.StoreInt32(&redisClient.failSet, 1)
+	heartbeatErr := (<-connection.HeartbeatErrors()).(*HeartbeatError)
+	c.Check(heartbeatErr.Count, Equals, 1)
+	c.Check(heartbeatErr.Dead, Equals, false)
+	c.Check(errors.Is(heartbeatErr, errSetFailed), Equals, true)
+	c.Check(atomic.LoadInt32(&queue.consumingStopped), Equals, int32(0))
+
+	time.Sleep(30 * time.Millisecond)
+	c.Check(rawClient.Exists(connection.heartbeatKey).Val(), Equals, int64(0))
+	c.Check(atomic.LoadInt32(&queue.consumingStopped), Equals, int32(1))
+	_, err = queue.AddConsumerFunc("heartbeat-cons", func(Delivery) {})
+	c.Check(err, Equals, ErrConsumingStopped)
+
+	atomic.StoreInt32(&redisClient.failSet, 0)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(rawClient.Exists(connection.heartbeatKey).Val(), Equals, int64(1))
+	c.Check(connection.StopHeartbeat(), IsNil)
+}
+
+func (suite *QueueSuite) TestInvalidHeartbeat(c *C) {
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	_, err := OpenConnectionWithOptions("heartbeat-conn", redisClient, ConnectionOptions{
+		HeartbeatInterval: time.Second,
+		HeartbeatTTL:      time.Second,
+	})
+	c.Check(err, Equals, ErrInvalidHeartbeat)
+	_, err = OpenConnectionWithOptions("heartbeat-conn", redisClient, ConnectionOptions{
+		HeartbeatTTL: 500 * time.Millisecond, // shorter than the default interval
+	})
+	c.Check(err, Equals, ErrInvalidHeartbeat)
+}
+
+func (suite *QueueSuite) TestUniversalConnection(c *C) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{"localhost:6379"}, DB: 1})
+	connection, err := OpenConnectionWithUniversalClient("universal-conn", redisClient, nil)
+	c.Assert(err, IsNil)
+	c.Check(connection.Check(), IsNil)
+
+	queue := openQueue(c, connection, "universal-q")
+	_, err = queue.PurgeReady()
+	c.Check(err, IsNil)
+	c.Check(queue.PublishContext(context.Background(), "universal-d1"), IsNil)
+	c.Check(readyCount(c, queue), Equals, 1)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestNamespace(c *C) {
+	connection := openConnection(c, "ns-default-conn")
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	nsConnection, err := OpenConnectionWithOptions("ns-conn", redisClient, ConnectionOptions{Namespace: "ns"})
+	c.Assert(err, IsNil)
+	_, err = NewCleaner(nsConnection).Clean()
+	c.Check(err, IsNil)
+
+	queue := openQueue(c, connection, "ns-q")
+	nsQueue := openQueue(c, nsConnection, "ns-q")
+	c.Check(nsQueue.readyKey, Equals, "ns::rmq::queue::[ns-q]::ready")
+	_, err = queue.PurgeReady()
+	c.Check(err, IsNil)
+	_, err = nsQueue.PurgeReady()
+	c.Check(err, IsNil)
+	published := GetCounters()["ns-q"].Published
+	nsPublished := GetNamespaceCounters("ns")["ns-q"].Published
+	c.Check(nsQueue.Publish("ns-d1", "ns-d2"), IsNil)
+	c.Check(readyCount(c, queue), Equals, 0)
+	c.Check(readyCount(c, nsQueue), Equals, 2)
+	c.Check(GetCounters()["ns-q"].Published, Equals, published)
+	c.Check(GetNamespaceCounters("ns")["ns-q"].Published, Equals, nsPublished+2)
+	c.Check(GetCounterMetrics(), Matches, `(?s).*\nrmq_published_total\{namespace="ns",queue="ns-q"\} \d+\n.*`)
+
+	c.Check(openQueues(c, nsConnection), DeepEquals, []string{"ns-q"})
+	c.Check(connections(c, nsConnection), DeepEquals, []string{nsConnection.Name})
+
+	stats, err := nsConnection.CollectStats([]string{"ns-q"})
+	c.Check(err, IsNil)
+	c.Check(stats.QueueStats["ns-q"].ReadyCount, Equals, 2)
+
+	// only cleaners of the same namespace clean the connection
+	c.Check(nsQueue.StartConsuming(10, time.Millisecond), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	<-nsQueue.StopConsuming()
+	c.Check(unackedCount(c, nsQueue), Equals, 2)
+	nsConnection.StopHeartbeat()
+	_, err = NewCleaner(connection).Clean()
+	c.Check(err, IsNil)
+	c.Check(connections(c, nsConnection), DeepEquals, []string{nsConnection.Name}) // not cleaned
+	c.Check(unackedCount(c, nsQueue), Equals, 2)
+	cleanerConnection, err := OpenConnectionWithOptions("ns-cleaner", redisClient, ConnectionOptions{Namespace: "ns"})
+	c.Assert(err, IsNil)
+	result, err := NewCleaner(cleanerConnection).Clean()
+	c.Check(err, IsNil)
+	c.Check(result.Connections, DeepEquals, []string{nsConnection.Name})
+	c.Check(readyCount(c, nsQueue), Equals, 2)
+
+	cleanerConnection.StopHeartbeat()
+	connection.StopHeartbeat()
+}
+
 func (suite *QueueSuite) TestConnectionQueues(c *C) {
-	connection := OpenConnection("conn-q-conn", "tcp", "localhost:6379", 1)
+	connection := openConnection(c, "conn-q-conn")
 	c.Assert(connection, NotNil)
 
-	connection.CloseAllQueues()
-	c.Check(connection.GetOpenQueues(), HasLen, 0)
+	_, err := connection.CloseAllQueues()
+	c.Check(err, IsNil)
+	c.Check(openQueues(c, connection), HasLen, 0)
 
-	queue1 := connection.OpenQueue("conn-q-q1").(*redisQueue)
+	queue1 := openQueue(c, connection, "conn-q-q1")
 	c.Assert(queue1, NotNil)
-	c.Check(connection.GetOpenQueues(), DeepEquals, []string{"conn-q-q1"})
-	c.Check(connection.GetConsumingQueues(), HasLen, 0)
-	queue1.StartConsuming(1, time.Millisecond)
-	c.Check(connection.GetConsumingQueues(), DeepEquals, []string{"conn-q-q1"})
+	c.Check(openQueues(c, connection), DeepEquals, []string{"conn-q-q1"})
+	c.Check(consumingQueues(c, connection), HasLen, 0)
+	c.Check(queue1.StartConsuming(1, time.Millisecond), IsNil)
+	c.Check(consumingQueues(c, connection), DeepEquals, []string{"conn-q-q1"})
 
-	queue2 := connection.OpenQueue("conn-q-q2").(*redisQueue)
+	queue2 := openQueue(c, connection, "conn-q-q2")
 	c.Assert(queue2, NotNil)
-	c.Check(connection.GetOpenQueues(), HasLen, 2)
-	c.Check(connection.GetConsumingQueues(), HasLen, 1)
-	queue2.StartConsuming(1, time.Millisecond)
-	c.Check(connection.GetConsumingQueues(), HasLen, 2)
+	c.Check(openQueues(c, connection), HasLen, 2)
+	c.Check(consumingQueues(c, connection), HasLen, 1)
+	c.Check(queue2.StartConsuming(1, time.Millisecond), IsNil)
+	c.Check(consumingQueues(c, connection), HasLen, 2)
 
 	queue2.StopConsuming()
-	queue2.CloseInConnection()
-	c.Check(connection.GetOpenQueues(), HasLen, 2)
-	c.Check(connection.GetConsumingQueues(), DeepEquals, []string{"conn-q-q1"})
+	c.Check(queue2.CloseInConnection(), IsNil)
+	c.Check(openQueues(c, connection), HasLen, 2)
+	c.Check(consumingQueues(c, connection), DeepEquals, []string{"conn-q-q1"})
 
 	queue1.StopConsuming()
-	queue1.CloseInConnection()
-	c.Check(connection.GetOpenQueues(), HasLen, 2)
-	c.Check(connection.GetConsumingQueues(), HasLen, 0)
+	c.Check(queue1.CloseInConnection(), IsNil)
+	c.Check(openQueues(c, connection), HasLen, 2)
+	c.Check(consumingQueues(c, connection), HasLen, 0)
 
-	queue1.Close()
-	c.Check(connection.GetOpenQueues(), DeepEquals, []string{"conn-q-q2"})
-	c.Check(connection.GetConsumingQueues(), HasLen, 0)
+	c.Check(queue1.Close(), IsNil)
+	c.Check(queue1.Close(), Equals, ErrNotFound)
+	c.Check(openQueues(c, connection), DeepEquals, []string{"conn-q-q2"})
+	c.Check(consumingQueues(c, connection), HasLen, 0)
 
 	connection.StopHeartbeat()
 }
 
 func (suite *QueueSuite) TestQueue(c *C) {
-	connection := OpenConnection("queue-conn", "tcp", "localhost:6379", 1)
+	connection := openConnection(c, "queue-conn")
 	c.Assert(connection, NotNil)
 
-	queue := connection.OpenQueue("queue-q").(*redisQueue)
+	queue := openQueue(c, connection, "queue-q")
 	c.Assert(queue, NotNil)
 	queue.PurgeReady()
-	c.Check(queue.ReadyCount(), Equals, 0)
-	c.Check(queue.Publish("queue-d1"), Equals, true)
-	c.Check(queue.ReadyCount(), Equals, 1)
-	c.Check(queue.Publish("queue-d2"), Equals, true)
-	c.Check(queue.ReadyCount(), Equals, 2)
-	c.Check(queue.PurgeReady(), Equals, 2)
-	c.Check(queue.ReadyCount(), Equals, 0)
-	c.Check(queue.PurgeReady(), Equals, 0)
-
-	queue.RemoveAllConsumers()
-	c.Check(queue.GetConsumers(), HasLen, 0)
-	c.Check(connection.GetConsumingQueues(), HasLen, 0)
-	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
-	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, false)
-	cons1name := queue.AddConsumer("queue-cons1", NewTestConsumer("queue-A"))
+	c.Check(readyCount(c, queue), Equals, 0)
+	c.Check(queue.Publish("queue-d1"), IsNil)
+	c.Check(readyCount(c, queue), Equals, 1)
+	c.Check(queue.Publish("queue-d2"), IsNil)
+	c.Check(readyCount(c, queue), Equals, 2)
+	count, err := queue.PurgeReady()
+	c.Check(err, IsNil)
+	c.Check(count, Equals, 2)
+	c.Check(readyCount(c, queue), Equals, 0)
+	count, err = queue.PurgeReady()
+	c.Check(err, IsNil)
+	c.Check(count, Equals, 0)
+
+	_, err = queue.RemoveAllConsumers()
+	c.Check(err, IsNil)
+	c.Check(consumers(c, queue), HasLen, 0)
+	c.Check(consumingQueues(c, connection), HasLen, 0)
+	_, err = queue.AddConsumer("queue-cons0", NewTestConsumer("queue-0"))
+	c.Check(err, Equals, ErrNotConsuming)
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, ErrAlreadyConsuming)
+	cons1name, err := queue.AddConsumer("queue-cons1", NewTestConsumer("queue-A"))
+	c.Check(err, IsNil)
 	time.Sleep(time.Millisecond)
-	c.Check(connection.GetConsumingQueues(), HasLen, 1)
-	c.Check(queue.GetConsumers(), DeepEquals, []string{cons1name})
-	cons2name := queue.AddConsumer("queue-cons2", NewTestConsumer("queue-B"))
-	c.Check(queue.GetConsumers(), HasLen, 2)
-	c.Check(queue.RemoveConsumer("queue-cons3"), Equals, false)
-	c.Check(queue.RemoveConsumer(cons1name), Equals, true)
-	c.Check(queue.GetConsumers(), DeepEquals, []string{cons2name})
-	c.Check(queue.RemoveConsumer(cons2name), Equals, true)
-	c.Check(queue.GetConsumers(), HasLen, 0)
+	c.Check(consumingQueues(c, connection), HasLen, 1)
+	c.Check(consumers(c, queue), DeepEquals, []string{cons1name})
+	cons2name, err := queue.AddConsumer("queue-cons2", NewTestConsumer("queue-B"))
+	c.Check(err, IsNil)
+	c.Check(consumers(c, queue), HasLen, 2)
+	removed, err := queue.RemoveConsumer("queue-cons3")
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, false)
+	removed, err = queue.RemoveConsumer(cons1name)
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, true)
+	c.Check(consumers(c, queue), DeepEquals, []string{cons2name})
+	removed, err = queue.RemoveConsumer(cons2name)
+	c.Check(err, IsNil)
+	c.Check(removed, Equals, true)
+	c.Check(consumers(c, queue), HasLen, 0)
 
 	queue.StopConsuming()
+	_, err = queue.AddConsumer("queue-cons4", NewTestConsumer("queue-C"))
+	c.Check(err, Equals, ErrConsumingStopped)
 	connection.StopHeartbeat()
 }
 
 func (suite *QueueSuite) TestConsumer(c *C) {
-	connection := OpenConnection("cons-conn", "tcp", "localhost:6379", 1)
+	connection := openConnection(c, "cons-conn")
 	c.Assert(connection, NotNil)
 
-	queue1 := connection.OpenQueue("cons-q").(*redisQueue)
+	queue1 := openQueue(c, connection, "cons-q")
 	c.Assert(queue1, NotNil)
 	queue1.PurgeReady()
 
@@ -136,57 +278,63 @@ func (suite *QueueSuite) TestConsumer(c *C) {
 	consumer.AutoAck = false
 	queue1.StartConsuming(10, time.Millisecond)
 	queue1.AddConsumer("cons-cons", consumer)
-	c.Check(consumer.LastDelivery, IsNil)
+	c.Check(consumer.Last(), IsNil)
 
-	c.Check(queue1.Publish("cons-d1"), Equals, true)
+	c.Check(queue1.Publish("cons-d1"), IsNil)
 	time.Sleep(2 * time.Millisecond)
-	c.Assert(consumer.LastDelivery, NotNil)
-	c.Check(consumer.LastDelivery.Payload(), Equals, "cons-d1")
-	c.Check(queue1.ReadyCount(), Equals, 0)
-	c.Check(queue1.UnackedCount(), Equals, 1)
+	c.Assert(consumer.Last(), NotNil)
+	c.Check(consumer.Last().Payload(), Equals, "cons-d1")
+	c.Check(readyCount(c, queue1), Equals, 0)
+	c.Check(unackedCount(c, queue1), Equals, 1)
 
-	c.Check(queue1.Publish("cons-d2"), Equals, true)
+	c.Check(queue1.Publish("cons-d2"), IsNil)
 	time.Sleep(2 * time.Millisecond)
-	c.Check(consumer.LastDelivery.Payload(), Equals, "cons-d2")
-	c.Check(queue1.ReadyCount(), Equals, 0)
-	c.Check(queue1.UnackedCount(), Equals, 2)
+	c.Check(consumer.Last().Payload(), Equals, "cons-d2")
+	c.Check(readyCount(c, queue1), Equals, 0)
+	c.Check(unackedCount(c, queue1), Equals, 2)
 
-	c.Check(consumer.LastDeliveries[0].Ack(), Equals, true)
-	c.Check(queue1.ReadyCount(), Equals, 0)
-	c.Check(queue1.UnackedCount(), Equals, 1)
+	c.Check(consumer.Deliveries()[0].Ack(), IsNil)
+	c.Check(readyCount(c, queue1), Equals, 0)
+	c.Check(unackedCount(c, queue1), Equals, 1)
 
-	c.Check(consumer.LastDeliveries[1].Ack(), Equals, true)
-	c.Check(queue1.ReadyCount(), Equals, 0)
-	c.Check(queue1.UnackedCount(), Equals, 0)
+	c.Check(consumer.Deliveries()[1].Ack(), IsNil)
+	c.Check(readyCount(c, queue1), Equals, 0)
+	c.Check(unackedCount(c, queue1), Equals, 0)
 
-	c.Check(consumer.LastDeliveries[0].Ack(), Equals, false)
+	c.Check(consumer.Deliveries()[0].Ack(), Equals, ErrNotFound)
+	c.Check(consumer.Deliveries()[0].Reject(), Equals, ErrNotFound)
+	c.Check(rejectedCount(c, queue1), Equals, 0)
 
-	c.Check(queue1.Publish("cons-d3"), Equals, true)
+	c.Check(queue1.Publish("cons-d3"), IsNil)
 	time.Sleep(2 * time.Millisecond)
-	c.Check(queue1.ReadyCount(), Equals, 0)
-	c.Check(queue1.UnackedCount(), Equals, 1)
-	c.Check(queue1.RejectedCount(), Equals, 0)
-	c.Check(consumer.LastDelivery.Payload(), Equals, "cons-d3")
-	c.Check(consumer.LastDelivery.Reject(), Equals, true)
-	c.Check(queue1.ReadyCount(), Equals, 0)
-	c.Check(queue1.UnackedCount(), Equals, 0)
-	c.Check(queue1.RejectedCount(), Equals, 1)
-
-	c.Check(queue1.Publish("cons-d4"), Equals, true)
+	c.Check(readyCount(c, queue1), Equals, 0)
+	c.Check(unackedCount(c, queue1), Equals, 1)
+	c.Check(rejectedCount(c, queue1), Equals, 0)
+	c.Check(consumer.Last().Payload(), Equals, "cons-d3")
+	c.Check(consumer.Last().Reject(), IsNil)
+	c.Check(readyCount(c, queue1), Equals, 0)
+	c.Check(unackedCount(c, queue1), Equals, 0)
+	c.Check(rejectedCount(c, queue1), Equals, 1)
+
+	c.Check(queue1.Publish("cons-d4"), IsNil)
 	time.Sleep(2 * time.Millisecond)
-	c.Check(queue1.ReadyCount(), Equals, 0)
-	c.Check(queue1.UnackedCount(), Equals, 1)
-	c.Check(queue1.RejectedCount(), Equals, 1)
-	c.Check(consumer.LastDelivery.Payload(), Equals, "cons-d4")
-	c.Check(consumer.LastDelivery.Reject(), Equals, true)
-	c.Check(queue1.ReadyCount(), Equals, 0)
-	c.Check(queue1.UnackedCount(), Equals, 0)
-	c.Check(queue1.RejectedCount(), Equals, 2)
-	c.Check(queue1.PurgeRejected(), Equals, 2)
-	c.Check(queue1.RejectedCount(), Equals, 0)
-	c.Check(queue1.PurgeRejected(), Equals, 0)
-
-	queue2 := connection.OpenQueue("cons-func-q").(*redisQueue)
+	c.Check(readyCount(c, queue1), Equals, 0)
+	c.Check(unackedCount(c, queue1), Equals, 1)
+	c.Check(rejectedCount(c, queue1), Equals, 1)
+	c.Check(consumer.Last().Payload(), Equals, "cons-d4")
+	c.Check(consumer.Last().Reject(), IsNil)
+	c.Check(readyCount(c, queue1), Equals, 0)
+	c.Check(unackedCount(c, queue1), Equals, 0)
+	c.Check(rejectedCount(c, queue1), Equals, 2)
+	count, err := queue1.PurgeRejected()
+	c.Check(err, IsNil)
+	c.Check(count, Equals, 2)
+	c.Check(rejectedCount(c, queue1), Equals, 0)
+	count, err = queue1.PurgeRejected()
+	c.Check(err, IsNil)
+	c.Check(count, Equals, 0)
+
+	queue2 := openQueue(c, connection, "cons-func-q")
 	queue2.StartConsuming(10, time.Millisecond)
 
 	payloadChan := make(chan string, 1)
@@ -197,11 +345,11 @@ func (suite *QueueSuite) TestConsumer(c *C) {
 		payloadChan <- delivery.Payload()
 	})
 
-	c.Check(queue2.Publish(payload), Equals, true)
+	c.Check(queue2.Publish(payload), IsNil)
 	time.Sleep(2 * time.Millisecond)
 	c.Check(<-payloadChan, Equals, payload)
-	c.Check(queue2.ReadyCount(), Equals, 0)
-	c.Check(queue2.UnackedCount(), Equals, 0)
+	c.Check(readyCount(c, queue2), Equals, 0)
+	c.Check(unackedCount(c, queue2), Equals, 0)
 
 	queue1.StopConsuming()
 	queue2.StopConsuming()
@@ -209,20 +357,20 @@ func (suite *QueueSuite) TestConsumer(c *C) {
 }
 
 func (suite *QueueSuite) TestMulti(c *C) {
-	connection := OpenConnection("multi-conn", "tcp", "localhost:6379", 1)
-	queue := connection.OpenQueue("multi-q").(*redisQueue)
+	connection := openConnection(c, "multi-conn")
+	queue := openQueue(c, connection, "multi-q")
 	queue.PurgeReady()
 
 	for i := 0; i < 20; i++ {
-		c.Check(queue.Publish(fmt.Sprintf("multi-d%d", i)), Equals, true)
+		c.Check(queue.Publish(fmt.Sprintf("multi-d%d", i)), IsNil)
 	}
-	c.Check(queue.ReadyCount(), Equals, 20)
-	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(readyCount(c, queue), Equals, 20)
+	c.Check(unackedCount(c, queue), Equals, 0)
 
 	queue.StartConsuming(10, time.Millisecond)
 	time.Sleep(2 * time.Millisecond)
-	c.Check(queue.ReadyCount(), Equals, 10)
-	c.Check(queue.UnackedCount(), Equals, 10)
+	c.Check(readyCount(c, queue), Equals, 10)
+	c.Check(unackedCount(c, queue), Equals, 10)
 
 	consumer := NewTestConsumer("multi-cons")
 	consumer.AutoAck = false
@@ -230,139 +378,166 @@ func (suite *QueueSuite) TestMulti(c *C) {
 
 	queue.AddConsumer("multi-cons", consumer)
 	time.Sleep(10 * time.Millisecond)
-	c.Check(queue.ReadyCount(), Equals, 9)
-	c.Check(queue.UnackedCount(), Equals, 11)
+	c.Check(readyCount(c, queue), Equals, 9)
+	c.Check(unackedCount(c, queue), Equals, 11)
 
-	c.Check(consumer.LastDelivery.Ack(), Equals, true)
+	c.Check(consumer.Last().Ack(), IsNil)
 	time.Sleep(10 * time.Millisecond)
-	c.Check(queue.ReadyCount(), Equals, 9)
-	c.Check(queue.UnackedCount(), Equals, 10)
+	c.Check(readyCount(c, queue), Equals, 9)
+	c.Check(unackedCount(c, queue), Equals, 10)
 
 	consumer.Finish()
 	time.Sleep(10 * time.Millisecond)
-	c.Check(queue.ReadyCount(), Equals, 8)
-	c.Check(queue.UnackedCount(), Equals, 11)
+	c.Check(readyCount(c, queue), Equals, 8)
+	c.Check(unackedCount(c, queue), Equals, 11)
 
-	c.Check(consumer.LastDelivery.Ack(), Equals, true)
+	c.Check(consumer.Last().Ack(), IsNil)
 	time.Sleep(10 * time.Millisecond)
-	c.Check(queue.ReadyCount(), Equals, 8)
-	c.Check(queue.UnackedCount(), Equals, 10)
+	c.Check(readyCount(c, queue), Equals, 8)
+	c.Check(unackedCount(c, queue), Equals, 10)
 
 	consumer.Finish()
 	time.Sleep(10 * time.Millisecond)
-	c.Check(queue.ReadyCount(), Equals, 7)
-	c.Check(queue.UnackedCount(), Equals, 11)
+	c.Check(readyCount(c, queue), Equals, 7)
+	c.Check(unackedCount(c, queue), Equals, 11)
 
 	queue.StopConsuming()
 	connection.StopHeartbeat()
 }
 
 func (suite *QueueSuite) TestBatch(c *C) {
-	connection := OpenConnection("batch-conn", "tcp", "localhost:6379", 1)
-	queue := connection.OpenQueue("batch-q").(*redisQueue)
+	connection := openConnection(c, "batch-conn")
+	queue := openQueue(c, connection, "batch-q")
 	queue.PurgeRejected()
 	queue.PurgeReady()
 
 	for i := 0; i < 5; i++ {
-		c.Check(queue.Publish(fmt.Sprintf("batch-d%d", i)), Equals, true)
+		c.Check(queue.Publish(fmt.Sprintf("batch-d%d", i)), IsNil)
 	}
 
 	queue.StartConsuming(10, time.Millisecond)
 	time.Sleep(10 * time.Millisecond)
-	c.Check(queue.UnackedCount(), Equals, 5)
+	c.Check(unackedCount(c, queue), Equals, 5)
 
 	consumer := NewTestBatchConsumer()
 	queue.AddBatchConsumerWithTimeout("batch-cons", 2, 50*time.Millisecond, consumer)
 	time.Sleep(10 * time.Millisecond)
-	c.Assert(consumer.LastBatch, HasLen, 2)
-	c.Check(consumer.LastBatch[0].Payload(), Equals, "batch-d0")
-	c.Check(consumer.LastBatch[1].Payload(), Equals, "batch-d1")
-	c.Check(consumer.LastBatch[0].Reject(), Equals, true)
-	c.Check(consumer.LastBatch[1].Ack(), Equals, true)
-	c.Check(queue.UnackedCount(), Equals, 3)
-	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Assert(consumer.Last(), HasLen, 2)
+	c.Check(consumer.Last()[0].Payload(), Equals, "batch-d0")
+	c.Check(consumer.Last()[1].Payload(), Equals, "batch-d1")
+	c.Check(consumer.Last()[0].Reject(), IsNil)
+	c.Check(consumer.Last()[1].Ack(), IsNil)
+	c.Check(unackedCount(c, queue), Equals, 3)
+	c.Check(rejectedCount(c, queue), Equals, 1)
 
 	consumer.Finish()
 	time.Sleep(10 * time.Millisecond)
-	c.Assert(consumer.LastBatch, HasLen, 2)
-	c.Check(consumer.LastBatch[0].Payload(), Equals, "batch-d2")
-	c.Check(consumer.LastBatch[1].Payload(), Equals, "batch-d3")
-	c.Check(consumer.LastBatch[0].Reject(), Equals, true)
-	c.Check(consumer.LastBatch[1].Ack(), Equals, true)
-	c.Check(queue.UnackedCount(), Equals, 1)
-	c.Check(queue.RejectedCount(), Equals, 2)
+	c.Assert(consumer.Last(), HasLen, 2)
+	c.Check(consumer.Last()[0].Payload(), Equals, "batch-d2")
+	c.Check(consumer.Last()[1].Payload(), Equals, "batch-d3")
+	c.Check(consumer.Last()[0].Reject(), IsNil)
+	c.Check(consumer.Last()[1].Ack(), IsNil)
+	c.Check(unackedCount(c, queue), Equals, 1)
+	c.Check(rejectedCount(c, queue), Equals, 2)
 
 	consumer.Finish()
 	time.Sleep(10 * time.Millisecond)
-	c.Check(consumer.LastBatch, HasLen, 0)
-	c.Check(queue.UnackedCount(), Equals, 1)
-	c.Check(queue.RejectedCount(), Equals, 2)
+	c.Check(consumer.Last(), HasLen, 0)
+	c.Check(unackedCount(c, queue), Equals, 1)
+	c.Check(rejectedCount(c, queue), Equals, 2)
 
 	time.Sleep(60 * time.Millisecond)
-	c.Assert(consumer.LastBatch, HasLen, 1)
-	c.Check(consumer.LastBatch[0].Payload(), Equals, "batch-d4")
-	c.Check(consumer.LastBatch[0].Reject(), Equals, true)
-	c.Check(queue.UnackedCount(), Equals, 0)
-	c.Check(queue.RejectedCount(), Equals, 3)
+	c.Assert(consumer.Last(), HasLen, 1)
+	c.Check(consumer.Last()[0].Payload(), Equals, "batch-d4")
+	c.Check(consumer.Last()[0].Reject(), IsNil)
+	c.Check(unackedCount(c, queue), Equals, 0)
+	c.Check(rejectedCount(c, queue), Equals, 3)
 }
 
 func (suite *QueueSuite) TestReturnRejected(c *C) {
-	connection := OpenConnection("return-conn", "tcp", "localhost:6379", 1)
-	queue := connection.OpenQueue("return-q").(*redisQueue)
+	connection := openConnection(c, "return-conn")
+	queue := openQueue(c, connection, "return-q")
 	queue.PurgeReady()
 
 	for i := 0; i < 6; i++ {
-		c.Check(queue.Publish(fmt.Sprintf("return-d%d", i)), Equals, true)
+		c.Check(queue.Publish(fmt.Sprintf("return-d%d", i)), IsNil)
 	}
 
-	c.Check(queue.ReadyCount(), Equals, 6)
-	c.Check(queue.UnackedCount(), Equals, 0)
-	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(readyCount(c, queue), Equals, 6)
+	c.Check(unackedCount(c, queue), Equals, 0)
+	c.Check(rejectedCount(c, queue), Equals, 0)
 
 	queue.StartConsuming(10, time.Millisecond)
 	time.Sleep(time.Millisecond)
-	c.Check(queue.ReadyCount(), Equals, 0)
-	c.Check(queue.UnackedCount(), Equals, 6)
-	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(readyCount(c, queue), Equals, 0)
+	c.Check(unackedCount(c, queue), Equals, 6)
+	c.Check(rejectedCount(c, queue), Equals, 0)
 
 	consumer := NewTestConsumer("return-cons")
 	consumer.AutoAck = false
 	queue.AddConsumer("cons", consumer)
 	time.Sleep(time.Millisecond)
-	c.Check(queue.ReadyCount(), Equals, 0)
-	c.Check(queue.UnackedCount(), Equals, 6)
-	c.Check(queue.RejectedCount(), Equals, 0)
-
-	c.Check(consumer.LastDeliveries, HasLen, 6)
-	consumer.LastDeliveries[0].Reject()
-	consumer.LastDeliveries[1].Ack()
-	consumer.LastDeliveries[2].Reject()
-	consumer.LastDeliveries[3].Reject()
+	c.Check(readyCount(c, queue), Equals, 0)
+	c.Check(unackedCount(c, queue), Equals, 6)
+	c.Check(rejectedCount(c, queue), Equals, 0)
+
+	c.Check(consumer.Deliveries(), HasLen, 6)
+	consumer.Deliveries()[0].Reject()
+	consumer.Deliveries()[1].Ack()
+	consumer.Deliveries()[2].Reject()
+	consumer.Deliveries()[3].Reject()
 	// delivery 4 still open
-	consumer.LastDeliveries[5].Reject()
+	consumer.Deliveries()[5].Reject()
 
 	time.Sleep(time.Millisecond)
-	c.Check(queue.ReadyCount(), Equals, 0)
-	c.Check(queue.UnackedCount(), Equals, 1)  // delivery 4
-	c.Check(queue.RejectedCount(), Equals, 4) // delivery 0, 2, 3, 5
+	c.Check(readyCount(c, queue), Equals, 0)
+	c.Check(unackedCount(c, queue), Equals, 1)  // delivery 4
+	c.Check(rejectedCount(c, queue), Equals, 4) // delivery 0, 2, 3, 5
+
+	<-queue.StopConsuming() // don't fetch returned deliveries again
+
+	count, err := queue.ReturnRejected(2)
+	c.Check(err, IsNil)
+	c.Check(count, Equals, 2)
+	c.Check(readyCount(c, queue), Equals, 2)    // delivery 0, 2
+	c.Check(unackedCount(c, queue), Equals, 1)  // delivery 4
+	c.Check(rejectedCount(c, queue), Equals, 2) // delivery 3, 5
+
+	count, err = queue.ReturnAllRejected()
+	c.Check(err, IsNil)
+	c.Check(count, Equals, 2)
+	c.Check(readyCount(c, queue), Equals, 4)   // delivery 0, 2, 3, 5
+	c.Check(unackedCount(c, queue), Equals, 1) // delivery 4
+	c.Check(rejectedCount(c, queue), Equals, 0)
+}
 
-	queue.StopConsuming()
+func (suite *QueueSuite) TestReturnRejectedBatches(c *C) {
+	connection := openConnection(c, "return-batches-conn")
+	queue := openQueue(c, connection, "return-batches-q")
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	for i := 0; i < 2*returnBatchSize+50; i++ {
+		_, err := queue.redisClient.LPush(queue.rejectedKey, fmt.Sprintf("return-batches-d%d", i))
+		c.Check(err, IsNil)
+	}
 
-	queue.ReturnRejected(2)
-	c.Check(queue.ReadyCount(), Equals, 2)    // delivery 0, 2
-	c.Check(queue.UnackedCount(), Equals, 1)  // delivery 4
-	c.Check(queue.RejectedCount(), Equals, 2) // delivery 3, 5
+	count, err := queue.ReturnRejected(returnBatchSize + 20)
+	c.Check(err, IsNil)
+	c.Check(count, Equals, returnBatchSize+20)
+	c.Check(rejectedCount(c, queue), Equals, returnBatchSize+30)
 
-	queue.ReturnAllRejected()
-	c.Check(queue.ReadyCount(), Equals, 4)   // delivery 0, 2, 3, 5
-	c.Check(queue.UnackedCount(), Equals, 1) // delivery 4
-	c.Check(queue.RejectedCount(), Equals, 0)
+	count, err = queue.ReturnAllRejected()
+	c.Check(err, IsNil)
+	c.Check(count, Equals, returnBatchSize+30)
+	c.Check(readyCount(c, queue), Equals, 2*returnBatchSize+50)
+	c.Check(rejectedCount(c, queue), Equals, 0)
 }
 
 func (suite *QueueSuite) TestPushQueue(c *C) {
-	connection := OpenConnection("push", "tcp", "localhost:6379", 1)
-	queue1 := connection.OpenQueue("queue1").(*redisQueue)
-	queue2 := connection.OpenQueue("queue2").(*redisQueue)
+	connection := openConnection(c, "push")
+	queue1 := openQueue(c, connection, "queue1")
+	queue2 := openQueue(c, connection, "queue2")
 	queue1.SetPushQueue(queue2)
 	c.Check(queue1.pushKey, Equals, queue2.readyKey)
 
@@ -380,23 +555,690 @@ func (suite *QueueSuite) TestPushQueue(c *C) {
 
 	queue1.Publish("d1")
 	time.Sleep(2 * time.Millisecond)
-	c.Check(queue1.UnackedCount(), Equals, 1)
-	c.Assert(consumer1.LastDeliveries, HasLen, 1)
+	c.Check(unackedCount(c, queue1), Equals, 1)
+	c.Assert(consumer1.Deliveries(), HasLen, 1)
 
-	c.Check(consumer1.LastDelivery.Push(), Equals, true)
+	c.Check(consumer1.Last().Push(), IsNil)
 	time.Sleep(2 * time.Millisecond)
-	c.Check(queue1.UnackedCount(), Equals, 0)
-	c.Check(queue2.UnackedCount(), Equals, 1)
+	c.Check(unackedCount(c, queue1), Equals, 0)
+	c.Check(unackedCount(c, queue2), Equals, 1)
 
-	c.Assert(consumer2.LastDeliveries, HasLen, 1)
-	c.Check(consumer2.LastDelivery.Push(), Equals, true)
+	c.Assert(consumer2.Deliveries(), HasLen, 1)
+	c.Check(consumer2.Last().Push(), IsNil)
 	time.Sleep(2 * time.Millisecond)
-	c.Check(queue2.RejectedCount(), Equals, 1)
+	c.Check(rejectedCount(c, queue2), Equals, 1)
+}
+
+func (suite *QueueSuite) TestDeadLetterQueue(c *C) {
+	connection := openConnection(c, "dead-conn")
+	queue := openQueue(c, connection, "dead-q")
+	deadQueue := openQueue(c, connection, "dead-q-dead")
+	_, err := queue.PurgeReady()
+	c.Check(err, IsNil)
+	_, err = queue.PurgeRejected()
+	c.Check(err, IsNil)
+	_, err = deadQueue.PurgeReady()
+	c.Check(err, IsNil)
+
+	queue.SetDeadLetterQueue(deadQueue, 2)
+	consumer := NewTestConsumer("dead-cons")
+	consumer.AutoAck = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err = queue.AddConsumer("dead-cons", consumer)
+	c.Check(err, IsNil)
+
+	c.Check(queue.Publish("dead-d1"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 1)
+	c.Check(consumer.Last().RejectWithReason("first"), IsNil)
+	c.Check(rejectedCount(c, queue), Equals, 1)
+	c.Check(readyCount(c, deadQueue), Equals, 0)
+
+	// rejections are counted across returns
+	_, err = queue.ReturnAllRejected()
+	c.Check(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 2)
+	c.Check(consumer.Last().Headers()[HeaderRejectReason], Equals, "first")
+	c.Check(consumer.Last().RejectWithReason("second"), IsNil)
+	c.Check(rejectedCount(c, queue), Equals, 0)
+	c.Check(unackedCount(c, queue), Equals, 0)
+	c.Check(readyCount(c, deadQueue), Equals, 1)
+	<-queue.StopConsuming()
+
+	deadConsumer := NewTestConsumer("dead-dead-cons")
+	c.Check(deadQueue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err = deadQueue.AddConsumer("dead-dead-cons", deadConsumer)
+	c.Check(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(deadConsumer.Deliveries(), HasLen, 1)
+	delivery := deadConsumer.Last()
+	c.Check(delivery.Payload(), Equals, "dead-d1")
+	c.Check(delivery.ID(), Equals, consumer.Last().ID())
+	c.Check(delivery.Headers()[HeaderRejectReason], Equals, "second")
+	c.Check(delivery.Headers()[HeaderDeadLetteredBy], Equals, "dead-q")
+	_, err = time.Parse(time.RFC3339, delivery.Headers()[HeaderRejectedAt])
+	c.Check(err, IsNil)
+
+	<-deadQueue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestClusterKeys(c *C) {
+	connection := openClusterConnection(c, "cluster-conn")
+	queue := openQueue(c, connection, "cluster-q")
+	pushQueue := openQueue(c, connection, "cluster-q-push")
+	c.Check(queue.readyKey, Equals, "rmq::queue::{cluster-q}::ready")
+	c.Check(queue.unackedKey, Equals, "rmq::queue::{cluster-q}::connection::"+connection.Name+"::unacked")
+	c.Check(hashTag(queue.rejectedKey), Equals, "cluster-q")
+	c.Check(hashTag(queue.delayedKey), Equals, "cluster-q")
+	c.Check(hashTag(queue.consumersKey), Equals, "cluster-q")
+	_, err := queue.PurgeReady()
+	c.Check(err, IsNil)
+	_, err = pushQueue.PurgeReady()
+	c.Check(err, IsNil)
+
+	queue.SetPushQueue(pushQueue)
+	consumer := NewTestConsumer("cluster-cons")
+	consumer.AutoAck = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err = queue.AddConsumer("cluster-cons", consumer)
+	c.Check(err, IsNil)
+	c.Check(queue.Publish("cluster-d1", "cluster-d2"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 2)
+	c.Check(consumer.Deliveries()[0].Push(), IsNil)
+	c.Check(consumer.Deliveries()[0].Push(), Equals, ErrNotFound)
+	c.Check(consumer.Deliveries()[1].Ack(), IsNil)
+	c.Check(unackedCount(c, queue), Equals, 0)
+	c.Check(readyCount(c, pushQueue), Equals, 1)
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestMigrateKeys(c *C) {
+	connection := openConnection(c, "migrate-conn")
+	queue := openQueue(c, connection, "migrate-q")
+	_, err := queue.PurgeReady()
+	c.Check(err, IsNil)
+	c.Check(queue.Publish("migrate-d1", "migrate-d2", "migrate-d3"), IsNil)
+	c.Check(queue.PublishDelayed("migrate-d4", time.Hour), IsNil)
+	c.Check(queue.PublishWithPriority(5, "migrate-h1"), IsNil)
+	// consume migrate-d1 without a consumer running
+	_, err = connection.redisClient.SAdd(connection.queuesKey, "migrate-q")
+	c.Check(err, IsNil)
+	_, err = connection.redisClient.SAdd(queue.consumersKey, "migrate-cons")
+	c.Check(err, IsNil)
+	_, err = connection.redisClient.RPopLPush(queue.readyKey, queue.unackedKey)
+	c.Check(err, IsNil)
+
+	clusterConnection := openClusterConnection(c, "migrate-cluster-conn")
+	clusterQueue := openQueue(c, clusterConnection, "migrate-q")
+	c.Check(clusterQueue.Publish("migrate-d5"), IsNil)
+	migrated, err := clusterConnection.MigrateKeys(LegacyKeys)
+	c.Check(err, IsNil)
+	c.Check(migrated >= 4, Equals, true) // ready, delayed, unacked and consumers, maybe more from other tests
+	c.Check(readyCount(c, queue), Equals, 0)
+	c.Check(unackedCount(c, queue), Equals, 0)
+	c.Check(delayedCount(c, queue), Equals, 0)
+
+	// migrated deliveries are consumed before the ones published after the switch
+	c.Check(readyCount(c, clusterQueue), Equals, 4)
+	readyCounts, err := clusterQueue.ReadyCountByPriority()
+	c.Check(err, IsNil)
+	c.Check(readyCounts, DeepEquals, map[int]int{5: 1, 0: 3})
+	legacyCount, err := connection.redisClient.LLen(queue.priorityReadyKey(5))
+	c.Check(err, IsNil)
+	c.Check(legacyCount, Equals, 0)
+	c.Check(delayedCount(c, clusterQueue), Equals, 1)
+	migratedConnection := clusterConnection.hijackConnection(connection.Name)
+	c.Check(unackedCount(c, migratedConnection.openQueue("migrate-q")), Equals, 1)
+
+	clusterConsumer := NewTestConsumer("migrate-cluster-cons")
+	c.Check(clusterQueue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err = clusterQueue.AddConsumer("migrate-cluster-cons", clusterConsumer)
+	c.Check(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(clusterConsumer.Deliveries(), HasLen, 4)
+	c.Check(clusterConsumer.Deliveries()[0].Payload(), Equals, "migrate-h1")
+	c.Check(clusterConsumer.Deliveries()[1].Payload(), Equals, "migrate-d2")
+	c.Check(clusterConsumer.Deliveries()[2].Payload(), Equals, "migrate-d3")
+	c.Check(clusterConsumer.Deliveries()[3].Payload(), Equals, "migrate-d5")
+
+	<-clusterQueue.StopConsuming()
+	clusterConnection.StopHeartbeat()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPriorities(c *C) {
+	connection := openConnection(c, "prio-conn")
+	queue := openQueue(c, connection, "prio-q")
+	c.Check(queue.Close(), IsNil)
+	queue = openQueue(c, connection, "prio-q")
+
+	c.Check(queue.PublishWithPriority(-1, "prio-l1"), IsNil)
+	c.Check(queue.Publish("prio-d1"), IsNil)
+	c.Check(queue.PublishWithPriority(5, "prio-h1", "prio-h2"), IsNil)
+	c.Check(readyCount(c, queue), Equals, 4)
+	readyCounts, err := queue.ReadyCountByPriority()
+	c.Check(err, IsNil)
+	c.Check(readyCounts, DeepEquals, map[int]int{5: 2, 0: 1, -1: 1})
+
+	stats, err := connection.CollectStats([]string{"prio-q"})
+	c.Check(err, IsNil)
+	c.Check(stats.QueueStats["prio-q"].ReadyCount, Equals, 4)
+	c.Check(stats.QueueStats["prio-q"].ReadyCountByPriority, DeepEquals, map[int]int{5: 2, 0: 1, -1: 1})
+
+	consumer := NewTestConsumer("prio-cons")
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err = queue.AddConsumer("prio-cons", consumer)
+	c.Check(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 4)
+	c.Check(consumer.Deliveries()[0].Payload(), Equals, "prio-h1")
+	c.Check(consumer.Deliveries()[1].Payload(), Equals, "prio-h2")
+	c.Check(consumer.Deliveries()[2].Payload(), Equals, "prio-d1")
+	c.Check(consumer.Deliveries()[3].Payload(), Equals, "prio-l1")
+	<-queue.StopConsuming()
+
+	c.Check(queue.PublishWithPriority(1, "prio-p1"), IsNil)
+	purged, err := queue.PurgeReady()
+	c.Check(err, IsNil)
+	c.Check(purged, Equals, 1)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPriorityReturned(c *C) {
+	connection := openConnection(c, "prio-return-conn")
+	queue := openQueue(c, connection, "prio-return-q")
+	c.Check(queue.Close(), IsNil)
+	queue = openQueue(c, connection, "prio-return-q")
+
+	c.Check(queue.PublishWithPriority(10, "prio-return-h1", "prio-return-h2"), IsNil)
+
+	// fetch without consuming
+	queue.deliveryChan = make(chan Delivery, 10)
+	fetched, err := queue.fetch([]int{10}, 2)
+	c.Check(err, IsNil)
+	c.Check(fetched, Equals, 2)
+	c.Check((<-queue.deliveryChan).Reject(), IsNil)
+
+	count, err := queue.ReturnRejected(1)
+	c.Check(err, IsNil)
+	c.Check(count, Equals, 1)
+	readyCounts, err := queue.ReadyCountByPriority()
+	c.Check(err, IsNil)
+	c.Check(readyCounts, DeepEquals, map[int]int{10: 1, 0: 0})
+
+	count, err = queue.ReturnAllUnacked()
+	c.Check(err, IsNil)
+	c.Check(count, Equals, 1)
+	readyCounts, err = queue.ReadyCountByPriority()
+	c.Check(err, IsNil)
+	c.Check(readyCounts, DeepEquals, map[int]int{10: 2, 0: 0})
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestStarvationLimit(c *C) {
+	connection := openConnection(c, "starve-conn")
+	queue := openQueue(c, connection, "starve-q")
+	c.Check(queue.Close(), IsNil)
+	queue = openQueue(c, connection, "starve-q")
+
+	c.Check(queue.PublishWithPriority(5, "starve-h1", "starve-h2", "starve-h3"), IsNil)
+	c.Check(queue.Publish("starve-d1"), IsNil)
+	c.Check(queue.PublishWithPriority(-1, "starve-l1"), IsNil)
+	queue.SetStarvationLimit(2)
+
+	// fetch one delivery at a time without consuming
+	queue.deliveryChan = make(chan Delivery, 10)
+	priorities, err := queue.priorities()
+	c.Check(err, IsNil)
+	c.Check(priorities, DeepEquals, []int{5, 0, -1})
+	for _, expected := range []string{"starve-h1", "starve-h2", "starve-d1", "starve-l1", "starve-h3"} {
+		fetched, err := queue.fetch(priorities, 1)
+		c.Check(err, IsNil)
+		c.Check(fetched, Equals, 1)
+		c.Check((<-queue.deliveryChan).Payload(), Equals, expected)
+	}
+	fetched, err := queue.fetch(priorities, 1)
+	c.Check(err, IsNil)
+	c.Check(fetched, Equals, 0)
+
+	_, err = queue.ReturnAllUnacked()
+	c.Check(err, IsNil)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishUnique(c *C) {
+	connection := openConnection(c, "unique-conn")
+	queue := openQueue(c, connection, "unique-q")
+	_, err := queue.PurgeReady()
+	c.Check(err, IsNil)
+
+	c.Check(queue.PublishUnique("unique-k1", "unique-d1", 50*time.Millisecond), IsNil)
+	c.Check(queue.PublishUnique("unique-k1", "unique-d2", 50*time.Millisecond), Equals, ErrDuplicate)
+	c.Check(queue.PublishUnique("unique-k2", "unique-d3", 50*time.Millisecond), IsNil)
+	c.Check(readyCount(c, queue), Equals, 2)
+
+	time.Sleep(60 * time.Millisecond)
+	c.Check(queue.PublishUnique("unique-k1", "unique-d4", 50*time.Millisecond), IsNil)
+	c.Check(readyCount(c, queue), Equals, 3)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishWithTTL(c *C) {
+	connection := openConnection(c, "ttl-conn")
+	queue := openQueue(c, connection, "ttl-q")
+	c.Check(queue.Close(), IsNil)
+	queue = openQueue(c, connection, "ttl-q")
+	counters := GetCounters()["ttl-q"]
+
+	c.Check(queue.PublishWithTTL(time.Millisecond, "ttl-d1", "ttl-d2"), IsNil)
+	c.Check(queue.PublishWithTTL(time.Hour, "ttl-d3"), IsNil)
+	time.Sleep(5 * time.Millisecond)
+
+	consumer := NewTestConsumer("ttl-cons")
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err := queue.AddConsumer("ttl-cons", consumer)
+	c.Check(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 1)
+	c.Check(consumer.Last().Payload(), Equals, "ttl-d3")
+	<-queue.StopConsuming()
+
+	c.Check(readyCount(c, queue), Equals, 0)
+	c.Check(unackedCount(c, queue), Equals, 0)
+	expiredCount, err := queue.ExpiredCount()
+	c.Check(err, IsNil)
+	c.Check(expiredCount, Equals, 2)
+	c.Check(GetCounters()["ttl-q"].Expired, Equals, counters.Expired+2)
+
+	stats, err := connection.CollectStats([]string{"ttl-q"})
+	c.Check(err, IsNil)
+	c.Check(stats.QueueStats["ttl-q"].ExpiredCount, Equals, 2)
+
+	purged, err := queue.PurgeExpired()
+	c.Check(err, IsNil)
+	c.Check(purged, Equals, 2)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestLeases(c *C) {
+	connection := openConnection(c, "lease-conn")
+	queue := openQueue(c, connection, "lease-q")
+	c.Check(queue.Close(), IsNil)
+	queue = openQueue(c, connection, "lease-q")
+	c.Check(queue.newDelivery("lease-d0").ExtendLease(time.Second), Equals, ErrNoLease)
+
+	queue.SetLeaseDuration(50 * time.Millisecond)
+	c.Check(queue.Publish("lease-d1", "lease-d2"), IsNil)
+	consumer := NewTestConsumer("lease-cons")
+	consumer.AutoAck = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err := queue.AddConsumer("lease-cons", consumer)
+	c.Check(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 2)
+	c.Check(consumer.Deliveries()[1].ExtendLease(time.Hour), IsNil)
+
+	// the lease of lease-d1 expires, it gets returned and consumed again
+	time.Sleep(60 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 3)
+	c.Check(consumer.Last().Payload(), Equals, "lease-d1")
+	c.Check(unackedCount(c, queue), Equals, 2)
+
+	c.Check(consumer.Last().Ack(), IsNil)
+	c.Check(consumer.Deliveries()[0].Ack(), Equals, ErrNotFound)
+	c.Check(consumer.Deliveries()[0].ExtendLease(time.Hour), Equals, ErrNotFound)
+	c.Check(consumer.Deliveries()[1].Ack(), IsNil)
+
+	time.Sleep(60 * time.Millisecond)
+	c.Check(consumer.Deliveries(), HasLen, 3)
+	<-queue.StopConsuming()
+	c.Check(readyCount(c, queue), Equals, 0)
+	c.Check(unackedCount(c, queue), Equals, 0)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestLeasesPrefetched(c *C) {
+	connection := openConnection(c, "lease-prefetch-conn")
+	queue := openQueue(c, connection, "lease-prefetch-q")
+	c.Check(queue.Close(), IsNil)
+	queue = openQueue(c, connection, "lease-prefetch-q")
+
+	queue.SetLeaseDuration(50 * time.Millisecond)
+	c.Check(queue.Publish("lease-prefetch-d1", "lease-prefetch-d2"), IsNil)
+	consumer := NewTestConsumer("lease-prefetch-cons")
+	consumer.AutoAck = false
+	consumer.AutoFinish = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err := queue.AddConsumer("lease-prefetch-cons", consumer)
+	c.Check(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 1)
+	c.Check(consumer.Last().ExtendLease(time.Hour), IsNil)
+
+	// lease-prefetch-d2 waits in the prefetch buffer longer than the lease
+	// duration, but isn't leased yet so it doesn't get returned
+	time.Sleep(70 * time.Millisecond)
+	c.Check(readyCount(c, queue), Equals, 0)
+	c.Check(unackedCount(c, queue), Equals, 2)
+
+	c.Check(consumer.Last().Ack(), IsNil)
+	consumer.Finish()
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 2)
+	c.Check(consumer.Last().Payload(), Equals, "lease-prefetch-d2")
+	c.Check(consumer.Last().ExtendLease(time.Hour), IsNil) // leased once taken
+	c.Check(consumer.Last().Ack(), IsNil)
+	consumer.Finish()
+
+	<-queue.StopConsuming()
+	c.Check(consumer.Deliveries(), HasLen, 2)
+	c.Check(readyCount(c, queue), Equals, 0)
+	c.Check(unackedCount(c, queue), Equals, 0)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDelayed(c *C) {
+	connection := openConnection(c, "delayed-conn")
+	queue := openQueue(c, connection, "delayed-q")
+	c.Check(queue.Close(), IsNil)
+	queue = openQueue(c, connection, "delayed-q")
+
+	c.Check(queue.PublishDelayed("delayed-d1", 50*time.Millisecond), IsNil)
+	c.Check(queue.PublishDelayed("delayed-d1", 50*time.Millisecond), IsNil)
+	c.Check(queue.PublishAt("delayed-d2", time.Now().Add(-time.Second)), IsNil)
+	c.Check(readyCount(c, queue), Equals, 0)
+	c.Check(delayedCount(c, queue), Equals, 3)
+
+	moved, err := queue.MoveDueDelayed()
+	c.Check(err, IsNil)
+	c.Check(moved, Equals, 1)
+	c.Check(readyCount(c, queue), Equals, 1)
+	c.Check(delayedCount(c, queue), Equals, 2)
+
+	consumer := NewTestConsumer("delayed-cons")
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err = queue.AddConsumer("delayed-cons", consumer)
+	c.Check(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 1)
+	c.Check(consumer.Last().Payload(), Equals, "delayed-d2")
+	c.Check(delayedCount(c, queue), Equals, 2)
+
+	time.Sleep(60 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 3)
+	c.Check(consumer.Deliveries()[1].Payload(), Equals, "delayed-d1")
+	c.Check(consumer.Deliveries()[2].Payload(), Equals, "delayed-d1")
+	c.Check(delayedCount(c, queue), Equals, 0)
+	c.Check(readyCount(c, queue), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestEnvelope(c *C) {
+	connection := openConnection(c, "envelope-conn")
+	queue := openQueue(c, connection, "envelope-q")
+	_, err := queue.PurgeReady()
+	c.Check(err, IsNil)
+
+	c.Check(queue.Publish("envelope-d1", "envelope-d1"), IsNil)
+	c.Check(queue.PublishWithHeaders(map[string]string{"trace": "t1"}, "envelope-d2"), IsNil)
+	_, err = queue.redisClient.LPush(queue.readyKey, "envelope-raw") // published by older versions
+	c.Check(err, IsNil)
+	c.Check(readyCount(c, queue), Equals, 4)
+
+	consumer := NewTestConsumer("envelope-cons")
+	consumer.AutoAck = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err = queue.AddConsumer("envelope-cons", consumer)
+	c.Check(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 4)
+	c.Check(unackedCount(c, queue), Equals, 4)
+
+	first, second := consumer.Deliveries()[0], consumer.Deliveries()[1]
+	c.Check(first.Payload(), Equals, "envelope-d1")
+	c.Check(second.Payload(), Equals, "envelope-d1")
+	c.Check(first.ID(), Not(Equals), "")
+	c.Check(first.ID(), Not(Equals), second.ID())
+	c.Check(first.PublishedAt().IsZero(), Equals, false)
+	c.Check(first.Headers(), IsNil)
+
+	// acking one delivery doesn't ack the other one with the same payload
+	c.Check(first.Ack(), IsNil)
+	c.Check(first.Ack(), Equals, ErrNotFound)
+	c.Check(unackedCount(c, queue), Equals, 3)
+	c.Check(second.Reject(), IsNil)
+	c.Check(rejectedCount(c, queue), Equals, 1)
+
+	third := consumer.Deliveries()[2]
+	c.Check(third.Payload(), Equals, "envelope-d2")
+	c.Check(third.Headers(), DeepEquals, map[string]string{"trace": "t1"})
+	c.Check(third.Ack(), IsNil)
+
+	raw := consumer.Deliveries()[3]
+	c.Check(raw.Payload(), Equals, "envelope-raw")
+	c.Check(raw.ID(), Equals, "")
+	c.Check(raw.PublishedAt().IsZero(), Equals, true)
+	c.Check(raw.Ack(), IsNil)
+	c.Check(unackedCount(c, queue), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestBlockingFetch(c *C) {
+	connection := openConnection(c, "blocking-conn")
+	queue := openQueue(c, connection, "blocking-q")
+	_, err := queue.PurgeReady()
+	c.Check(err, IsNil)
+
+	queue.SetBlockingFetch(time.Second)
+	consumer := NewTestConsumer("blocking-cons")
+	consumer.AutoFinish = false
+	c.Check(queue.StartConsuming(2, time.Millisecond), IsNil)
+	_, err = queue.AddConsumer("blocking-cons", consumer)
+	c.Check(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+
+	// delivered right away even though the queue is waiting for a second
+	c.Check(queue.Publish("blocking-d1"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 1)
+	c.Check(consumer.Last().Payload(), Equals, "blocking-d1")
+	consumer.Finish()
+
+	// doesn't fetch more than the prefetch limit
+	c.Check(queue.Publish("blocking-d2", "blocking-d3", "blocking-d4", "blocking-d5"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(readyCount(c, queue), Equals, 1)   // delivery 5
+	c.Check(unackedCount(c, queue), Equals, 2) // delivery 3 and 4 prefetched, 2 is acked but not finished
+	consumer.Finish()
+	consumer.Finish()
+	consumer.Finish()
+	consumer.Finish()
+	time.Sleep(10 * time.Millisecond)
+	c.Check(readyCount(c, queue), Equals, 0)
+	c.Check(unackedCount(c, queue), Equals, 0)
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumerPanic(c *C) {
+	connection := openConnection(c, "panic-conn")
+	queue := openQueue(c, connection, "panic-q")
+	c.Check(queue.Close(), IsNil)
+	queue = openQueue(c, connection, "panic-q")
+
+	type recovery struct {
+		queue     string
+		payload   string
+		recovered interface{}
+	}
+	recoveries := make(chan recovery, 10)
+	queue.SetPanicPolicy(PanicReject)
+	queue.OnConsumerPanic(func(queue string, delivery Delivery, recovered interface{}) {
+		recoveries <- recovery{queue, delivery.Payload(), recovered}
+	})
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err := queue.AddConsumerFunc("panic-cons", func(delivery Delivery) {
+		if delivery.Payload() == "panic-d1" {
+			panic("panic-d1 failed")
+		}
+		delivery.Ack()
+	})
+	c.Check(err, IsNil)
+
+	// the consumer keeps consuming after the panic
+	c.Check(queue.Publish("panic-d1", "panic-d2"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(recoveries, HasLen, 1)
+	c.Check(<-recoveries, Equals, recovery{"panic-q", "panic-d1", "panic-d1 failed"})
+	c.Check(unackedCount(c, queue), Equals, 0)
+	c.Check(rejectedCount(c, queue), Equals, 1)
+
+	// without retry policy deliveries are rejected
+	queue.SetPanicPolicy(PanicRetry)
+	c.Check(queue.Publish("panic-d1"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(rejectedCount(c, queue), Equals, 2)
+
+	queue.SetRetryPolicy(RetryPolicy{BaseBackoff: time.Hour})
+	c.Check(queue.Publish("panic-d1"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(rejectedCount(c, queue), Equals, 2)
+	c.Check(delayedCount(c, queue), Equals, 1)
+	c.Check(recoveries, HasLen, 2)
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestMiddlewares(c *C) {
+	connection := openConnection(c, "middleware-conn")
+	queue := openQueue(c, connection, "middleware-q")
+	c.Check(queue.Close(), IsNil)
+	queue = openQueue(c, connection, "middleware-q")
+
+	calls := make(chan string, 20)
+	tag := func(name string) Middleware {
+		return func(next Consumer) Consumer {
+			return ConsumerFunc(func(delivery Delivery) {
+				calls <- name + " " + delivery.Payload()
+				next.Consume(delivery)
+			})
+		}
+	}
+	queue.Use(tag("outer"), tag("inner"))
+	queue.Use(AutoAckMiddleware())
+
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err := queue.AddContextConsumerFunc("middleware-cons", func(ctx context.Context, delivery Delivery) {
+		c.Check(ctx, NotNil)
+		calls <- "consume " + delivery.Payload()
+	})
+	c.Check(err, IsNil)
+	c.Check(queue.Publish("middleware-d1"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(calls, HasLen, 3)
+	c.Check(<-calls, Equals, "outer middleware-d1")
+	c.Check(<-calls, Equals, "inner middleware-d1")
+	c.Check(<-calls, Equals, "consume middleware-d1")
+	c.Check(unackedCount(c, queue), Equals, 0)
+
+	<-queue.StopConsuming()
+	queue = openQueue(c, connection, "middleware-q")
+	queue.UseBatch(func(next BatchConsumer) BatchConsumer {
+		return batchConsumerFunc(func(batch Deliveries) {
+			calls <- "batch"
+			next.Consume(batch)
+			batch.Ack()
+		})
+	})
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	batchConsumer := NewTestBatchConsumer()
+	batchConsumer.AutoFinish = true
+	_, err = queue.AddBatchConsumerWithTimeout("middleware-batch", 2, time.Millisecond, batchConsumer)
+	c.Check(err, IsNil)
+	c.Check(queue.Publish("middleware-d2", "middleware-d3"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(<-calls, Equals, "batch")
+	c.Check(batchConsumer.Consumed(), Equals, 2)
+	c.Check(unackedCount(c, queue), Equals, 0)
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestContext(c *C) {
+	connection := openConnection(c, "context-conn")
+	ctx, cancel := context.WithCancel(context.Background())
+	q, err := connection.OpenQueueContext(ctx, "context-q")
+	c.Assert(err, IsNil)
+	queue := q.(*redisQueue)
+	_, err = queue.PurgeReady()
+	c.Check(err, IsNil)
+
+	c.Check(queue.PublishContext(ctx, "context-d1"), IsNil)
+	c.Check(readyCount(c, queue), Equals, 1)
+	stats, err := connection.CollectStatsContext(ctx, []string{"context-q"})
+	c.Check(err, IsNil)
+	c.Check(stats.QueueStats["context-q"].ReadyCount, Equals, 1)
+
+	cancel()
+	c.Check(queue.PublishContext(ctx, "context-d2"), Equals, context.Canceled)
+	_, err = connection.OpenQueueContext(ctx, "context-q")
+	c.Check(err, Equals, context.Canceled)
+	_, err = connection.CollectStatsContext(ctx, []string{"context-q"})
+	c.Check(err, Equals, context.Canceled)
+	c.Check(readyCount(c, queue), Equals, 1)
+
+	ctxErrs := make(chan error, 10)
+	queue.SetConsumeTimeout(5 * time.Millisecond)
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err = queue.AddContextConsumerFunc("context-cons", func(ctx context.Context, delivery Delivery) {
+		<-ctx.Done()
+		delivery.Ack()
+		ctxErrs <- ctx.Err()
+	})
+	c.Check(err, IsNil)
+
+	// deadline elapses
+	select {
+	case err := <-ctxErrs:
+		c.Check(err, Equals, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		c.Fatal("consumer context wasn't cancelled")
+	}
+	c.Check(unackedCount(c, queue), Equals, 0)
+
+	// stop consuming cancels
+	queue.SetConsumeTimeout(0)
+	c.Check(queue.Publish("context-d3"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(unackedCount(c, queue), Equals, 1)
+	finishedChan := queue.StopConsuming()
+	select {
+	case err := <-ctxErrs:
+		c.Check(err, Equals, context.Canceled)
+	case <-time.After(time.Second):
+		c.Fatal("consumer context wasn't cancelled")
+	}
+	<-finishedChan
+	c.Check(unackedCount(c, queue), Equals, 0)
+
+	connection.StopHeartbeat()
 }
 
 func (suite *QueueSuite) TestConsuming(c *C) {
-	connection := OpenConnection("consume", "tcp", "localhost:6379", 1)
-	queue := connection.OpenQueue("consume-q").(*redisQueue)
+	connection := openConnection(c, "consume")
+	queue := openQueue(c, connection, "consume-q")
 
 	finishedChan := queue.StopConsuming()
 	c.Check(finishedChan, NotNil)
@@ -418,8 +1260,8 @@ func (suite *QueueSuite) TestConsuming(c *C) {
 }
 
 func (suite *QueueSuite) TestStopConsuming_Consumer(c *C) {
-	connection := OpenConnection("consume", "tcp", "localhost:6379", 1)
-	queue := connection.OpenQueue("consume-q").(*redisQueue)
+	connection := openConnection(c, "consume")
+	queue := openQueue(c, connection, "consume-q")
 	queue.PurgeReady()
 
 	deliveryCount := 30
@@ -443,19 +1285,81 @@ func (suite *QueueSuite) TestStopConsuming_Consumer(c *C) {
 
 	var consumedCount int
 	for i := 0; i < 10; i++ {
-		consumedCount += len(consumers[i].LastDeliveries)
+		consumedCount += len(consumers[i].Deliveries())
 	}
 
 	// make sure all fetched deliveries are consumed
-	c.Check(consumedCount, Equals, deliveryCount-queue.ReadyCount())
+	c.Check(consumedCount, Equals, deliveryCount-readyCount(c, queue))
 	c.Check(queue.deliveryChan, HasLen, 0)
 
 	connection.StopHeartbeat()
 }
 
+func (suite *QueueSuite) TestStopConsumingWithTimeout(c *C) {
+	connection := openConnection(c, "stop-timeout-conn")
+	queue := openQueue(c, connection, "stop-timeout-q")
+	c.Check(queue.Close(), IsNil)
+	queue = openQueue(c, connection, "stop-timeout-q")
+
+	c.Check(queue.Publish("stop-d1", "stop-d2", "stop-d3", "stop-d4", "stop-d5"), IsNil)
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	consumer := NewTestConsumer("stop-timeout-cons")
+	consumer.AutoAck = false
+	consumer.AutoFinish = false
+	_, err := queue.AddConsumer("stop-timeout-cons", consumer)
+	c.Check(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.Deliveries(), HasLen, 1)
+
+	// the consumer doesn't finish in time, the prefetched deliveries are returned
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	result, err := queue.StopConsumingWithTimeout(ctx, true)
+	c.Check(err, Equals, context.DeadlineExceeded)
+	c.Check(result, Equals, StopResult{Returned: 4, Unacked: 1})
+	c.Check(readyCount(c, queue), Equals, 4)
+
+	consumer.Finish()
+	time.Sleep(time.Millisecond)
+	c.Check(consumer.Deliveries(), HasLen, 1)
+	c.Check(consumer.Last().Ack(), IsNil)
+
+	// without returning all prefetched deliveries get consumed
+	queue = openQueue(c, connection, "stop-timeout-q")
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	consumer = NewTestConsumer("stop-timeout-cons")
+	consumer.SleepDuration = time.Millisecond
+	_, err = queue.AddConsumer("stop-timeout-cons", consumer)
+	c.Check(err, IsNil)
+	time.Sleep(time.Millisecond)
+	result, err = queue.StopConsumingWithTimeout(context.Background(), false)
+	c.Check(err, IsNil)
+	c.Check(result, Equals, StopResult{})
+	c.Check(consumer.Deliveries(), HasLen, 4-readyCount(c, queue))
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestStopAllConsuming(c *C) {
+	connection := openConnection(c, "stop-all-conn")
+	queue1 := openQueue(c, connection, "stop-all-q1")
+	queue2 := openQueue(c, connection, "stop-all-q2")
+	openQueue(c, connection, "stop-all-q3") // not consuming
+	c.Check(queue1.StartConsuming(10, time.Millisecond), IsNil)
+	c.Check(queue2.StartConsuming(10, time.Millisecond), IsNil)
+
+	<-connection.StopAllConsuming()
+	_, err := queue1.AddConsumer("stop-all-cons", NewTestConsumer("stop-all-cons"))
+	c.Check(err, Equals, ErrConsumingStopped)
+	_, err = queue2.AddConsumer("stop-all-cons", NewTestConsumer("stop-all-cons"))
+	c.Check(err, Equals, ErrConsumingStopped)
+
+	connection.StopHeartbeat()
+}
+
 func (suite *QueueSuite) TestStopConsuming_BatchConsumer(c *C) {
-	connection := OpenConnection("batchConsume", "tcp", "localhost:6379", 1)
-	queue := connection.OpenQueue("batchConsume-q").(*redisQueue)
+	connection := openConnection(c, "batchConsume")
+	queue := openQueue(c, connection, "batchConsume-q")
 	queue.PurgeReady()
 
 	deliveryCount := 50
@@ -483,21 +1387,227 @@ func (suite *QueueSuite) TestStopConsuming_BatchConsumer(c *C) {
 
 	var consumedCount int
 	for i := 0; i < 10; i++ {
-		consumedCount += consumers[i].ConsumedCount
+		consumedCount += consumers[i].Consumed()
 	}
 
 	// make sure all fetched deliveries are consumed
-	c.Check(consumedCount, Equals, deliveryCount-queue.ReadyCount())
+	c.Check(consumedCount, Equals, deliveryCount-readyCount(c, queue))
 	c.Check(queue.deliveryChan, HasLen, 0)
 
 	connection.StopHeartbeat()
 }
 
+func (suite *QueueSuite) TestRateLimit(c *C) {
+	connection := openConnection(c, "ratelimit-conn")
+	queue := openQueue(c, connection, "ratelimit-q")
+	_, err := queue.PurgeReady()
+	c.Check(err, IsNil)
+	for i := 0; i < 20; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("ratelimit-d%d", i)), IsNil)
+	}
+
+	queue.SetRateLimit(5, time.Second)
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	consumer := NewTestConsumer("ratelimit-cons")
+	_, err = queue.AddConsumer("ratelimit-cons", consumer)
+	c.Check(err, IsNil)
+	time.Sleep(20 * time.Millisecond)
+	c.Check(consumer.Deliveries(), HasLen, 5)
+	c.Check(readyCount(c, queue), Equals, 15)
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestSharedRateLimit(c *C) {
+	connection1 := openConnection(c, "shared-ratelimit-conn1")
+	connection2 := openConnection(c, "shared-ratelimit-conn2")
+	queue1 := openQueue(c, connection1, "shared-ratelimit-q")
+	queue2 := openQueue(c, connection2, "shared-ratelimit-q")
+	_, err := queue1.PurgeReady()
+	c.Check(err, IsNil)
+	_, err = queue1.redisClient.Del("rmq::queue::[shared-ratelimit-q]::ratelimit")
+	c.Check(err, IsNil)
+	for i := 0; i < 20; i++ {
+		c.Check(queue1.Publish(fmt.Sprintf("shared-ratelimit-d%d", i)), IsNil)
+	}
+
+	consumers := []*TestConsumer{}
+	for _, queue := range []*redisQueue{queue1, queue2} {
+		queue.SetSharedRateLimit(6, time.Second)
+		c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+		consumer := NewTestConsumer("shared-ratelimit-cons")
+		_, err = queue.AddConsumer("shared-ratelimit-cons", consumer)
+		c.Check(err, IsNil)
+		consumers = append(consumers, consumer)
+	}
+	time.Sleep(20 * time.Millisecond)
+	c.Check(len(consumers[0].Deliveries())+len(consumers[1].Deliveries()), Equals, 6)
+	c.Check(readyCount(c, queue1), Equals, 14)
+	<-queue1.StopConsuming()
+	<-queue2.StopConsuming()
+	connection1.StopHeartbeat()
+	connection2.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestSharedRateLimitSubMillisecond(c *C) {
+	connection := openConnection(c, "submilli-ratelimit-conn")
+	queue := openQueue(c, connection, "submilli-ratelimit-q")
+	_, err := queue.redisClient.Del("rmq::queue::[submilli-ratelimit-q]::ratelimit")
+	c.Check(err, IsNil)
+
+	queue.SetSharedRateLimit(2, 500*time.Microsecond)
+	c.Assert(queue.rateLimiter, NotNil)
+	c.Check(queue.rateLimiter.(*redisRateLimiter).period, Equals, "1")
+	taken, err := queue.rateLimiter.take(3)
+	c.Check(err, IsNil)
+	c.Check(taken, Equals, 2)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPause(c *C) {
+	connection1 := openConnection(c, "pause-conn1")
+	connection2 := openConnection(c, "pause-conn2")
+	queue1 := openQueue(c, connection1, "pause-q")
+	c.Check(queue1.Close(), IsNil)
+	queue1 = openQueue(c, connection1, "pause-q")
+	queue2 := openQueue(c, connection2, "pause-q")
+	queue2.SetBlockingFetch(time.Millisecond)
+
+	c.Check(queue1.Pause(), IsNil)
+	paused, err := queue2.Paused()
+	c.Check(err, IsNil)
+	c.Check(paused, Equals, true)
+	priorities, err := queue2.priorities()
+	c.Check(err, IsNil)
+	c.Check(priorities, DeepEquals, []int{0}) // paused marker is no priority
+
+	consumers := []*TestConsumer{}
+	for _, queue := range []*redisQueue{queue1, queue2} {
+		c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+		consumer := NewTestConsumer("pause-cons")
+		_, err = queue.AddConsumer("pause-cons", consumer)
+		c.Check(err, IsNil)
+		consumers = append(consumers, consumer)
+	}
+	c.Check(queue1.Publish("pause-d1", "pause-d2"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(readyCount(c, queue1), Equals, 2)
+	c.Check(consumers[0].Deliveries(), HasLen, 0)
+	c.Check(consumers[1].Deliveries(), HasLen, 0)
+
+	c.Check(queue2.Resume(), IsNil)
+	paused, err = queue1.Paused()
+	c.Check(err, IsNil)
+	c.Check(paused, Equals, false)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(readyCount(c, queue1), Equals, 0)
+	c.Check(len(consumers[0].Deliveries())+len(consumers[1].Deliveries()), Equals, 2)
+
+	<-queue1.StopConsuming()
+	<-queue2.StopConsuming()
+	connection1.StopHeartbeat()
+	connection2.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumeMany(c *C) {
+	connection := openConnection(c, "many-conn")
+	queueA := openQueue(c, connection, "many-qa")
+	queueB := openQueue(c, connection, "many-qb")
+	for _, queue := range []*redisQueue{queueA, queueB} {
+		_, err := queue.PurgeReady()
+		c.Check(err, IsNil)
+		for i := 0; i < 8; i++ {
+			c.Check(queue.Publish(fmt.Sprintf("%s-d%d", queue.name, i)), IsNil)
+		}
+	}
+
+	_, err := connection.ConsumeMany([]Queue{queueA, queueB}, []int{3}, 4)
+	c.Check(err, Equals, ErrInvalidWeights)
+	_, err = connection.ConsumeMany([]Queue{queueA, queueB}, []int{3, 0}, 4)
+	c.Check(err, Equals, ErrInvalidWeights)
+	_, err = connection.ConsumeMany([]Queue{queueA, queueA}, []int{3, 1}, 4)
+	c.Check(err, Equals, ErrDuplicateQueue)
+	otherConnection := openConnection(c, "many-other-conn")
+	_, err = connection.ConsumeMany([]Queue{queueA, openQueue(c, otherConnection, "many-qb")}, []int{3, 1}, 4)
+	c.Check(err, Equals, ErrForeignQueue)
+	testConnection := NewTestConnection()
+	testQueue, err := testConnection.OpenQueue("many-qb")
+	c.Check(err, IsNil)
+	_, err = connection.ConsumeMany([]Queue{queueA, testQueue}, []int{3, 1}, 4)
+	c.Check(err, Equals, ErrForeignQueue)
+	otherConnection.StopHeartbeat()
+
+	multi, err := connection.ConsumeMany([]Queue{queueA, queueB}, []int{3, 1}, 4)
+	c.Assert(err, IsNil)
+	_, err = connection.ConsumeMany([]Queue{queueA}, []int{1}, 4)
+	c.Check(err, Equals, ErrAlreadyConsuming)
+	_, err = queueA.AddConsumerFunc("many-cons", func(Delivery) {})
+	c.Check(err, Equals, ErrConsumingMany)
+	_, err = queueA.StopConsumingWithTimeout(context.Background(), true)
+	c.Check(err, Equals, ErrConsumingMany)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(unackedCount(c, queueA), Equals, 3)
+	c.Check(unackedCount(c, queueB), Equals, 1)
+
+	consumed := make(chan Delivery, 20)
+	name, err := multi.AddConsumerFunc("many-cons", func(delivery Delivery) {
+		c.Check(delivery.Ack(), IsNil)
+		consumed <- delivery
+	})
+	c.Check(err, IsNil)
+	c.Check(consumers(c, queueA), DeepEquals, []string{name})
+	c.Check(consumers(c, queueB), DeepEquals, []string{name})
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(consumed, HasLen, 16)
+	for i := 0; i < 16; i++ {
+		delivery := <-consumed
+		c.Check(delivery.Payload(), Matches, delivery.Queue()+"-d.")
+	}
+	c.Check(readyCount(c, queueA), Equals, 0)
+	c.Check(readyCount(c, queueB), Equals, 0)
+
+	<-connection.StopAllConsuming()
+	_, err = multi.AddConsumerFunc("many-cons", func(Delivery) {})
+	c.Check(err, Equals, ErrConsumingStopped)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestLogger(c *C) {
+	buffer := &lockedBuffer{}
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	connection, err := OpenConnectionWithOptions("logger-conn", redisClient, ConnectionOptions{
+		Logger: NewStdLogger(log.New(buffer, "", 0), true),
+	})
+	c.Assert(err, IsNil)
+	queue, err := connection.OpenQueue("logger-q")
+	c.Assert(err, IsNil)
+	_, err = queue.PurgeReady()
+	c.Check(err, IsNil)
+
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err = queue.AddConsumerFunc("logger-cons", func(delivery Delivery) {
+		c.Check(delivery.Ack(), IsNil)
+	})
+	c.Check(err, IsNil)
+	c.Check(queue.Publish("logger-d1"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+
+	lines := strings.Split(buffer.String(), "\n")
+	c.Check(lines[0], Matches, "rmq info: connected connection=logger-conn-.*")
+	c.Check(strings.Join(lines, "\n"), Matches, "(?s).*rmq info: started consuming queue=logger-q connection=logger-conn-.* prefetch=10 poll=1ms\n.*")
+	c.Check(strings.Join(lines, "\n"), Matches, "(?s).*rmq debug: delivery acked queue=logger-q delivery=.*")
+	c.Check(strings.Join(lines, "\n"), Matches, "(?s).*rmq info: stopped fetching queue=logger-q .*")
+	c.Check(strings.Join(lines, "\n"), Matches, "(?s).*rmq debug: added consumer queue=logger-q consumer=logger-cons-.*")
+	c.Check(strings.Join(lines, "\n"), Matches, "(?s).*rmq info: stopped consuming queue=logger-q connection=logger-conn-.*")
+}
+
 func (suite *QueueSuite) BenchmarkQueue(c *C) {
 	// open queue
-	connection := OpenConnection("bench-conn", "tcp", "localhost:6379", 1)
+	connection := openConnection(c, "bench-conn")
 	queueName := fmt.Sprintf("bench-q%d", c.N)
-	queue := connection.OpenQueue(queueName).(*redisQueue)
+	queue := openQueue(c, connection, queueName)
 
 	// add some consumers
 	numConsumers := 10
@@ -512,13 +1622,13 @@ func (suite *QueueSuite) BenchmarkQueue(c *C) {
 
 	// publish deliveries
 	for i := 0; i < c.N; i++ {
-		c.Check(queue.Publish("bench-d"), Equals, true)
+		c.Check(queue.Publish("bench-d"), IsNil)
 	}
 
 	// wait until all are consumed
 	for {
-		ready := queue.ReadyCount()
-		unacked := queue.UnackedCount()
+		ready := readyCount(c, queue)
+		unacked := unackedCount(c, queue)
 		fmt.Printf("%d unacked %d %d\n", c.N, ready, unacked)
 		if ready == 0 && unacked == 0 {
 			break
@@ -530,9 +1640,109 @@ func (suite *QueueSuite) BenchmarkQueue(c *C) {
 
 	sum := 0
 	for _, consumer := range consumers {
-		sum += len(consumer.LastDeliveries)
+		sum += len(consumer.Deliveries())
 	}
 	fmt.Printf("consumed %d\n", sum)
 
 	connection.StopHeartbeat()
 }
+
+func openConnection(c *C, tag string) *redisConnection {
+	connection, err := OpenConnection(tag, "tcp", "localhost:6379", 1, nil)
+	c.Assert(err, IsNil)
+	return connection
+}
+
+func openClusterConnection(c *C, tag string) *redisConnection {
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	connection, err := OpenClusterConnection(tag, redisClient, nil)
+	c.Assert(err, IsNil)
+	return connection
+}
+
+func openQueue(c *C, connection *redisConnection, name string) *redisQueue {
+	queue, err := connection.OpenQueue(name)
+	c.Assert(err, IsNil)
+	return queue.(*redisQueue)
+}
+
+func readyCount(c *C, queue *redisQueue) int {
+	count, err := queue.ReadyCount()
+	c.Assert(err, IsNil)
+	return count
+}
+
+func unackedCount(c *C, queue *redisQueue) int {
+	count, err := queue.UnackedCount()
+	c.Assert(err, IsNil)
+	return count
+}
+
+func rejectedCount(c *C, queue *redisQueue) int {
+	count, err := queue.RejectedCount()
+	c.Assert(err, IsNil)
+	return count
+}
+
+func delayedCount(c *C, queue *redisQueue) int {
+	count, err := queue.DelayedCount()
+	c.Assert(err, IsNil)
+	return count
+}
+
+func openQueues(c *C, connection *redisConnection) []string {
+	queues, err := connection.GetOpenQueues()
+	c.Assert(err, IsNil)
+	return queues
+}
+
+func consumingQueues(c *C, connection *redisConnection) []string {
+	queues, err := connection.GetConsumingQueues()
+	c.Assert(err, IsNil)
+	return queues
+}
+
+func consumers(c *C, queue *redisQueue) []string {
+	consumers, err := queue.GetConsumers()
+	c.Assert(err, IsNil)
+	return consumers
+}
+
+func connections(c *C, connection *redisConnection) []string {
+	connections, err := connection.GetConnections()
+	c.Assert(err, IsNil)
+	return connections
+}
+
+// lockedBuffer is a bytes.Buffer which can be written to concurrently
+type lockedBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (buffer *lockedBuffer) Write(p []byte) (int, error) {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+	return buffer.buffer.Write(p)
+}
+
+func (buffer *lockedBuffer) String() string {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+	return buffer.buffer.String()
+}
+
+var errSetFailed = errors.New("set failed")
+
+// failingRedisClient is a RedisClient whose Set fails while failSet is 1
+type failingRedisClient struct {
+	RedisClient
+	failSet int32
+}
+
+func (client *failingRedisClient) Set(key string, value string, expiration time.Duration) error {
+	if atomic.LoadInt32(&client.failSet) == 1 {
+		return errSetFailed
+	}
+	return client.RedisClient.Set(key, value, expiration)
+}
@@ -0,0 +1,121 @@
+package rmq
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateLimiter hands out tokens for fetching deliveries, see SetRateLimit
+type rateLimiter interface {
+	// take takes up to count tokens and returns how many it took
+	take(count int) (int, error)
+	// giveBack returns tokens which were taken but not used
+	giveBack(count int) error
+}
+
+// tokenBucket holds up to capacity tokens and refills capacity tokens per
+// period, refilled up to the last update
+type tokenBucket struct {
+	capacity float64
+	period   float64 // milliseconds
+	tokens   float64
+	updated  float64 // unix milliseconds
+}
+
+// take refills the bucket up to now and takes up to count tokens from it, a
+// negative count gives back tokens. Returns the number of taken tokens
+func (bucket *tokenBucket) take(now float64, count int) int {
+	if now > bucket.updated {
+		bucket.tokens = math.Min(bucket.capacity, bucket.tokens+(now-bucket.updated)*bucket.capacity/bucket.period)
+		bucket.updated = now
+	}
+
+	taken := math.Min(math.Floor(bucket.tokens), float64(count))
+	bucket.tokens = math.Min(bucket.capacity, bucket.tokens-taken)
+	if taken < 0 {
+		return 0
+	}
+	return int(taken)
+}
+
+// String returns the state of the bucket as stored by takeTokensScript
+func (bucket *tokenBucket) String() string {
+	return strconv.FormatFloat(bucket.tokens, 'f', -1, 64) + " " + strconv.FormatFloat(bucket.updated, 'f', -1, 64)
+}
+
+// parseTokenBucket parses the state stored by takeTokensScript, returns a
+// full bucket updated at now if it can't be parsed
+func parseTokenBucket(state string, capacity, period, now float64) *tokenBucket {
+	bucket := &tokenBucket{capacity: capacity, period: period, tokens: capacity, updated: now}
+	fields := strings.Fields(state)
+	if len(fields) != 2 {
+		return bucket
+	}
+	tokens, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return bucket
+	}
+	updated, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return bucket
+	}
+	bucket.tokens = tokens
+	bucket.updated = updated
+	return bucket
+}
+
+// localRateLimiter is a token bucket used by a single queue consumer
+type localRateLimiter struct {
+	bucket tokenBucket
+}
+
+func newLocalRateLimiter(n int, per time.Duration) *localRateLimiter {
+	return &localRateLimiter{bucket: tokenBucket{
+		capacity: float64(n),
+		period:   float64(per) / float64(time.Millisecond),
+		tokens:   float64(n),
+		updated:  unixMilli(time.Now()),
+	}}
+}
+
+func (limiter *localRateLimiter) take(count int) (int, error) {
+	return limiter.bucket.take(unixMilli(time.Now()), count), nil
+}
+
+func (limiter *localRateLimiter) giveBack(count int) error {
+	limiter.bucket.take(unixMilli(time.Now()), -count)
+	return nil
+}
+
+// redisRateLimiter is a token bucket stored in Redis, shared by all consumers
+// of a queue
+type redisRateLimiter struct {
+	redisClient RedisClient
+	key         string
+	capacity    string
+	period      string // milliseconds
+}
+
+// newRedisRateLimiter rounds per up to whole milliseconds, the resolution of
+// the expiry takeTokensScript sets
+func newRedisRateLimiter(redisClient RedisClient, key string, n int, per time.Duration) *redisRateLimiter {
+	periodMillis := int64((per + time.Millisecond - 1) / time.Millisecond)
+	return &redisRateLimiter{
+		redisClient: redisClient,
+		key:         key,
+		capacity:    strconv.Itoa(n),
+		period:      strconv.FormatInt(periodMillis, 10),
+	}
+}
+
+func (limiter *redisRateLimiter) take(count int) (int, error) {
+	now := strconv.FormatFloat(unixMilli(time.Now()), 'f', -1, 64)
+	return limiter.redisClient.RunScript(takeTokensScript, []string{limiter.key}, limiter.capacity, limiter.period, now, strconv.Itoa(count))
+}
+
+func (limiter *redisRateLimiter) giveBack(count int) error {
+	_, err := limiter.take(-count)
+	return err
+}
@@ -1,25 +1,53 @@
 package rmq
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type RedisClient interface {
 	// simple keys
-	Set(key string, value string, expiration time.Duration) bool
-	Del(key string) (affected int, ok bool)      // default affected: 0
-	TTL(key string) (ttl time.Duration, ok bool) // default ttl: 0
+	Set(key string, value string, expiration time.Duration) error
+	Del(key string) (affected int, err error)
+	TTL(key string) (ttl time.Duration, err error)
 
 	// lists
-	LPush(key string, value ...string) bool
-	LLen(key string) (affected int, ok bool)
-	LRem(key string, count int, value string) (affected int, ok bool)
-	LTrim(key string, start, stop int)
-	RPopLPush(source, destination string) (value string, ok bool)
+	LPush(key string, value ...string) (total int, err error)
+	LLen(key string) (affected int, err error)
+	LRem(key string, count int, value string) (affected int, err error)
+	LTrim(key string, start, stop int) error
+	RPopLPush(source, destination string) (value string, err error)                         // ErrNotFound if source is empty
+	BRPopLPush(source, destination string, timeout time.Duration) (value string, err error) // ErrNotFound on timeout, zero timeout blocks forever
 
 	// sets
-	SAdd(key, value string) bool
-	SMembers(key string) (members []string)         // default members: []string{}
-	SRem(key, value string) (affected int, ok bool) // default affected: 0
+	SAdd(key, value string) (total int, err error)
+	SMembers(key string) (members []string, err error)
+	SRem(key, value string) (affected int, err error)
+
+	// sorted sets
+	ZAdd(key string, score float64, member string) (total int, err error)
+	ZCard(key string) (count int, err error)
+	ZRangeByScore(key string, min, max float64, count int) (members []string, err error) // ascending by score
+	ZRem(key, member string) (affected int, err error)
+
+	// scripts
+	RunScript(script *Script, keys []string, args ...string) (result int, err error)
 
 	// special
-	FlushDb()
+	FlushDb() error
+}
+
+// ContextRedisClient is implemented by RedisClients which can pass a context
+// on to all their calls, this is used by PublishContext, OpenQueueContext and
+// CollectStatsContext
+type ContextRedisClient interface {
+	WithContext(ctx context.Context) RedisClient
+}
+
+// withContext returns a RedisClient using ctx if redisClient supports it
+func withContext(ctx context.Context, redisClient RedisClient) RedisClient {
+	if contextClient, ok := redisClient.(ContextRedisClient); ok {
+		return contextClient.WithContext(ctx)
+	}
+	return redisClient
 }
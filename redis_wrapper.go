@@ -1,99 +1,138 @@
 package rmq
 
 import (
-	"log"
+	"context"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v7"
 )
 
+// RedisWrapper implements RedisClient for any go-redis client, like
+// redis.Client, redis.ClusterClient, redis.Ring or a client returned by
+// redis.NewFailoverClient or redis.NewUniversalClient
 type RedisWrapper struct {
-	rawClient *redis.Client
+	rawClient redis.Cmdable
 }
 
-func (wrapper RedisWrapper) Set(key string, value string, expiration time.Duration) bool {
-	return checkErr(wrapper.rawClient.Set(key, value, expiration).Err())
+// WithContext returns a RedisWrapper which passes ctx on to all calls
+// clients other than redis.Client, redis.ClusterClient and redis.Ring ignore ctx
+func (wrapper RedisWrapper) WithContext(ctx context.Context) RedisClient {
+	switch rawClient := wrapper.rawClient.(type) {
+	case *redis.Client:
+		return RedisWrapper{rawClient: rawClient.WithContext(ctx)}
+	case *redis.ClusterClient:
+		return RedisWrapper{rawClient: rawClient.WithContext(ctx)}
+	case *redis.Ring:
+		return RedisWrapper{rawClient: rawClient.WithContext(ctx)}
+	}
+	return wrapper
+}
+
+func (wrapper RedisWrapper) Set(key string, value string, expiration time.Duration) error {
+	return wrapper.rawClient.Set(key, value, expiration).Err()
 }
 
-func (wrapper RedisWrapper) Del(key string) (affected int, ok bool) {
+func (wrapper RedisWrapper) Del(key string) (affected int, err error) {
 	n, err := wrapper.rawClient.Del(key).Result()
-	ok = checkErr(err)
-	if !ok {
-		return 0, false
-	}
-	return int(n), ok
+	return int(n), err
 }
 
-func (wrapper RedisWrapper) TTL(key string) (ttl time.Duration, ok bool) {
-	ttl, err := wrapper.rawClient.TTL(key).Result()
-	ok = checkErr(err)
-	if !ok {
-		return 0, false
-	}
-	return ttl, ok
+func (wrapper RedisWrapper) TTL(key string) (ttl time.Duration, err error) {
+	return wrapper.rawClient.TTL(key).Result()
 }
 
-func (wrapper RedisWrapper) LPush(key string, value ...string) bool {
-	return checkErr(wrapper.rawClient.LPush(key, value).Err())
+func (wrapper RedisWrapper) LPush(key string, value ...string) (total int, err error) {
+	n, err := wrapper.rawClient.LPush(key, value).Result()
+	return int(n), err
 }
 
-func (wrapper RedisWrapper) LLen(key string) (affected int, ok bool) {
+func (wrapper RedisWrapper) LLen(key string) (affected int, err error) {
 	n, err := wrapper.rawClient.LLen(key).Result()
-	ok = checkErr(err)
-	if !ok {
-		return 0, false
-	}
-	return int(n), ok
+	return int(n), err
 }
 
-func (wrapper RedisWrapper) LRem(key string, count int, value string) (affected int, ok bool) {
+func (wrapper RedisWrapper) LRem(key string, count int, value string) (affected int, err error) {
 	n, err := wrapper.rawClient.LRem(key, int64(count), value).Result()
-	return int(n), checkErr(err)
+	return int(n), err
 }
 
-func (wrapper RedisWrapper) LTrim(key string, start, stop int) {
-	checkErr(wrapper.rawClient.LTrim(key, int64(start), int64(stop)).Err())
+func (wrapper RedisWrapper) LTrim(key string, start, stop int) error {
+	return wrapper.rawClient.LTrim(key, int64(start), int64(stop)).Err()
 }
 
-func (wrapper RedisWrapper) RPopLPush(source, destination string) (value string, ok bool) {
-	value, err := wrapper.rawClient.RPopLPush(source, destination).Result()
-	return value, checkErr(err)
+func (wrapper RedisWrapper) RPopLPush(source, destination string) (value string, err error) {
+	value, err = wrapper.rawClient.RPopLPush(source, destination).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return value, err
+}
+
+func (wrapper RedisWrapper) BRPopLPush(source, destination string, timeout time.Duration) (value string, err error) {
+	if timeout > 0 && timeout < time.Second {
+		timeout = time.Second // would get truncated to zero, which blocks forever
+	}
+	value, err = wrapper.rawClient.BRPopLPush(source, destination, timeout).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return value, err
 }
 
-func (wrapper RedisWrapper) SAdd(key, value string) bool {
-	return checkErr(wrapper.rawClient.SAdd(key, value).Err())
+func (wrapper RedisWrapper) SAdd(key, value string) (total int, err error) {
+	n, err := wrapper.rawClient.SAdd(key, value).Result()
+	return int(n), err
 }
 
-func (wrapper RedisWrapper) SMembers(key string) []string {
-	members, err := wrapper.rawClient.SMembers(key).Result()
-	if ok := checkErr(err); !ok {
-		return []string{}
-	}
-	return members
+func (wrapper RedisWrapper) SMembers(key string) (members []string, err error) {
+	return wrapper.rawClient.SMembers(key).Result()
 }
 
-func (wrapper RedisWrapper) SRem(key, value string) (affected int, ok bool) {
+func (wrapper RedisWrapper) SRem(key, value string) (affected int, err error) {
 	n, err := wrapper.rawClient.SRem(key, value).Result()
-	ok = checkErr(err)
-	if !ok {
-		return 0, false
-	}
-	return int(n), ok
+	return int(n), err
+}
+
+func (wrapper RedisWrapper) ZAdd(key string, score float64, member string) (total int, err error) {
+	n, err := wrapper.rawClient.ZAdd(key, &redis.Z{Score: score, Member: member}).Result()
+	return int(n), err
 }
 
-func (wrapper RedisWrapper) FlushDb() {
-	wrapper.rawClient.FlushDB()
+func (wrapper RedisWrapper) ZCard(key string) (count int, err error) {
+	n, err := wrapper.rawClient.ZCard(key).Result()
+	return int(n), err
 }
 
-// checkErr returns true if there is no error, false if the result error is nil and panics if there's another error
-func checkErr(err error) (ok bool) {
-	switch err {
-	case nil:
-		return true
-	case redis.Nil:
-		return false
-	default:
-		log.Panicf("rmq redis error is not nil %s", err)
-		return false
+func (wrapper RedisWrapper) ZRangeByScore(key string, min, max float64, count int) (members []string, err error) {
+	return wrapper.rawClient.ZRangeByScore(key, &redis.ZRangeBy{
+		Min:   strconv.FormatFloat(min, 'f', -1, 64),
+		Max:   strconv.FormatFloat(max, 'f', -1, 64),
+		Count: int64(count),
+	}).Result()
+}
+
+func (wrapper RedisWrapper) ZRem(key, member string) (affected int, err error) {
+	n, err := wrapper.rawClient.ZRem(key, member).Result()
+	return int(n), err
+}
+
+// RunScript runs the script with EVALSHA and falls back to EVAL (which also
+// caches the script) if Redis doesn't know it yet
+func (wrapper RedisWrapper) RunScript(script *Script, keys []string, args ...string) (result int, err error) {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg
+	}
+
+	n, err := wrapper.rawClient.EvalSha(script.Hash, keys, values...).Int64()
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		n, err = wrapper.rawClient.Eval(script.Source, keys, values...).Int64()
 	}
+	return int(n), err
+}
+
+func (wrapper RedisWrapper) FlushDb() error {
+	return wrapper.rawClient.FlushDB().Err()
 }
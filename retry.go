@@ -0,0 +1,47 @@
+package rmq
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy defines how deliveries of a queue get retried when consumers
+// call Delivery.Retry()
+type RetryPolicy struct {
+	MaxAttempts int           // number of attempts after which a delivery gets rejected instead of retried, 0 for unlimited
+	BaseBackoff time.Duration // delay before the first retry, doubled for each following one
+	MaxBackoff  time.Duration // upper limit for the delay, 0 for no limit
+	Jitter      float64       // fraction of the delay by which it gets randomly shortened or extended, between 0 and 1
+}
+
+// Backoff returns the delay before the given retry attempt (starting with 1)
+func (policy RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := policy.BaseBackoff
+	for i := 1; i < attempt; i++ {
+		if policy.MaxBackoff > 0 && backoff >= policy.MaxBackoff {
+			break
+		}
+		if backoff > math.MaxInt64/2 {
+			break // avoid overflow
+		}
+		backoff *= 2
+	}
+
+	if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+
+	if policy.Jitter > 0 {
+		jitter := float64(backoff) * policy.Jitter * (2*rand.Float64() - 1)
+		backoff += time.Duration(jitter)
+	}
+
+	return backoff
+}
+
+// exhausted returns true if a delivery shouldn't be retried anymore after
+// the given number of failed attempts
+func (policy RetryPolicy) exhausted(attempts int) bool {
+	return policy.MaxAttempts > 0 && attempts >= policy.MaxAttempts
+}
@@ -0,0 +1,101 @@
+package rmq
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+)
+
+func TestRetrySuite(t *testing.T) {
+	TestingSuiteT(&RetrySuite{}, t)
+}
+
+type RetrySuite struct{}
+
+func (suite *RetrySuite) TestBackoff(c *C) {
+	policy := RetryPolicy{BaseBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	c.Check(policy.Backoff(1), Equals, time.Second)
+	c.Check(policy.Backoff(2), Equals, 2*time.Second)
+	c.Check(policy.Backoff(3), Equals, 4*time.Second)
+	c.Check(policy.Backoff(4), Equals, 8*time.Second)
+	c.Check(policy.Backoff(5), Equals, 10*time.Second)
+	c.Check(policy.Backoff(1000), Equals, 10*time.Second)
+
+	policy.MaxBackoff = 0
+	c.Check(policy.Backoff(5), Equals, 16*time.Second)
+	c.Check(policy.Backoff(1000) > 0, Equals, true)
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(2)
+		c.Check(backoff >= time.Second, Equals, true)
+		c.Check(backoff <= 3*time.Second, Equals, true)
+	}
+}
+
+func (suite *RetrySuite) TestExhausted(c *C) {
+	c.Check(RetryPolicy{}.exhausted(1000), Equals, false)
+	c.Check(RetryPolicy{MaxAttempts: 3}.exhausted(2), Equals, false)
+	c.Check(RetryPolicy{MaxAttempts: 3}.exhausted(3), Equals, true)
+}
+
+func (suite *RetrySuite) TestRetry(c *C) {
+	connection := openConnection(c, "retry-conn")
+	queue := openQueue(c, connection, "retry-q")
+	c.Check(queue.Close(), IsNil)
+	queue = openQueue(c, connection, "retry-q")
+
+	consumer := NewTestConsumer("retry-cons")
+	consumer.AutoAck = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err := queue.AddConsumer("retry-cons", consumer)
+	c.Check(err, IsNil)
+
+	c.Check(queue.Publish("retry-d1"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 1)
+	c.Check(consumer.Last().Retry(), Equals, ErrNoRetryPolicy)
+	c.Check(consumer.Last().Ack(), IsNil)
+	<-queue.StopConsuming() // don't let the stopped queue fetch the next delivery
+
+	queue = openQueue(c, connection, "retry-q")
+	queue.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseBackoff: 20 * time.Millisecond})
+	consumer = NewTestConsumer("retry-cons")
+	consumer.AutoAck = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err = queue.AddConsumer("retry-cons", consumer)
+	c.Check(err, IsNil)
+
+	c.Check(queue.Publish("retry-d2"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 1)
+	c.Check(consumer.Last().Retry(), IsNil)
+	c.Check(unackedCount(c, queue), Equals, 0)
+	c.Check(delayedCount(c, queue), Equals, 1)
+
+	time.Sleep(40 * time.Millisecond) // first backoff is 20ms
+	c.Assert(consumer.Deliveries(), HasLen, 2)
+	c.Check(consumer.Last().Payload(), Equals, "retry-d2")
+	c.Check(consumer.Last().Retry(), IsNil)
+	c.Check(delayedCount(c, queue), Equals, 1)
+
+	time.Sleep(20 * time.Millisecond) // second backoff is 40ms
+	c.Check(consumer.Deliveries(), HasLen, 2)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 3)
+	c.Check(consumer.Last().Retry(), IsNil) // third attempt failed
+	c.Check(delayedCount(c, queue), Equals, 0)
+	c.Check(unackedCount(c, queue), Equals, 0)
+	c.Check(rejectedCount(c, queue), Equals, 1)
+
+	// attempts start over for new deliveries with the same payload
+	c.Check(queue.Publish("retry-d2"), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.Deliveries(), HasLen, 4)
+	c.Check(consumer.Last().Retry(), IsNil)
+	c.Check(delayedCount(c, queue), Equals, 1)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
@@ -0,0 +1,227 @@
+package rmq
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+// Script is a Lua script which Redis runs as a single atomic operation
+// RedisClient implementations which can't run Lua (like TestRedisClient)
+// can identify the scripts of this package by name and run their own
+// equivalent instead
+type Script struct {
+	Name   string
+	Source string
+	Hash   string // SHA1 of Source, used with EVALSHA
+}
+
+func newScript(name, source string) *Script {
+	hash := sha1.Sum([]byte(source))
+	return &Script{
+		Name:   name,
+		Source: source,
+		Hash:   hex.EncodeToString(hash[:]),
+	}
+}
+
+// readyKeyFunction is prepended to the scripts which put deliveries back to
+// the ready lists. ready_key returns the ready list of the priority stored in
+// the envelope value (ready itself for priority 0) and adds other priorities
+// to the set priorities, like PublishWithPriority does
+const readyKeyFunction = `
+local function ready_key(value, ready, priorities)
+	if string.sub(value, 1, 15) == 'rmq::envelope::' then
+		local priority = string.match(value, '"priority":(%-?%d+)')
+		if priority and priority ~= '0' then
+			redis.call('SADD', priorities, priority)
+			return ready .. '::priority::' .. priority
+		end
+	end
+	return ready
+end
+`
+
+var (
+	// moveScript removes ARGV[1] from the list KEYS[1] and pushes ARGV[2] to
+	// the list KEYS[2], returns 0 without pushing if ARGV[1] wasn't found
+	moveScript = newScript("move", `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('LPUSH', KEYS[2], ARGV[2])
+return 1
+`)
+
+	// delayScript removes ARGV[1] from the list KEYS[1] and adds ARGV[3] with
+	// score ARGV[2] to the sorted set KEYS[2], returns 0 without adding if
+	// ARGV[1] wasn't found
+	delayScript = newScript("delay", `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+return 1
+`)
+
+	// returnScript moves up to ARGV[1] elements from the tail of the list
+	// KEYS[1] to the head of their ready list (KEYS[2] or one of its priority
+	// lists, see readyKeyFunction with the priorities set KEYS[3]), returns the
+	// number of moved elements. Callers keep ARGV[1] small and call it again
+	// to move more
+	returnScript = newScript("return", readyKeyFunction+`
+local count = tonumber(ARGV[1])
+local moved = 0
+while moved < count do
+	local value = redis.call('RPOP', KEYS[1])
+	if not value then
+		break
+	end
+	redis.call('LPUSH', ready_key(value, KEYS[2], KEYS[3]), value)
+	moved = moved + 1
+end
+return moved
+`)
+
+	// moveDelayedScript moves up to ARGV[2] members of the sorted set KEYS[1]
+	// with a score up to ARGV[1] to the head of their ready list (KEYS[2] or
+	// one of its priority lists, see readyKeyFunction with the priorities set
+	// KEYS[3]) in ascending order of their scores, returns the number of moved
+	// members
+	moveDelayedScript = newScript("moveDelayed", readyKeyFunction+`
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, member in ipairs(members) do
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('LPUSH', ready_key(member, KEYS[2], KEYS[3]), member)
+end
+return #members
+`)
+
+	// lockScript sets the key KEYS[1] to ARGV[1] with a TTL of ARGV[2]
+	// milliseconds unless it's held by another value, returns 1 if it's held
+	// by ARGV[1] now
+	lockScript = newScript("lock", `
+local owner = redis.call('GET', KEYS[1])
+if owner and owner ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+	// unlockScript deletes the key KEYS[1] if it's held by ARGV[1], returns 1
+	// if it was deleted
+	unlockScript = newScript("unlock", `
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+	// publishUniqueScript sets the key KEYS[1] with a TTL of ARGV[1]
+	// milliseconds and pushes ARGV[2] to the list KEYS[2] unless KEYS[1]
+	// exists already, returns 0 without pushing if it did
+	publishUniqueScript = newScript("publishUnique", `
+if not redis.call('SET', KEYS[1], '1', 'NX', 'PX', ARGV[1]) then
+	return 0
+end
+redis.call('LPUSH', KEYS[2], ARGV[2])
+return 1
+`)
+
+	// returnLeasesScript moves the members of the sorted set KEYS[1] with a
+	// score up to ARGV[1] from the list KEYS[2] to their ready list (KEYS[3]
+	// or one of its priority lists, see readyKeyFunction with the priorities
+	// set KEYS[4]) and removes them from KEYS[1], returns the number of moved
+	// elements
+	returnLeasesScript = newScript("returnLeases", readyKeyFunction+`
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local returned = 0
+for _, member in ipairs(members) do
+	redis.call('ZREM', KEYS[1], member)
+	if redis.call('LREM', KEYS[2], 1, member) == 1 then
+		redis.call('LPUSH', ready_key(member, KEYS[3], KEYS[4]), member)
+		returned = returned + 1
+	end
+end
+return returned
+`)
+
+	// extendLeaseScript sets the score of the member ARGV[2] of the sorted set
+	// KEYS[1] to ARGV[1] if it's a member, returns 0 if it isn't
+	extendLeaseScript = newScript("extendLease", `
+if not redis.call('ZSCORE', KEYS[1], ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+	// takeTokensScript refills the token bucket stored as "tokens updated" at
+	// KEYS[1], which holds up to ARGV[1] tokens and refills ARGV[1] tokens per
+	// ARGV[2] milliseconds, up to the time ARGV[3] in unix milliseconds. Then
+	// it takes up to ARGV[4] tokens, a negative count gives back tokens.
+	// Returns the number of taken tokens
+	takeTokensScript = newScript("takeTokens", `
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local count = tonumber(ARGV[4])
+local tokens = capacity
+local updated = now
+local state = redis.call('GET', KEYS[1])
+if state then
+	local storedTokens, storedUpdated = string.match(state, '^(%S+) (%S+)$')
+	tokens = tonumber(storedTokens)
+	updated = tonumber(storedUpdated)
+	if now > updated then
+		tokens = math.min(capacity, tokens + (now - updated) * capacity / period)
+		updated = now
+	end
+end
+local taken = math.min(math.floor(tokens), count)
+tokens = math.min(capacity, tokens - taken)
+redis.call('SET', KEYS[1], tokens .. ' ' .. updated, 'PX', period)
+if taken < 0 then
+	return 0
+end
+return taken
+`)
+
+	// migrateListScript moves up to ARGV[1] elements from the head of the list
+	// KEYS[1] to the tail (the oldest end) of the list KEYS[2], so that the
+	// elements of KEYS[1] keep their order, returns the number of moved
+	// elements. Callers keep ARGV[1] small and call it again to move more
+	migrateListScript = newScript("migrateList", `
+local count = tonumber(ARGV[1])
+local moved = 0
+while moved < count do
+	local value = redis.call('LPOP', KEYS[1])
+	if not value then
+		break
+	end
+	redis.call('RPUSH', KEYS[2], value)
+	moved = moved + 1
+end
+return moved
+`)
+
+	// migrateScript moves KEYS[1] into KEYS[2] of the same type ARGV[1], which
+	// is set or zset, returns 0 if KEYS[1] didn't exist
+	migrateScript = newScript("migrate", `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local kind = ARGV[1]
+if kind == 'set' then
+	redis.call('SUNIONSTORE', KEYS[2], KEYS[1], KEYS[2])
+	redis.call('DEL', KEYS[1])
+elseif kind == 'zset' then
+	local members = redis.call('ZRANGE', KEYS[1], 0, -1, 'WITHSCORES')
+	for i = 1, #members, 2 do
+		redis.call('ZADD', KEYS[2], members[i + 1], members[i])
+	end
+	redis.call('DEL', KEYS[1])
+end
+return 1
+`)
+)
@@ -4,9 +4,9 @@ package rmq
 
 import "fmt"
 
-const _State_name = "UnackedAckedRejectedPushed"
+const _State_name = "UnackedAckedRejectedPushedRetried"
 
-var _State_index = [...]uint8{0, 7, 12, 20, 26}
+var _State_index = [...]uint8{0, 7, 12, 20, 26, 33}
 
 func (i State) String() string {
 	if i < 0 || i >= State(len(_State_index)-1) {
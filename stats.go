@@ -22,9 +22,13 @@ func (stat ConnectionStat) String() string {
 type ConnectionStats map[string]ConnectionStat
 
 type QueueStat struct {
-	ReadyCount      int `json:"ready"`
-	RejectedCount   int `json:"rejected"`
-	connectionStats ConnectionStats
+	ReadyCount           int         `json:"ready"`
+	ReadyCountByPriority map[int]int `json:"ready_by_priority,omitempty"` // nil unless the queue uses priorities other than 0
+	RejectedCount        int         `json:"rejected"`
+	DelayedCount         int         `json:"delayed"`
+	ExpiredCount         int         `json:"expired"`
+	Paused               bool        `json:"paused"`
+	connectionStats      ConnectionStats
 }
 
 func NewQueueStat(readyCount, rejectedCount int) QueueStat {
@@ -36,9 +40,12 @@ func NewQueueStat(readyCount, rejectedCount int) QueueStat {
 }
 
 func (stat QueueStat) String() string {
-	return fmt.Sprintf("[ready:%d rejected:%d conn:%s",
+	return fmt.Sprintf("[ready:%d rejected:%d delayed:%d expired:%d paused:%t conn:%s",
 		stat.ReadyCount,
 		stat.RejectedCount,
+		stat.DelayedCount,
+		stat.ExpiredCount,
+		stat.Paused,
 		stat.connectionStats,
 	)
 }
@@ -77,48 +84,100 @@ func NewStats() Stats {
 	}
 }
 
-func CollectStats(queueList []string, mainConnection *redisConnection) Stats {
+func CollectStats(queueList []string, mainConnection *redisConnection) (Stats, error) {
 	stats := NewStats()
 	for _, queueName := range queueList {
 		queue := mainConnection.openQueue(queueName)
-		stats.QueueStats[queueName] = NewQueueStat(queue.ReadyCount(), queue.RejectedCount())
+		readyCounts, err := queue.ReadyCountByPriority()
+		if err != nil {
+			return stats, err
+		}
+		readyCount := 0
+		for _, count := range readyCounts {
+			readyCount += count
+		}
+		rejectedCount, err := queue.RejectedCount()
+		if err != nil {
+			return stats, err
+		}
+		delayedCount, err := queue.DelayedCount()
+		if err != nil {
+			return stats, err
+		}
+		expiredCount, err := queue.ExpiredCount()
+		if err != nil {
+			return stats, err
+		}
+		paused, err := queue.Paused()
+		if err != nil {
+			return stats, err
+		}
+		queueStat := NewQueueStat(readyCount, rejectedCount)
+		queueStat.DelayedCount = delayedCount
+		queueStat.ExpiredCount = expiredCount
+		queueStat.Paused = paused
+		if len(readyCounts) > 1 {
+			queueStat.ReadyCountByPriority = readyCounts
+		}
+		stats.QueueStats[queueName] = queueStat
 	}
 
-	connectionNames := mainConnection.GetConnections()
+	connectionNames, err := mainConnection.GetConnections()
+	if err != nil {
+		return stats, err
+	}
 	for _, connectionName := range connectionNames {
 		connection := mainConnection.hijackConnection(connectionName)
-		connectionActive := connection.Check()
+		var connectionActive bool
+		switch err := connection.Check(); err {
+		case nil:
+			connectionActive = true
+		case ErrNotFound:
+			connectionActive = false
+		default:
+			return stats, err
+		}
 
-		queueNames := connection.GetConsumingQueues()
+		queueNames, err := connection.GetConsumingQueues()
+		if err != nil {
+			return stats, err
+		}
 		if len(queueNames) == 0 {
 			stats.otherConnections[connectionName] = connectionActive
 			continue
 		}
 
 		for _, queueName := range queueNames {
-			queue := connection.openQueue(queueName)
-			consumers := queue.GetConsumers()
 			openQueueStat, ok := stats.QueueStats[queueName]
 			if !ok {
 				continue
 			}
+			queue := connection.openQueue(queueName)
+			consumers, err := queue.GetConsumers()
+			if err != nil {
+				return stats, err
+			}
+			unackedCount, err := queue.UnackedCount()
+			if err != nil {
+				return stats, err
+			}
 			openQueueStat.connectionStats[connectionName] = ConnectionStat{
 				active:       connectionActive,
-				unackedCount: queue.UnackedCount(),
+				unackedCount: unackedCount,
 				consumers:    consumers,
 			}
 		}
 	}
 
-	return stats
+	return stats, nil
 }
 
 func (stats Stats) String() string {
 	var buffer bytes.Buffer
 
 	for queueName, queueStat := range stats.QueueStats {
-		buffer.WriteString(fmt.Sprintf("    queue:%s ready:%d rejected:%d unacked:%d consumers:%d\n",
-			queueName, queueStat.ReadyCount, queueStat.RejectedCount, queueStat.UnackedCount(), queueStat.ConsumerCount(),
+		buffer.WriteString(fmt.Sprintf("    queue:%s ready:%d rejected:%d delayed:%d expired:%d paused:%t unacked:%d consumers:%d\n",
+			queueName, queueStat.ReadyCount, queueStat.RejectedCount, queueStat.DelayedCount, queueStat.ExpiredCount, queueStat.Paused, queueStat.UnackedCount(), queueStat.ConsumerCount(),
 		))
 
 		for connectionName, connectionStat := range queueStat.connectionStats {
@@ -149,6 +208,9 @@ func (stats Stats) GetHtml(layout, refresh string) string {
 		`queue</td><td></td><td>` +
 		`ready</td><td></td><td>` +
 		`rejected</td><td></td><td>` +
+		`delayed</td><td></td><td>` +
+		`expired</td><td></td><td>` +
+		`paused</td><td></td><td>` +
 		`</td><td></td><td>` +
 		`connections</td><td></td><td>` +
 		`unacked</td><td></td><td>` +
@@ -162,11 +224,14 @@ func (stats Stats) GetHtml(layout, refresh string) string {
 			`%s</td><td></td><td>`+
 			`%d</td><td></td><td>`+
 			`%d</td><td></td><td>`+
+			`%d</td><td></td><td>`+
+			`%d</td><td></td><td>`+
+			`%s</td><td></td><td>`+
 			`%s</td><td></td><td>`+
 			`%d</td><td></td><td>`+
 			`%d</td><td></td><td>`+
 			`%d</td><td></td></tr>`,
-			queueName, queueStat.ReadyCount, queueStat.RejectedCount, "", len(connectionNames), queueStat.UnackedCount(), queueStat.ConsumerCount(),
+			queueName, queueStat.ReadyCount, queueStat.RejectedCount, queueStat.DelayedCount, queueStat.ExpiredCount, PausedSign(queueStat.Paused), "", len(connectionNames), queueStat.UnackedCount(), queueStat.ConsumerCount(),
 		))
 
 		if layout != "condensed" {
@@ -178,9 +243,12 @@ func (stats Stats) GetHtml(layout, refresh string) string {
 					`%s</td><td></td><td>`+
 					`%s</td><td></td><td>`+
 					`%s</td><td></td><td>`+
+					`%s</td><td></td><td>`+
+					`%s</td><td></td><td>`+
+					`%s</td><td></td><td>`+
 					`%d</td><td></td><td>`+
 					`%d</td><td></td></tr>`,
-					"", "", "", ActiveSign(connectionStat.active), connectionName, connectionStat.unackedCount, len(connectionStat.consumers),
+					"", "", "", "", "", "", ActiveSign(connectionStat.active), connectionName, connectionStat.unackedCount, len(connectionStat.consumers),
 				))
 			}
 		}
@@ -197,8 +265,11 @@ func (stats Stats) GetHtml(layout, refresh string) string {
 				`%s</td><td></td><td>`+
 				`%s</td><td></td><td>`+
 				`%s</td><td></td><td>`+
+				`%s</td><td></td><td>`+
+				`%s</td><td></td><td>`+
+				`%s</td><td></td><td>`+
 				`%s</td><td></td></tr>`,
-				"", "", "", ActiveSign(active), connectionName, "", "",
+				"", "", "", "", "", "", ActiveSign(active), connectionName, "", "",
 			))
 		}
 	}
@@ -234,6 +305,14 @@ func (stats Stats) sortedConnectionNames() []string {
 	return keys
 }
 
+// PausedSign marks paused queues in the html overview
+func PausedSign(paused bool) string {
+	if paused {
+		return "⏸"
+	}
+	return ""
+}
+
 func ActiveSign(active bool) string {
 	if active {
 		return "✓"
@@ -14,15 +14,19 @@ func TestStatsSuite(t *testing.T) {
 type StatsSuite struct{}
 
 func (suite *StatsSuite) TestStats(c *C) {
-	connection := OpenConnection("stats-conn", "tcp", "localhost:6379", 1)
-	c.Assert(NewCleaner(connection).Clean(), IsNil)
+	connection := openConnection(c, "stats-conn")
+	_, err := NewCleaner(connection).Clean()
+	c.Assert(err, IsNil)
 
-	conn1 := OpenConnection("stats-conn1", "tcp", "localhost:6379", 1)
-	conn2 := OpenConnection("stats-conn2", "tcp", "localhost:6379", 1)
-	q1 := conn2.OpenQueue("stats-q1").(*redisQueue)
-	q1.PurgeReady()
+	conn1 := openConnection(c, "stats-conn1")
+	conn2 := openConnection(c, "stats-conn2")
+	q1 := openQueue(c, conn2, "stats-q1")
+	q1.Close()
+	q1 = openQueue(c, conn2, "stats-q1")
 	q1.Publish("stats-d1")
-	q2 := conn2.OpenQueue("stats-q2").(*redisQueue)
+	q1.PublishDelayed("stats-d5", time.Hour)
+	c.Check(q1.Pause(), IsNil)
+	q2 := openQueue(c, conn2, "stats-q2")
 	q2.PurgeReady()
 	consumer := NewTestConsumer("hand-A")
 	consumer.AutoAck = false
@@ -32,21 +36,28 @@ func (suite *StatsSuite) TestStats(c *C) {
 	q2.Publish("stats-d3")
 	q2.Publish("stats-d4")
 	time.Sleep(2 * time.Millisecond)
-	consumer.LastDeliveries[0].Ack()
-	consumer.LastDeliveries[1].Reject()
+	consumer.Deliveries()[0].Ack()
+	consumer.Deliveries()[1].Reject()
 	q2.AddConsumer("stats-cons2", NewTestConsumer("hand-B"))
 
-	stats := CollectStats(connection.GetOpenQueues(), connection)
+	stats, err := CollectStats(openQueues(c, connection), connection)
+	c.Assert(err, IsNil)
 	// log.Printf("stats\n%s", stats)
 	html := stats.GetHtml("", "")
 	c.Check(html, Matches, ".*queue.*ready.*connection.*unacked.*consumers.*q1.*1.*0.*0.*")
 	c.Check(html, Matches, ".*queue.*ready.*connection.*unacked.*consumers.*q2.*0.*1.*1.*2.*conn2.*1.*2.*")
+	c.Check(html, Matches, ".*paused.*stats-q1.*⏸.*stats-q2.*")
 
-	stats = CollectStats([]string{"stats-q1", "stats-q2"}, connection)
+	stats, err = CollectStats([]string{"stats-q1", "stats-q2"}, connection)
+	c.Assert(err, IsNil)
 
 	for key, _ := range stats.QueueStats {
 		c.Check(key, Matches, "stats.*")
 	}
+	c.Check(stats.QueueStats["stats-q1"].DelayedCount, Equals, 1)
+	c.Check(stats.QueueStats["stats-q2"].DelayedCount, Equals, 0)
+	c.Check(stats.QueueStats["stats-q1"].Paused, Equals, true)
+	c.Check(stats.QueueStats["stats-q2"].Paused, Equals, false)
 	/*
 		<html><body><table style="font-family:monospace">
 		<tr><td>queue</td><td></td><td>ready</td><td></td><td>rejected</td><td></td><td style="color:lightgrey">connection</td><td></td><td>unacked</td><td></td><td>consumers</td><td></td></tr>
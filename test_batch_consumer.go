@@ -1,7 +1,12 @@
 package rmq
 
+import "sync"
+
 type TestBatchConsumer struct {
-	LastBatch     Deliveries
+	mu sync.Mutex // guards LastBatch and ConsumedCount
+	// Deprecated: use Last(), reading it while consuming is a data race
+	LastBatch Deliveries
+	// Deprecated: use Consumed(), reading it while consuming is a data race
 	ConsumedCount int
 	AutoFinish    bool
 
@@ -15,17 +20,33 @@ func NewTestBatchConsumer() *TestBatchConsumer {
 }
 
 func (consumer *TestBatchConsumer) Consume(batch Deliveries) {
-	// log.Printf("TestBatchConsumer.Consume(%d)", len(batch))
+	consumer.mu.Lock()
 	consumer.LastBatch = batch
 	consumer.ConsumedCount += len(batch)
+	consumer.mu.Unlock()
 	if !consumer.AutoFinish {
 		<-consumer.finish
-		// log.Printf("TestBatchConsumer.Consume() finished")
 	}
 }
 
+// Last returns the batch consumed last, nil if none was consumed yet or it
+// was finished
+func (consumer *TestBatchConsumer) Last() Deliveries {
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+	return consumer.LastBatch
+}
+
+// Consumed returns the number of consumed deliveries of all batches
+func (consumer *TestBatchConsumer) Consumed() int {
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+	return consumer.ConsumedCount
+}
+
 func (consumer *TestBatchConsumer) Finish() {
-	// log.Printf("TestBatchConsumer.Finish()")
+	consumer.mu.Lock()
 	consumer.LastBatch = nil
+	consumer.mu.Unlock()
 	consumer.finish <- 1
 }
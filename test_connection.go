@@ -1,6 +1,7 @@
 package rmq
 
 import (
+	"context"
 	"fmt"
 	"sync"
 )
@@ -15,13 +16,56 @@ func NewTestConnection() TestConnection {
 	}
 }
 
-func (connection TestConnection) OpenQueue(name string) Queue {
+func (connection TestConnection) OpenQueue(name string) (Queue, error) {
 	queue, _ := connection.queues.LoadOrStore(name, NewTestQueue(name))
-	return queue.(*TestQueue)
+	return queue.(*TestQueue), nil
 }
 
-func (connection TestConnection) CollectStats(queueList []string) Stats {
-	return Stats{}
+func (connection TestConnection) OpenQueueContext(ctx context.Context, name string) (Queue, error) {
+	return connection.OpenQueue(name)
+}
+
+func (connection TestConnection) StopAllConsuming() <-chan struct{} {
+	finishedChan := make(chan struct{})
+	close(finishedChan)
+	return finishedChan
+}
+
+func (connection TestConnection) ConsumeMany(queues []Queue, weights []int, prefetchLimit int) (MultiQueue, error) {
+	return testMultiQueue{}, nil
+}
+
+// testMultiQueue is the MultiQueue of TestConnection, it doesn't consume
+type testMultiQueue struct{}
+
+func (testMultiQueue) AddConsumer(tag string, consumer Consumer) (string, error) {
+	return "", nil
+}
+
+func (testMultiQueue) AddConsumerFunc(tag string, consumerFunc ConsumerFunc) (string, error) {
+	return "", nil
+}
+
+func (testMultiQueue) AddConsumerWithContext(tag string, consumer ConsumerWithContext) (string, error) {
+	return "", nil
+}
+
+func (testMultiQueue) StopConsuming() <-chan struct{} {
+	finishedChan := make(chan struct{})
+	close(finishedChan)
+	return finishedChan
+}
+
+func (connection TestConnection) HeartbeatErrors() <-chan error {
+	return nil
+}
+
+func (connection TestConnection) CollectStats(queueList []string) (Stats, error) {
+	return Stats{}, nil
+}
+
+func (connection TestConnection) CollectStatsContext(ctx context.Context, queueList []string) (Stats, error) {
+	return Stats{}, nil
 }
 
 func (connection TestConnection) GetDeliveries(queueName string) []string {
@@ -49,6 +93,6 @@ func (connection TestConnection) Reset() {
 	})
 }
 
-func (connection TestConnection) GetOpenQueues() []string {
-	return []string{}
+func (connection TestConnection) GetOpenQueues() ([]string, error) {
+	return []string{}, nil
 }
@@ -18,17 +18,18 @@ func (suite *ConnectionSuite) TestConnection(c *C) {
 	c.Check(connection, Implements, &conn)
 	c.Check(connection.GetDelivery("things", 0), Equals, "rmq.TestConnection: delivery not found: things[0]")
 
-	queue := connection.OpenQueue("things")
+	queue, err := connection.OpenQueue("things")
+	c.Check(err, IsNil)
 	c.Check(connection.GetDelivery("things", -1), Equals, "rmq.TestConnection: delivery not found: things[-1]")
 	c.Check(connection.GetDelivery("things", 0), Equals, "rmq.TestConnection: delivery not found: things[0]")
 	c.Check(connection.GetDelivery("things", 1), Equals, "rmq.TestConnection: delivery not found: things[1]")
 
-	c.Check(queue.Publish("bar"), Equals, true)
+	c.Check(queue.Publish("bar"), IsNil)
 	c.Check(connection.GetDelivery("things", 0), Equals, "bar")
 	c.Check(connection.GetDelivery("things", 1), Equals, "rmq.TestConnection: delivery not found: things[1]")
 	c.Check(connection.GetDelivery("things", 2), Equals, "rmq.TestConnection: delivery not found: things[2]")
 
-	c.Check(queue.Publish("foo"), Equals, true)
+	c.Check(queue.Publish("foo"), IsNil)
 	c.Check(connection.GetDelivery("things", 0), Equals, "bar")
 	c.Check(connection.GetDelivery("things", 1), Equals, "foo")
 	c.Check(connection.GetDelivery("things", 2), Equals, "rmq.TestConnection: delivery not found: things[2]")
@@ -36,7 +37,7 @@ func (suite *ConnectionSuite) TestConnection(c *C) {
 	connection.Reset()
 	c.Check(connection.GetDelivery("things", 0), Equals, "rmq.TestConnection: delivery not found: things[0]")
 
-	c.Check(queue.Publish("blab"), Equals, true)
+	c.Check(queue.Publish("blab"), IsNil)
 	c.Check(connection.GetDelivery("things", 0), Equals, "blab")
 	c.Check(connection.GetDelivery("things", 1), Equals, "rmq.TestConnection: delivery not found: things[1]")
 }
@@ -1,10 +1,19 @@
 package rmq
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 type TestDelivery struct {
-	State   State
-	payload string
+	State          State
+	RejectReason   string        // reason passed to RejectWithReason()
+	LeaseExtension time.Duration // last duration passed to ExtendLease()
+	QueueName      string        // returned by Queue()
+	id             string
+	payload        string
+	headers        map[string]string
+	publishedAt    time.Time
 }
 
 func NewTestDelivery(content interface{}) *TestDelivery {
@@ -21,35 +30,80 @@ func NewTestDelivery(content interface{}) *TestDelivery {
 }
 
 func NewTestDeliveryString(payload string) *TestDelivery {
+	return NewTestDeliveryWithHeaders(payload, nil)
+}
+
+func NewTestDeliveryWithHeaders(payload string, headers map[string]string) *TestDelivery {
+	envelope := newEnvelope(payload, headers)
 	return &TestDelivery{
-		payload: payload,
+		id:          envelope.ID,
+		payload:     envelope.Payload,
+		headers:     envelope.Headers,
+		publishedAt: envelope.PublishedAt,
 	}
 }
 
+func (delivery *TestDelivery) ID() string {
+	return delivery.id
+}
+
 func (delivery *TestDelivery) Payload() string {
 	return delivery.payload
 }
 
-func (delivery *TestDelivery) Ack() bool {
-	if delivery.State == Unacked {
-		delivery.State = Acked
-		return true
+func (delivery *TestDelivery) Headers() map[string]string {
+	return delivery.headers
+}
+
+func (delivery *TestDelivery) PublishedAt() time.Time {
+	return delivery.publishedAt
+}
+
+func (delivery *TestDelivery) Queue() string {
+	return delivery.QueueName
+}
+
+func (delivery *TestDelivery) Ack() error {
+	if delivery.State != Unacked {
+		return ErrNotFound
+	}
+	delivery.State = Acked
+	return nil
+}
+
+func (delivery *TestDelivery) Reject() error {
+	return delivery.RejectWithReason("")
+}
+
+func (delivery *TestDelivery) RejectWithReason(reason string) error {
+	if delivery.State != Unacked {
+		return ErrNotFound
+	}
+	delivery.State = Rejected
+	delivery.RejectReason = reason
+	return nil
+}
+
+func (delivery *TestDelivery) Push() error {
+	if delivery.State != Unacked {
+		return ErrNotFound
 	}
-	return false
+	delivery.State = Pushed
+	return nil
 }
 
-func (delivery *TestDelivery) Reject() bool {
-	if delivery.State == Unacked {
-		delivery.State = Rejected
-		return true
+func (delivery *TestDelivery) Retry() error {
+	if delivery.State != Unacked {
+		return ErrNotFound
 	}
-	return false
+	delivery.State = Retried
+	return nil
 }
 
-func (delivery *TestDelivery) Push() bool {
-	if delivery.State == Unacked {
-		delivery.State = Pushed
-		return true
+func (delivery *TestDelivery) ExtendLease(duration time.Duration) error {
+	if delivery.State != Unacked {
+		return ErrNotFound
 	}
-	return false
+	delivery.LeaseExtension = duration
+	return nil
 }
@@ -16,28 +16,48 @@ type DeliverySuite struct {
 func (suite *DeliverySuite) TestDeliveryPayload(c *C) {
 	var delivery Delivery
 	delivery = NewTestDelivery("p23")
-	c.Check(delivery.Ack(), Equals, true)
+	c.Check(delivery.Ack(), IsNil)
 	c.Check(delivery.Payload(), Equals, "p23")
 }
 
 func (suite *DeliverySuite) TestDeliveryAck(c *C) {
 	delivery := NewTestDelivery("p")
 	c.Check(delivery.State, Equals, Unacked)
-	c.Check(delivery.Ack(), Equals, true)
+	c.Check(delivery.Ack(), IsNil)
 	c.Check(delivery.State, Equals, Acked)
 
-	c.Check(delivery.Ack(), Equals, false)
-	c.Check(delivery.Reject(), Equals, false)
+	c.Check(delivery.Ack(), Equals, ErrNotFound)
+	c.Check(delivery.Reject(), Equals, ErrNotFound)
 	c.Check(delivery.State, Equals, Acked)
 }
 
 func (suite *DeliverySuite) TestDeliveryReject(c *C) {
 	delivery := NewTestDelivery("p")
 	c.Check(delivery.State, Equals, Unacked)
-	c.Check(delivery.Reject(), Equals, true)
+	c.Check(delivery.Reject(), IsNil)
 	c.Check(delivery.State, Equals, Rejected)
 
-	c.Check(delivery.Reject(), Equals, false)
-	c.Check(delivery.Ack(), Equals, false)
+	c.Check(delivery.Reject(), Equals, ErrNotFound)
+	c.Check(delivery.Ack(), Equals, ErrNotFound)
 	c.Check(delivery.State, Equals, Rejected)
 }
+
+func (suite *DeliverySuite) TestDeliveryRejectWithReason(c *C) {
+	delivery := NewTestDelivery("p")
+	c.Check(delivery.RejectWithReason("invalid"), IsNil)
+	c.Check(delivery.State, Equals, Rejected)
+	c.Check(delivery.RejectReason, Equals, "invalid")
+	c.Check(delivery.RejectWithReason("again"), Equals, ErrNotFound)
+	c.Check(delivery.RejectReason, Equals, "invalid")
+}
+
+func (suite *DeliverySuite) TestDeliveryRetry(c *C) {
+	delivery := NewTestDelivery("p")
+	c.Check(delivery.State, Equals, Unacked)
+	c.Check(delivery.Retry(), IsNil)
+	c.Check(delivery.State, Equals, Retried)
+
+	c.Check(delivery.Retry(), Equals, ErrNotFound)
+	c.Check(delivery.Ack(), Equals, ErrNotFound)
+	c.Check(delivery.State, Equals, Retried)
+}
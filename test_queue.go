@@ -1,6 +1,9 @@
 package rmq
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type TestQueue struct {
 	name           string
@@ -17,12 +20,22 @@ func (queue *TestQueue) String() string {
 	return queue.name
 }
 
-func (queue *TestQueue) Publish(payload ...string) bool {
+func (queue *TestQueue) Publish(payload ...string) error {
 	queue.LastDeliveries = append(queue.LastDeliveries, payload...)
-	return true
+	return nil
+}
+
+// PublishWithHeaders records the deliveries in LastDeliveries, the headers are ignored
+func (queue *TestQueue) PublishWithHeaders(headers map[string]string, payload ...string) error {
+	return queue.Publish(payload...)
+}
+
+// PublishContext records the deliveries in LastDeliveries, the context is ignored
+func (queue *TestQueue) PublishContext(ctx context.Context, payload ...string) error {
+	return queue.Publish(payload...)
 }
 
-func (queue *TestQueue) PublishBytes(payload ...[]byte) bool {
+func (queue *TestQueue) PublishBytes(payload ...[]byte) error {
 	stringifiedBytes := make([]string, len(payload))
 	for i, b := range payload {
 		stringifiedBytes[i] = string(b)
@@ -30,51 +43,144 @@ func (queue *TestQueue) PublishBytes(payload ...[]byte) bool {
 	return queue.Publish(stringifiedBytes...)
 }
 
+// PublishDelayed records the delivery in LastDeliveries, the delay is ignored
+func (queue *TestQueue) PublishDelayed(payload string, delay time.Duration) error {
+	return queue.Publish(payload)
+}
+
+// PublishAt records the delivery in LastDeliveries, the due time is ignored
+func (queue *TestQueue) PublishAt(payload string, dueTime time.Time) error {
+	return queue.Publish(payload)
+}
+
+// PublishWithPriority records the deliveries in LastDeliveries, the priority is ignored
+func (queue *TestQueue) PublishWithPriority(priority int, payload ...string) error {
+	return queue.Publish(payload...)
+}
+
+// PublishUnique records the delivery in LastDeliveries, the key and window are ignored
+func (queue *TestQueue) PublishUnique(key string, payload string, window time.Duration) error {
+	return queue.Publish(payload)
+}
+
+// PublishWithTTL records the deliveries in LastDeliveries, the TTL is ignored
+func (queue *TestQueue) PublishWithTTL(ttl time.Duration, payload ...string) error {
+	return queue.Publish(payload...)
+}
+
 func (queue *TestQueue) SetPushQueue(pushQueue Queue) {
 }
 
-func (queue *TestQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) bool {
-	return true
+func (queue *TestQueue) SetDeadLetterQueue(deadLetterQueue Queue, maxRejections int) {
+}
+
+func (queue *TestQueue) SetRetryPolicy(policy RetryPolicy) {
+}
+
+func (queue *TestQueue) SetBlockingFetch(blockTimeout time.Duration) {
+}
+
+func (queue *TestQueue) SetConsumeTimeout(timeout time.Duration) {
+}
+
+func (queue *TestQueue) SetStarvationLimit(batches int) {
+}
+
+func (queue *TestQueue) SetLeaseDuration(duration time.Duration) {
+}
+
+func (queue *TestQueue) SetPanicPolicy(policy PanicPolicy) {
+}
+
+func (queue *TestQueue) OnConsumerPanic(handler PanicHandler) {
+}
+
+func (queue *TestQueue) Use(middlewares ...Middleware) {
+}
+
+func (queue *TestQueue) UseBatch(middlewares ...BatchMiddleware) {
+}
+
+func (queue *TestQueue) SetRateLimit(n int, per time.Duration) {
+}
+
+func (queue *TestQueue) SetSharedRateLimit(n int, per time.Duration) {
+}
+
+func (queue *TestQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) error {
+	return nil
 }
 
 func (queue *TestQueue) StopConsuming() <-chan struct{} {
 	return nil
 }
 
-func (queue *TestQueue) AddConsumer(tag string, consumer Consumer) string {
-	return ""
+func (queue *TestQueue) StopConsumingWithTimeout(ctx context.Context, returnPrefetched bool) (StopResult, error) {
+	return StopResult{}, nil
+}
+
+func (queue *TestQueue) AddConsumer(tag string, consumer Consumer) (string, error) {
+	return "", nil
 }
 
-func (queue *TestQueue) AddConsumerFunc(tag string, consumerFunc ConsumerFunc) string {
-	return ""
+func (queue *TestQueue) AddConsumerFunc(tag string, consumerFunc ConsumerFunc) (string, error) {
+	return "", nil
 }
 
-func (queue *TestQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string {
-	return ""
+func (queue *TestQueue) AddConsumerWithContext(tag string, consumer ConsumerWithContext) (string, error) {
+	return "", nil
 }
 
-func (queue *TestQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string {
-	return ""
+func (queue *TestQueue) AddContextConsumerFunc(tag string, consumerFunc ContextConsumerFunc) (string, error) {
+	return "", nil
 }
 
-func (queue *TestQueue) ReturnRejected(count int) int {
-	return 0
+func (queue *TestQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) (string, error) {
+	return "", nil
 }
 
-func (queue *TestQueue) ReturnAllRejected() int {
-	return 0
+func (queue *TestQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) (string, error) {
+	return "", nil
 }
 
-func (queue *TestQueue) PurgeReady() int {
-	return 0
+func (queue *TestQueue) AddBatchConsumerWithContext(tag string, batchSize int, timeout time.Duration, consumer BatchConsumerWithContext) (string, error) {
+	return "", nil
 }
 
-func (queue *TestQueue) PurgeRejected() int {
-	return 0
+func (queue *TestQueue) ReturnRejected(count int) (int, error) {
+	return 0, nil
 }
 
-func (queue *TestQueue) Close() bool {
-	return false
+func (queue *TestQueue) ReturnAllRejected() (int, error) {
+	return 0, nil
+}
+
+func (queue *TestQueue) PurgeReady() (int, error) {
+	return 0, nil
+}
+
+func (queue *TestQueue) PurgeRejected() (int, error) {
+	return 0, nil
+}
+
+func (queue *TestQueue) PurgeExpired() (int, error) {
+	return 0, nil
+}
+
+func (queue *TestQueue) Pause() error {
+	return nil
+}
+
+func (queue *TestQueue) Resume() error {
+	return nil
+}
+
+func (queue *TestQueue) Paused() (bool, error) {
+	return false, nil
+}
+
+func (queue *TestQueue) Close() error {
+	return nil
 }
 
 func (queue *TestQueue) Reset() {
@@ -2,12 +2,16 @@ package rmq
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-//TestRedisClient is a mock for redis
+// TestRedisClient is a mock for redis
 type TestRedisClient struct {
 	store sync.Map
 	ttl   sync.Map
@@ -15,7 +19,7 @@ type TestRedisClient struct {
 
 var lock sync.Mutex
 
-//NewTestRedisClient returns a NewTestRedisClient
+// NewTestRedisClient returns a NewTestRedisClient
 func NewTestRedisClient() *TestRedisClient {
 	return &TestRedisClient{}
 }
@@ -23,7 +27,7 @@ func NewTestRedisClient() *TestRedisClient {
 // Set sets key to hold the string value.
 // If key already holds a value, it is overwritten, regardless of its type.
 // Any previous time to live associated with the key is discarded on successful SET operation.
-func (client *TestRedisClient) Set(key string, value string, expiration time.Duration) bool {
+func (client *TestRedisClient) Set(key string, value string, expiration time.Duration) error {
 
 	lock.Lock()
 	defer lock.Unlock()
@@ -38,7 +42,7 @@ func (client *TestRedisClient) Set(key string, value string, expiration time.Dur
 		client.ttl.Store(key, time.Now().Add(expiration).Unix())
 	}
 
-	return true
+	return nil
 }
 
 // Get the value of key.
@@ -57,17 +61,17 @@ func (client *TestRedisClient) Get(key string) string {
 	return "nil"
 }
 
-//Del removes the specified key. A key is ignored if it does not exist.
-func (client *TestRedisClient) Del(key string) (affected int, ok bool) {
+// Del removes the specified key. A key is ignored if it does not exist.
+func (client *TestRedisClient) Del(key string) (affected int, err error) {
 
 	_, found := client.store.Load(key)
 	client.store.Delete(key)
 	client.ttl.Delete(key)
 
 	if found {
-		return 1, true
+		return 1, nil
 	}
-	return 0, false
+	return 0, nil
 
 }
 
@@ -77,7 +81,7 @@ func (client *TestRedisClient) Del(key string) (affected int, ok bool) {
 // Starting with Redis 2.8 the return value in case of error changed:
 // The command returns -2 if the key does not exist.
 // The command returns -1 if the key exists but has no associated expire.
-func (client *TestRedisClient) TTL(key string) (ttl time.Duration, ok bool) {
+func (client *TestRedisClient) TTL(key string) (ttl time.Duration, err error) {
 
 	//Lookup the expiration map
 	expiration, found := client.ttl.Load(key)
@@ -88,11 +92,11 @@ func (client *TestRedisClient) TTL(key string) (ttl time.Duration, ok bool) {
 		//It was there, but it expired; removing it now
 		if expiration.(int64) < time.Now().Unix() {
 			client.ttl.Delete(key)
-			return -2, false
+			return -2, nil
 		}
 
 		ttl = time.Duration(expiration.(int64) - time.Now().Unix())
-		return ttl, true
+		return ttl, nil
 	}
 
 	//Lookup the store in case this key exists but don't have an expiration
@@ -102,10 +106,10 @@ func (client *TestRedisClient) TTL(key string) (ttl time.Duration, ok bool) {
 	//The key was in store but didn't have an expiration associated
 	//to it.
 	if found {
-		return -1, false
+		return -1, nil
 	}
 
-	return -2, false
+	return -2, nil
 }
 
 // LPush inserts the specified value at the head of the list stored at key.
@@ -114,7 +118,7 @@ func (client *TestRedisClient) TTL(key string) (ttl time.Duration, ok bool) {
 // It is possible to push multiple elements using a single command call just specifying multiple arguments
 // at the end of the command. Elements are inserted one after the other to the head of the list,
 // from the leftmost element to the rightmost element.
-func (client *TestRedisClient) LPush(key string, value ...string) bool {
+func (client *TestRedisClient) LPush(key string, value ...string) (total int, err error) {
 
 	lock.Lock()
 	defer lock.Unlock()
@@ -122,23 +126,23 @@ func (client *TestRedisClient) LPush(key string, value ...string) bool {
 	list, err := client.findList(key)
 
 	if err != nil {
-		return false
+		return 0, err
 	}
 
 	client.storeList(key, append(value, list...))
-	return true
+	return len(list) + len(value), nil
 }
 
-//LLen returns the length of the list stored at key.
-//If key does not exist, it is interpreted as an empty list and 0 is returned.
-//An error is returned when the value stored at key is not a list.
-func (client *TestRedisClient) LLen(key string) (affected int, ok bool) {
+// LLen returns the length of the list stored at key.
+// If key does not exist, it is interpreted as an empty list and 0 is returned.
+// An error is returned when the value stored at key is not a list.
+func (client *TestRedisClient) LLen(key string) (affected int, err error) {
 	list, err := client.findList(key)
 
 	if err != nil {
-		return 0, false
+		return 0, err
 	}
-	return len(list), true
+	return len(list), nil
 }
 
 // LRem removes the first count occurrences of elements equal to
@@ -150,16 +154,21 @@ func (client *TestRedisClient) LLen(key string) (affected int, ok bool) {
 // LREM list -2 "hello" will remove the last two occurrences of "hello" in
 // the list stored at list. Note that non-existing keys are treated like empty
 // lists, so when key does not exist, the command will always return 0.
-func (client *TestRedisClient) LRem(key string, count int, value string) (affected int, ok bool) {
+func (client *TestRedisClient) LRem(key string, count int, value string) (affected int, err error) {
 
 	lock.Lock()
 	defer lock.Unlock()
 
 	list, err := client.findList(key)
 
-	//Wasn't a list, or is empty
-	if err != nil || len(list) == 0 {
-		return 0, true
+	//Wasn't a list
+	if err != nil {
+		return 0, err
+	}
+
+	//Is empty
+	if len(list) == 0 {
+		return 0, nil
 	}
 
 	//Create a list that have the capacity to store
@@ -168,10 +177,6 @@ func (client *TestRedisClient) LRem(key string, count int, value string) (affect
 	//very long list
 	newList := make([]string, 0, len(list))
 
-	if err != nil {
-		return 0, false
-	}
-
 	//left to right removal of count elements
 	if count >= 0 {
 
@@ -209,7 +214,7 @@ func (client *TestRedisClient) LRem(key string, count int, value string) (affect
 	//store the updated list
 	client.storeList(key, newList)
 
-	return affected, true
+	return affected, nil
 }
 
 // LTrim trims an existing list so that it will contain only the specified range of elements specified.
@@ -221,16 +226,21 @@ func (client *TestRedisClient) LRem(key string, count int, value string) (affect
 // Out of range indexes will not produce an error: if start is larger than the end of the list,
 // or start > end, the result will be an empty list (which causes key to be removed).
 // If end is larger than the end of the list, Redis will treat it like the last element of the list
-func (client *TestRedisClient) LTrim(key string, start, stop int) {
+func (client *TestRedisClient) LTrim(key string, start, stop int) error {
 
 	lock.Lock()
 	defer lock.Unlock()
 
 	list, err := client.findList(key)
 
-	//Wasn't a list, or is empty
-	if err != nil || len(list) == 0 {
-		return
+	//Wasn't a list
+	if err != nil {
+		return err
+	}
+
+	//Is empty
+	if len(list) == 0 {
+		return nil
 	}
 
 	if start < 0 {
@@ -243,10 +253,11 @@ func (client *TestRedisClient) LTrim(key string, start, stop int) {
 	//invalid values cause the remove of the key
 	if start > stop {
 		client.store.Delete(key)
-		return
+		return nil
 	}
 
 	client.storeList(key, list[start:stop])
+	return nil
 }
 
 // RPopLPush atomically returns and removes the last element (tail) of the list stored at source,
@@ -257,17 +268,18 @@ func (client *TestRedisClient) LTrim(key string, start, stop int) {
 // If source and destination are the same, the operation is equivalent to removing the
 // last element from the list and pushing it as first element of the list,
 // so it can be considered as a list rotation command.
-func (client *TestRedisClient) RPopLPush(source, destination string) (value string, ok bool) {
+func (client *TestRedisClient) RPopLPush(source, destination string) (value string, err error) {
 
 	lock.Lock()
 	defer lock.Unlock()
 
 	sourceList, sourceErr := client.findList(source)
+	if sourceErr != nil {
+		return "", sourceErr
+	}
 	destList, destErr := client.findList(destination)
-
-	//One of the two isn't a list
-	if sourceErr != nil || destErr != nil {
-		return "", false
+	if destErr != nil {
+		return "", destErr
 	}
 	//we have one element to move
 	if len(sourceList) > 0 {
@@ -276,10 +288,27 @@ func (client *TestRedisClient) RPopLPush(source, destination string) (value stri
 		//Put the last element of source (tail) and prepend it to dest
 		client.storeList(destination, append([]string{sourceList[len(sourceList)-1]}, destList...))
 
-		return sourceList[len(sourceList)-1], true
+		return sourceList[len(sourceList)-1], nil
 	}
 
-	return "", false
+	return "", ErrNotFound
+}
+
+// BRPopLPush is the blocking variant of RPopLPush. When source is empty it
+// waits for another client to push to it until timeout elapses.
+// A timeout of zero blocks indefinitely.
+func (client *TestRedisClient) BRPopLPush(source, destination string, timeout time.Duration) (value string, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		value, err = client.RPopLPush(source, destination)
+		if err != ErrNotFound {
+			return value, err
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			return "", ErrNotFound
+		}
+		time.Sleep(time.Millisecond)
+	}
 }
 
 // LRange returns the specified elements of the list stored at key.
@@ -315,27 +344,31 @@ func (client *TestRedisClient) LRange(key string, start, end int) []string {
 // Specified members that are already a member of this set are ignored.
 // If key does not exist, a new set is created before adding the specified members.
 // An error is returned when the value stored at key is not a set.
-func (client *TestRedisClient) SAdd(key, value string) bool {
+func (client *TestRedisClient) SAdd(key, value string) (total int, err error) {
 
 	lock.Lock()
 	defer lock.Unlock()
 
 	set, err := client.findSet(key)
 	if err != nil {
-		return false
+		return 0, err
+	}
+
+	if _, found := set[value]; found {
+		return 0, nil
 	}
 
 	set[value] = struct{}{}
 	client.storeSet(key, set)
-	return true
+	return 1, nil
 }
 
 // SMembers returns all the members of the set value stored at key.
 // This has the same effect as running SINTER with one argument key.
-func (client *TestRedisClient) SMembers(key string) (members []string) {
+func (client *TestRedisClient) SMembers(key string) (members []string, err error) {
 	set, err := client.findSet(key)
 	if err != nil {
-		return members
+		return nil, err
 	}
 
 	members = make([]string, 0, len(set))
@@ -343,43 +376,472 @@ func (client *TestRedisClient) SMembers(key string) (members []string) {
 		members = append(members, k)
 	}
 
-	return members
+	return members, nil
 }
 
 // SRem removes the specified members from the set stored at key.
 // Specified members that are not a member of this set are ignored.
 // If key does not exist, it is treated as an empty set and this command returns 0.
 // An error is returned when the value stored at key is not a set.
-func (client *TestRedisClient) SRem(key, value string) (affected int, ok bool) {
+func (client *TestRedisClient) SRem(key, value string) (affected int, err error) {
 
 	lock.Lock()
 	defer lock.Unlock()
 
 	set, err := client.findSet(key)
-	if err != nil || len(set) == 0 {
-		return 0, false
+	if err != nil {
+		return 0, err
 	}
 
 	if _, found := set[value]; found != false {
 		delete(set, value)
-		return 1, true
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+// ZAdd adds the specified member with the specified score to the sorted set stored at key.
+// If the member is already a member of the sorted set, the score is updated and
+// the element reinserted at the right position to ensure the correct ordering.
+// If key does not exist, a new sorted set with the specified member as sole member is created.
+// Returns the number of elements added to the sorted set, not including elements already existing
+// for which the score was updated.
+func (client *TestRedisClient) ZAdd(key string, score float64, member string) (total int, err error) {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	sortedSet, err := client.findSortedSet(key)
+	if err != nil {
+		return 0, err
+	}
+
+	_, found := sortedSet[member]
+	sortedSet[member] = score
+	client.storeSortedSet(key, sortedSet)
+
+	if found {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// ZCard returns the sorted set cardinality (number of elements) of the sorted set stored at key.
+// If key does not exist, it is interpreted as an empty sorted set and 0 is returned.
+func (client *TestRedisClient) ZCard(key string) (count int, err error) {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	sortedSet, err := client.findSortedSet(key)
+	if err != nil {
+		return 0, err
+	}
+	return len(sortedSet), nil
+}
+
+// ZRangeByScore returns up to count elements in the sorted set at key with a score
+// between min and max (including elements with score equal to min or max).
+// The elements are considered to be ordered from low to high scores,
+// elements with the same score are returned in lexicographical order.
+func (client *TestRedisClient) ZRangeByScore(key string, min, max float64, count int) (members []string, err error) {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	return client.zRangeByScore(key, min, max, count)
+}
+
+// zRangeByScore is ZRangeByScore for callers which hold the lock
+func (client *TestRedisClient) zRangeByScore(key string, min, max float64, count int) (members []string, err error) {
+	sortedSet, err := client.findSortedSet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	members = []string{}
+	for member, score := range sortedSet {
+		if score >= min && score <= max {
+			members = append(members, member)
+		}
 	}
 
-	return 0, true
+	sort.Slice(members, func(i, j int) bool {
+		if sortedSet[members[i]] != sortedSet[members[j]] {
+			return sortedSet[members[i]] < sortedSet[members[j]]
+		}
+		return members[i] < members[j]
+	})
+
+	if count >= 0 && count < len(members) {
+		members = members[:count]
+	}
+	return members, nil
+}
+
+// ZRem removes the specified member from the sorted set stored at key.
+// Non existing members are ignored.
+// An error is returned when key exists and does not hold a sorted set.
+func (client *TestRedisClient) ZRem(key, member string) (affected int, err error) {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	sortedSet, err := client.findSortedSet(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, found := sortedSet[member]; found {
+		delete(sortedSet, member)
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+// RunScript runs an in process equivalent of the scripts of this package.
+// Other scripts can't be run and return an error.
+func (client *TestRedisClient) RunScript(script *Script, keys []string, args ...string) (result int, err error) {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	switch script.Name {
+	case moveScript.Name:
+		return client.runMove(keys[0], keys[1], args[0], args[1])
+
+	case delayScript.Name:
+		score, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return 0, err
+		}
+		return client.runDelay(keys[0], keys[1], args[0], score, args[2])
+
+	case returnScript.Name:
+		count, err := strconv.Atoi(args[0])
+		if err != nil {
+			return 0, err
+		}
+		return client.runReturn(keys[0], keys[1], keys[2], count)
+
+	case moveDelayedScript.Name:
+		now, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return 0, err
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil {
+			return 0, err
+		}
+		return client.runMoveDelayed(keys[0], keys[1], keys[2], now, count)
+
+	case lockScript.Name:
+		ttl, err := strconv.Atoi(args[1])
+		if err != nil {
+			return 0, err
+		}
+		return client.runLock(keys[0], args[0], time.Duration(ttl)*time.Millisecond), nil
+
+	case unlockScript.Name:
+		return client.runUnlock(keys[0], args[0]), nil
+
+	case publishUniqueScript.Name:
+		window, err := strconv.Atoi(args[0])
+		if err != nil {
+			return 0, err
+		}
+		return client.runPublishUnique(keys[0], keys[1], time.Duration(window)*time.Millisecond, args[1])
+
+	case returnLeasesScript.Name:
+		now, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return 0, err
+		}
+		return client.runReturnLeases(keys[0], keys[1], keys[2], keys[3], now)
+
+	case extendLeaseScript.Name:
+		score, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return 0, err
+		}
+		return client.runExtendLease(keys[0], score, args[1])
+
+	case takeTokensScript.Name:
+		values := make([]float64, 4) // capacity, period, now, count
+		for i := range values {
+			if values[i], err = strconv.ParseFloat(args[i], 64); err != nil {
+				return 0, err
+			}
+		}
+		return client.runTakeTokens(keys[0], values[0], values[1], values[2], int(values[3])), nil
+
+	case migrateListScript.Name:
+		count, err := strconv.Atoi(args[0])
+		if err != nil {
+			return 0, err
+		}
+		return client.runMigrateList(keys[0], keys[1], count)
+
+	case migrateScript.Name:
+		return client.runMigrate(keys[0], keys[1]) // the type is known from the stored value
+	}
+
+	return 0, fmt.Errorf("rmq TestRedisClient can't run script %s", script.Name)
+}
+
+// runMove is the in process equivalent of moveScript
+func (client *TestRedisClient) runMove(source, destination, value, pushValue string) (int, error) {
+	removed, err := client.removeFromList(source, value)
+	if err != nil || !removed {
+		return 0, err
+	}
+
+	destList, err := client.findList(destination)
+	if err != nil {
+		return 0, err
+	}
+	client.storeList(destination, append([]string{pushValue}, destList...))
+	return 1, nil
+}
+
+// runDelay is the in process equivalent of delayScript
+func (client *TestRedisClient) runDelay(source, destination, value string, score float64, member string) (int, error) {
+	removed, err := client.removeFromList(source, value)
+	if err != nil || !removed {
+		return 0, err
+	}
+
+	sortedSet, err := client.findSortedSet(destination)
+	if err != nil {
+		return 0, err
+	}
+	sortedSet[member] = score
+	client.storeSortedSet(destination, sortedSet)
+	return 1, nil
+}
+
+// runReturn is the in process equivalent of returnScript
+func (client *TestRedisClient) runReturn(source, ready, priorities string, count int) (int, error) {
+	sourceList, err := client.findList(source)
+	if err != nil {
+		return 0, err
+	}
+
+	if count > len(sourceList) {
+		count = len(sourceList)
+	}
+
+	//the tail of source ends up at the head of the ready lists in the same order
+	for moved := 0; moved < count; moved++ {
+		value := sourceList[len(sourceList)-1]
+		sourceList = sourceList[:len(sourceList)-1]
+		client.storeList(source, sourceList)
+		if err := client.pushReady(ready, priorities, value); err != nil {
+			return moved, err
+		}
+	}
+	return count, nil
+}
+
+// runMoveDelayed is the in process equivalent of moveDelayedScript
+func (client *TestRedisClient) runMoveDelayed(source, ready, priorities string, now float64, count int) (int, error) {
+	members, err := client.zRangeByScore(source, math.Inf(-1), now, count)
+	if err != nil {
+		return 0, err
+	}
+	sortedSet, err := client.findSortedSet(source)
+	if err != nil {
+		return 0, err
+	}
+	for moved, member := range members {
+		delete(sortedSet, member)
+		if err := client.pushReady(ready, priorities, member); err != nil {
+			return moved, err
+		}
+	}
+	return len(members), nil
+}
+
+// pushReady is the in process equivalent of pushing to the ready_key of
+// readyKeyFunction
+func (client *TestRedisClient) pushReady(ready, priorities, value string) error {
+	key := ready
+	if priority := decodeEnvelope(value).Priority; priority != 0 {
+		set, err := client.findSet(priorities)
+		if err != nil {
+			return err
+		}
+		set[strconv.Itoa(priority)] = struct{}{}
+		client.storeSet(priorities, set)
+		key = ready + "::priority::" + strconv.Itoa(priority)
+	}
+
+	list, err := client.findList(key)
+	if err != nil {
+		return err
+	}
+	client.storeList(key, append([]string{value}, list...))
+	return nil
+}
+
+// runLock is the in process equivalent of lockScript
+func (client *TestRedisClient) runLock(key, token string, ttl time.Duration) int {
+	if owner := client.findString(key); owner != "" && owner != token {
+		return 0
+	}
+
+	client.store.Store(key, token)
+	client.ttl.Store(key, time.Now().Add(ttl).Unix())
+	return 1
+}
+
+// runUnlock is the in process equivalent of unlockScript
+func (client *TestRedisClient) runUnlock(key, token string) int {
+	if client.findString(key) != token {
+		return 0
+	}
+
+	client.store.Delete(key)
+	client.ttl.Delete(key)
+	return 1
+}
+
+// runPublishUnique is the in process equivalent of publishUniqueScript
+func (client *TestRedisClient) runPublishUnique(key, destination string, window time.Duration, value string) (int, error) {
+	if client.findString(key) != "" {
+		return 0, nil
+	}
+
+	destList, err := client.findList(destination)
+	if err != nil {
+		return 0, err
+	}
+	client.store.Store(key, "1")
+	client.ttl.Store(key, time.Now().Add(window).Unix())
+	client.storeList(destination, append([]string{value}, destList...))
+	return 1, nil
+}
+
+// runReturnLeases is the in process equivalent of returnLeasesScript
+func (client *TestRedisClient) runReturnLeases(leases, source, ready, priorities string, now float64) (int, error) {
+	sortedSet, err := client.findSortedSet(leases)
+	if err != nil {
+		return 0, err
+	}
+
+	returned := 0
+	for member, score := range sortedSet {
+		if score > now {
+			continue
+		}
+		delete(sortedSet, member)
+		removed, err := client.removeFromList(source, member)
+		if err != nil {
+			return returned, err
+		}
+		if !removed {
+			continue
+		}
+		if err := client.pushReady(ready, priorities, member); err != nil {
+			return returned, err
+		}
+		returned++
+	}
+	return returned, nil
+}
+
+// runExtendLease is the in process equivalent of extendLeaseScript
+func (client *TestRedisClient) runExtendLease(leases string, score float64, member string) (int, error) {
+	sortedSet, err := client.findSortedSet(leases)
+	if err != nil {
+		return 0, err
+	}
+	if _, found := sortedSet[member]; !found {
+		return 0, nil
+	}
+	sortedSet[member] = score
+	return 1, nil
+}
+
+// runTakeTokens is the in process equivalent of takeTokensScript
+func (client *TestRedisClient) runTakeTokens(key string, capacity, period, now float64, count int) int {
+	bucket := parseTokenBucket(client.findString(key), capacity, period, now)
+	taken := bucket.take(now, count)
+	client.store.Store(key, bucket.String())
+	client.ttl.Store(key, time.Now().Add(time.Duration(period)*time.Millisecond).Unix())
+	return taken
+}
+
+// runMigrateList is the in process equivalent of migrateListScript
+func (client *TestRedisClient) runMigrateList(source, destination string, count int) (int, error) {
+	sourceList, err := client.findList(source)
+	if err != nil {
+		return 0, err
+	}
+	destList, err := client.findList(destination)
+	if err != nil {
+		return 0, err
+	}
+
+	if count > len(sourceList) {
+		count = len(sourceList)
+	}
+	client.storeList(destination, append(destList, sourceList[:count]...))
+	client.storeList(source, sourceList[count:])
+	return count, nil
+}
+
+// runMigrate is the in process equivalent of migrateScript
+func (client *TestRedisClient) runMigrate(source, destination string) (int, error) {
+	storedValue, found := client.store.Load(source)
+	if !found {
+		return 0, nil
+	}
+
+	switch value := storedValue.(type) {
+	case map[string]struct{}:
+		destSet, err := client.findSet(destination)
+		if err != nil {
+			return 0, err
+		}
+		for member := range value {
+			destSet[member] = struct{}{}
+		}
+		client.storeSet(destination, destSet)
+
+	case map[string]float64:
+		destSortedSet, err := client.findSortedSet(destination)
+		if err != nil {
+			return 0, err
+		}
+		for member, score := range value {
+			destSortedSet[member] = score
+		}
+		client.storeSortedSet(destination, destSortedSet)
+
+	default:
+		return 0, nil
+	}
+
+	client.store.Delete(source)
+	return 1, nil
 }
 
 // FlushDb delete all the keys of the currently selected DB. This command never fails.
-func (client *TestRedisClient) FlushDb() {
+func (client *TestRedisClient) FlushDb() error {
 	client.store = *new(sync.Map)
 	client.ttl = *new(sync.Map)
+	return nil
 }
 
-//storeSet stores a set
+// storeSet stores a set
 func (client *TestRedisClient) storeSet(key string, set map[string]struct{}) {
 	client.store.Store(key, set)
 }
 
-//findSet finds a set
+// findSet finds a set
 func (client *TestRedisClient) findSet(key string) (map[string]struct{}, error) {
 	//Lookup the store for the list
 	storedValue, found := client.store.Load(key)
@@ -398,14 +860,68 @@ func (client *TestRedisClient) findSet(key string) (map[string]struct{}, error)
 	return make(map[string]struct{}), nil
 }
 
-//storeList is an helper function so others don't have to deal with pointers
+// storeSortedSet stores a sorted set
+func (client *TestRedisClient) storeSortedSet(key string, sortedSet map[string]float64) {
+	client.store.Store(key, sortedSet)
+}
+
+// findSortedSet finds a sorted set
+func (client *TestRedisClient) findSortedSet(key string) (map[string]float64, error) {
+	//Lookup the store for the sorted set
+	storedValue, found := client.store.Load(key)
+	if found {
+		//sorted sets are stored as map from member to score
+		sortedSet, casted := storedValue.(map[string]float64)
+
+		if casted {
+			return sortedSet, nil
+		}
+
+		return nil, errors.New("Stored value wasn't a sorted set")
+	}
+
+	//return an empty sorted set if not found
+	return make(map[string]float64), nil
+}
+
+// findString returns the string stored at key, empty if it doesn't exist or expired
+func (client *TestRedisClient) findString(key string) string {
+	if expiration, found := client.ttl.Load(key); found && expiration.(int64) < time.Now().Unix() {
+		return ""
+	}
+	value, _ := client.store.Load(key)
+	stringValue, _ := value.(string)
+	return stringValue
+}
+
+// removeFromList removes the first occurrence of value from the list stored at key
+// the caller has to hold the lock
+func (client *TestRedisClient) removeFromList(key, value string) (removed bool, err error) {
+	list, err := client.findList(key)
+	if err != nil {
+		return false, err
+	}
+
+	for index := range list {
+		if list[index] == value {
+			newList := make([]string, 0, len(list)-1)
+			newList = append(newList, list[:index]...)
+			client.storeList(key, append(newList, list[index+1:]...))
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// storeList is an helper function so others don't have to deal with pointers
 func (client *TestRedisClient) storeList(key string, list []string) {
 	client.store.Store(key, &list)
 }
 
-//findList returns the list stored at key.
-//if key doesn't exist, an empty list is returned
-//an error is returned when the value at key isn't a list
+// findList returns the list stored at key.
+// if key doesn't exist, an empty list is returned
+// an error is returned when the value at key isn't a list
 func (client *TestRedisClient) findList(key string) ([]string, error) {
 	//Lookup the store for the list
 	storedValue, found := client.store.Load(key)
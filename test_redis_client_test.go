@@ -16,7 +16,7 @@ func TestTestRedisClient_Set(t *testing.T) {
 		name   string
 		client *TestRedisClient
 		args   args
-		want   bool
+		want   error
 	}{
 		{
 			"successfull add",
@@ -26,7 +26,7 @@ func TestTestRedisClient_Set(t *testing.T) {
 				"somevalue",
 				time.Duration(0),
 			},
-			true,
+			nil,
 		},
 	}
 	for _, tt := range tests {
@@ -43,13 +43,13 @@ func TestTestRedisClient_Set(t *testing.T) {
 			}
 
 			//delete
-			if affected, found := tt.client.Del(tt.args.key); affected != 1 || found != true {
-				t.Errorf("TestRedisClient.Del(%v) =, want %v, %v", tt.args.key, 1, true)
+			if affected, err := tt.client.Del(tt.args.key); affected != 1 || err != nil {
+				t.Errorf("TestRedisClient.Del(%v) = %v, %v want %v, %v", tt.args.key, affected, err, 1, nil)
 			}
 
 			//delete it again
-			if affected, found := tt.client.Del(tt.args.key); affected != 0 || found != false {
-				t.Errorf("TestRedisClient.Del(%v) =, want %v, %v", tt.args.key, 0, false)
+			if affected, err := tt.client.Del(tt.args.key); affected != 0 || err != nil {
+				t.Errorf("TestRedisClient.Del(%v) = %v, %v want %v, %v", tt.args.key, affected, err, 0, nil)
 			}
 		})
 	}
@@ -64,7 +64,7 @@ func TestTestRedisClient_SAdd(t *testing.T) {
 		name   string
 		client *TestRedisClient
 		args   args
-		want   bool
+		want   int
 	}{
 		{
 			"adding member",
@@ -73,25 +73,26 @@ func TestTestRedisClient_SAdd(t *testing.T) {
 				"somekey",
 				"somevalue",
 			},
-			true,
+			1,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := tt.client.SAdd(tt.args.key, tt.args.value); got != tt.want {
-				t.Errorf("TestRedisClient.SAdd() = %v, want %v", got, tt.want)
+			if got, err := tt.client.SAdd(tt.args.key, tt.args.value); got != tt.want || err != nil {
+				t.Errorf("TestRedisClient.SAdd() = %v, %v want %v, %v", got, err, tt.want, nil)
 			}
 
-			if got := tt.client.SAdd(tt.args.key, tt.args.value); got != tt.want {
-				t.Errorf("TestRedisClient.SAdd() = %v, want %v", got, tt.want)
+			//adding it again
+			if got, err := tt.client.SAdd(tt.args.key, tt.args.value); got != 0 || err != nil {
+				t.Errorf("TestRedisClient.SAdd() = %v, %v want %v, %v", got, err, 0, nil)
 			}
 
-			if got := tt.client.SMembers(tt.args.key); len(got) != 1 || strings.Compare(got[0], tt.args.value) != 0 {
-				t.Errorf("TestRedisClient.SMembers(%v) = %v, want %v", tt.args.key, got, []string{tt.args.value})
+			if got, err := tt.client.SMembers(tt.args.key); len(got) != 1 || strings.Compare(got[0], tt.args.value) != 0 || err != nil {
+				t.Errorf("TestRedisClient.SMembers(%v) = %v, %v want %v, %v", tt.args.key, got, err, []string{tt.args.value}, nil)
 			}
 
-			if got, ok := tt.client.SRem(tt.args.key, tt.args.value); got != 1 || ok != true {
-				t.Errorf("TestRedisClient.SRem(%v, %v) = %v, %v, want %v, %v", tt.args.key, tt.args.value, got, ok, 1, true)
+			if got, err := tt.client.SRem(tt.args.key, tt.args.value); got != 1 || err != nil {
+				t.Errorf("TestRedisClient.SRem(%v, %v) = %v, %v, want %v, %v", tt.args.key, tt.args.value, got, err, 1, nil)
 			}
 		})
 	}
@@ -106,7 +107,7 @@ func TestTestRedisClient_LPush(t *testing.T) {
 		name   string
 		client *TestRedisClient
 		args   args
-		want   bool
+		want   int
 	}{
 		{
 			"adding to list",
@@ -115,25 +116,25 @@ func TestTestRedisClient_LPush(t *testing.T) {
 				"somekey",
 				"somevalue",
 			},
-			true,
+			1,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
 			//Push
-			if got := tt.client.LPush(tt.args.key, tt.args.value); got != tt.want {
-				t.Errorf("TestRedisClient.LPush() = %v, want %v", got, tt.want)
+			if got, err := tt.client.LPush(tt.args.key, tt.args.value); got != tt.want || err != nil {
+				t.Errorf("TestRedisClient.LPush() = %v, %v want %v, %v", got, err, tt.want, nil)
 			}
 
 			//Len
-			if got, ok := tt.client.LLen(tt.args.key); got != 1 || ok != true {
-				t.Errorf("TestRedisClient.LLen(%v) = %v, %v want %v, %v", tt.args.key, got, ok, 1, true)
+			if got, err := tt.client.LLen(tt.args.key); got != 1 || err != nil {
+				t.Errorf("TestRedisClient.LLen(%v) = %v, %v want %v, %v", tt.args.key, got, err, 1, nil)
 			}
 
 			//Len of non-existing
-			if got, ok := tt.client.LLen(tt.args.key + "nonsense"); got != 0 || ok != true {
-				t.Errorf("TestRedisClient.LLen(%vnonsense) = %v, %v want %v, %v", tt.args.key, got, ok, 0, true)
+			if got, err := tt.client.LLen(tt.args.key + "nonsense"); got != 0 || err != nil {
+				t.Errorf("TestRedisClient.LLen(%vnonsense) = %v, %v want %v, %v", tt.args.key, got, err, 0, nil)
 			}
 
 			//Range
@@ -142,14 +143,221 @@ func TestTestRedisClient_LPush(t *testing.T) {
 			}
 
 			//Lrem
-			if got, ok := tt.client.LRem(tt.args.key, 100, tt.args.value); got != 1 || ok != true {
-				t.Errorf("TestRedisClient.LRem(%v, 100, %v) = %v, %v want %v, %v", tt.args.key, tt.args.value, got, ok, 1, true)
+			if got, err := tt.client.LRem(tt.args.key, 100, tt.args.value); got != 1 || err != nil {
+				t.Errorf("TestRedisClient.LRem(%v, 100, %v) = %v, %v want %v, %v", tt.args.key, tt.args.value, got, err, 1, nil)
 			}
 
 			//Len again
-			if got, ok := tt.client.LLen(tt.args.key); got != 0 || ok != true {
-				t.Errorf("TestRedisClient.LLen(%v) = %v, %v want %v, %v", tt.args.key, got, ok, 0, true)
+			if got, err := tt.client.LLen(tt.args.key); got != 0 || err != nil {
+				t.Errorf("TestRedisClient.LLen(%v) = %v, %v want %v, %v", tt.args.key, got, err, 0, nil)
+			}
+
+			//Pop from empty list
+			if got, err := tt.client.RPopLPush(tt.args.key, tt.args.key+"dest"); got != "" || err != ErrNotFound {
+				t.Errorf("TestRedisClient.RPopLPush(%v, %vdest) = %v, %v want %v, %v", tt.args.key, tt.args.key, got, err, "", ErrNotFound)
 			}
 		})
 	}
 }
+
+func TestTestRedisClient_ZAdd(t *testing.T) {
+	client := NewTestRedisClient()
+
+	if got, err := client.ZAdd("somekey", 2, "second"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.ZAdd() = %v, %v want %v, %v", got, err, 1, nil)
+	}
+	if got, err := client.ZAdd("somekey", 1, "first"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.ZAdd() = %v, %v want %v, %v", got, err, 1, nil)
+	}
+
+	//updating score
+	if got, err := client.ZAdd("somekey", 3, "second"); got != 0 || err != nil {
+		t.Errorf("TestRedisClient.ZAdd() = %v, %v want %v, %v", got, err, 0, nil)
+	}
+
+	if got, err := client.ZCard("somekey"); got != 2 || err != nil {
+		t.Errorf("TestRedisClient.ZCard() = %v, %v want %v, %v", got, err, 2, nil)
+	}
+
+	if got, err := client.ZRangeByScore("somekey", 0, 3, 10); len(got) != 2 || got[0] != "first" || got[1] != "second" || err != nil {
+		t.Errorf("TestRedisClient.ZRangeByScore(0, 3) = %v, %v want %v, %v", got, err, []string{"first", "second"}, nil)
+	}
+
+	if got, err := client.ZRangeByScore("somekey", 0, 2, 10); len(got) != 1 || got[0] != "first" || err != nil {
+		t.Errorf("TestRedisClient.ZRangeByScore(0, 2) = %v, %v want %v, %v", got, err, []string{"first"}, nil)
+	}
+
+	if got, err := client.ZRangeByScore("somekey", 0, 3, 1); len(got) != 1 || got[0] != "first" || err != nil {
+		t.Errorf("TestRedisClient.ZRangeByScore(0, 3, 1) = %v, %v want %v, %v", got, err, []string{"first"}, nil)
+	}
+
+	if got, err := client.ZRem("somekey", "first"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.ZRem() = %v, %v want %v, %v", got, err, 1, nil)
+	}
+	if got, err := client.ZRem("somekey", "first"); got != 0 || err != nil {
+		t.Errorf("TestRedisClient.ZRem() = %v, %v want %v, %v", got, err, 0, nil)
+	}
+}
+
+func TestTestRedisClient_BRPopLPush(t *testing.T) {
+	client := NewTestRedisClient()
+
+	//Pop from empty list times out
+	if got, err := client.BRPopLPush("somekey", "destkey", 5*time.Millisecond); got != "" || err != ErrNotFound {
+		t.Errorf("TestRedisClient.BRPopLPush() = %v, %v want %v, %v", got, err, "", ErrNotFound)
+	}
+
+	//Pop waits for push
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		client.LPush("somekey", "value")
+	}()
+	if got, err := client.BRPopLPush("somekey", "destkey", time.Second); got != "value" || err != nil {
+		t.Errorf("TestRedisClient.BRPopLPush() = %v, %v want %v, %v", got, err, "value", nil)
+	}
+
+	if got, err := client.LLen("destkey"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.LLen(destkey) = %v, %v want %v, %v", got, err, 1, nil)
+	}
+}
+
+func TestTestRedisClient_RunScript(t *testing.T) {
+	client := NewTestRedisClient()
+	client.LPush("unacked", "a", "b", "c")
+
+	if got, err := client.RunScript(moveScript, []string{"unacked", "rejected"}, "b", "b2"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(move) = %v, %v want %v, %v", got, err, 1, nil)
+	}
+	if got := client.LRange("rejected", 0, 100); len(got) != 1 || got[0] != "b2" {
+		t.Errorf("TestRedisClient.LRange(rejected) = %v want %v", got, []string{"b2"})
+	}
+
+	//moving a missing value doesn't push
+	if got, err := client.RunScript(moveScript, []string{"unacked", "rejected"}, "b", "b2"); got != 0 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(move) = %v, %v want %v, %v", got, err, 0, nil)
+	}
+	if got, err := client.LLen("rejected"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.LLen(rejected) = %v, %v want %v, %v", got, err, 1, nil)
+	}
+
+	if got, err := client.RunScript(delayScript, []string{"unacked", "delayed"}, "a", "5", "a2"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(delay) = %v, %v want %v, %v", got, err, 1, nil)
+	}
+	if got, err := client.ZRangeByScore("delayed", 0, 10, 10); len(got) != 1 || got[0] != "a2" || err != nil {
+		t.Errorf("TestRedisClient.ZRangeByScore(delayed) = %v, %v want %v, %v", got, err, []string{"a2"}, nil)
+	}
+
+	client.ZAdd("delayed", 3, "y")
+	client.ZAdd("delayed", 4, "z")
+	client.ZAdd("delayed", 20, "later")
+	if got, err := client.RunScript(moveDelayedScript, []string{"delayed", "due", "priorities"}, "10", "2"); got != 2 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(moveDelayed) = %v, %v want %v, %v", got, err, 2, nil)
+	}
+	if got := client.LRange("due", 0, 100); len(got) != 2 || got[0] != "z" || got[1] != "y" {
+		t.Errorf("TestRedisClient.LRange(due) = %v want %v", got, []string{"z", "y"})
+	}
+	if got, err := client.RunScript(moveDelayedScript, []string{"delayed", "due", "priorities"}, "10", "2"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(moveDelayed) = %v, %v want %v, %v", got, err, 1, nil)
+	}
+	if got, err := client.ZRangeByScore("delayed", 0, 100, 10); len(got) != 1 || got[0] != "later" || err != nil {
+		t.Errorf("TestRedisClient.ZRangeByScore(delayed) = %v, %v want %v, %v", got, err, []string{"later"}, nil)
+	}
+
+	client.LPush("rejected", "d")
+	client.LPush("rejected", "e")
+	if got, err := client.RunScript(returnScript, []string{"rejected", "ready", "priorities"}, "2"); got != 2 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(return) = %v, %v want %v, %v", got, err, 2, nil)
+	}
+	if got := client.LRange("ready", 0, 100); len(got) != 2 || got[0] != "d" || got[1] != "b2" {
+		t.Errorf("TestRedisClient.LRange(ready) = %v want %v", got, []string{"d", "b2"})
+	}
+	if got, err := client.RunScript(returnScript, []string{"rejected", "ready", "priorities"}, "5"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(return) = %v, %v want %v, %v", got, err, 1, nil)
+	}
+
+	prioritized := &envelope{ID: "p", Priority: 7, Payload: "p"}
+	client.LPush("rejected", prioritized.encode())
+	if got, err := client.RunScript(returnScript, []string{"rejected", "ready", "priorities"}, "5"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(return) = %v, %v want %v, %v", got, err, 1, nil)
+	}
+	if got, err := client.LLen("ready::priority::7"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.LLen(ready::priority::7) = %v, %v want %v, %v", got, err, 1, nil)
+	}
+	if got, err := client.SMembers("priorities"); len(got) != 1 || got[0] != "7" || err != nil {
+		t.Errorf("TestRedisClient.SMembers(priorities) = %v, %v want %v, %v", got, err, []string{"7"}, nil)
+	}
+
+	client.LPush("new", "f")
+	if got, err := client.RunScript(migrateListScript, []string{"ready", "new"}, "2"); got != 2 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(migrateList) = %v, %v want %v, %v", got, err, 2, nil)
+	}
+	if got, err := client.RunScript(migrateListScript, []string{"ready", "new"}, "2"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(migrateList) = %v, %v want %v, %v", got, err, 1, nil)
+	}
+	if got := client.LRange("new", 0, 100); len(got) != 4 || got[0] != "f" || got[3] != "b2" {
+		t.Errorf("TestRedisClient.LRange(new) = %v want %v", got, []string{"f", "e", "d", "b2"})
+	}
+	if got, err := client.RunScript(migrateListScript, []string{"ready", "new"}, "2"); got != 0 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(migrateList) = %v, %v want %v, %v", got, err, 0, nil)
+	}
+	client.SAdd("consumers", "c1")
+	if got, err := client.RunScript(migrateScript, []string{"consumers", "new-consumers"}, "set"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(migrate) = %v, %v want %v, %v", got, err, 1, nil)
+	}
+	if got, err := client.SMembers("new-consumers"); len(got) != 1 || got[0] != "c1" || err != nil {
+		t.Errorf("TestRedisClient.SMembers(new-consumers) = %v, %v want %v, %v", got, err, []string{"c1"}, nil)
+	}
+
+	if got, err := client.RunScript(publishUniqueScript, []string{"unique", "new"}, "60000", "g"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(publishUnique) = %v, %v want %v, %v", got, err, 1, nil)
+	}
+	if got, err := client.RunScript(publishUniqueScript, []string{"unique", "new"}, "60000", "h"); got != 0 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(publishUnique) = %v, %v want %v, %v", got, err, 0, nil)
+	}
+	if got, err := client.LLen("new"); got != 5 || err != nil {
+		t.Errorf("TestRedisClient.LLen(new) = %v, %v want %v, %v", got, err, 5, nil)
+	}
+
+	client.ZAdd("leases", 50, "c")
+	client.ZAdd("leases", 50, "x")
+	if got, err := client.RunScript(extendLeaseScript, []string{"leases"}, "5", "c"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(extendLease) = %v, %v want %v, %v", got, err, 1, nil)
+	}
+	if got, err := client.RunScript(extendLeaseScript, []string{"leases"}, "5", "y"); got != 0 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(extendLease) = %v, %v want %v, %v", got, err, 0, nil)
+	}
+	if got, err := client.RunScript(returnLeasesScript, []string{"leases", "unacked", "returned", "priorities"}, "10"); got != 1 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(returnLeases) = %v, %v want %v, %v", got, err, 1, nil)
+	}
+	if got := client.LRange("returned", 0, 100); len(got) != 1 || got[0] != "c" {
+		t.Errorf("TestRedisClient.LRange(returned) = %v want %v", got, []string{"c"})
+	}
+	//expired leases of deliveries which aren't unacked anymore are only removed
+	if got, err := client.RunScript(returnLeasesScript, []string{"leases", "unacked", "returned", "priorities"}, "100"); got != 0 || err != nil {
+		t.Errorf("TestRedisClient.RunScript(returnLeases) = %v, %v want %v, %v", got, err, 0, nil)
+	}
+	if got, err := client.ZCard("leases"); got != 0 || err != nil {
+		t.Errorf("TestRedisClient.ZCard(leases) = %v, %v want %v, %v", got, err, 0, nil)
+	}
+
+	//token bucket with 2 tokens per 1000ms
+	for _, call := range []struct {
+		now, count string
+		want       int
+	}{
+		{"0", "3", 2},
+		{"0", "1", 0},
+		{"500", "3", 1},
+		{"500", "-1", 0}, // gives back a token
+		{"500", "3", 1},
+		{"5000", "3", 2},
+	} {
+		if got, err := client.RunScript(takeTokensScript, []string{"bucket"}, "2", "1000", call.now, call.count); got != call.want || err != nil {
+			t.Errorf("TestRedisClient.RunScript(takeTokens, %s, %s) = %v, %v want %v, %v", call.now, call.count, got, err, call.want, nil)
+		}
+	}
+
+	if _, err := client.RunScript(newScript("unknown", "return 1"), nil); err == nil {
+		t.Errorf("TestRedisClient.RunScript(unknown) = %v want error", err)
+	}
+}